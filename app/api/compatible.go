@@ -1,6 +1,7 @@
 package api
 
 import (
+	"github.com/alioth-center/akasha-whisper/app/entity"
 	"github.com/alioth-center/akasha-whisper/app/service"
 	"github.com/alioth-center/infrastructure/network/http"
 	"github.com/alioth-center/infrastructure/thirdparty/openai"
@@ -12,18 +13,92 @@ type compatibleApiImpl struct {
 	service *service.CompatibleService
 }
 
-func (impl compatibleApiImpl) CompleteChat() http.Chain[*openai.CompleteChatRequestBody, *openai.CompleteChatResponseBody] {
-	return http.NewChain(impl.service.ChatComplete)
+func (impl compatibleApiImpl) CompleteChat() http.Chain[*entity.ChatCompletionRequest, *entity.ChatResponse] {
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*entity.ChatCompletionRequest, *entity.ChatResponse]),
+		impl.service.ChatComplete,
+	)
 }
 
 func (impl compatibleApiImpl) Embedding() http.Chain[*openai.EmbeddingRequestBody, *openai.EmbeddingResponseBody] {
-	return http.NewChain(impl.service.EmbeddingAuthorize, impl.service.Embedding)
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*openai.EmbeddingRequestBody, *openai.EmbeddingResponseBody]),
+		impl.service.Embedding,
+	)
 }
 
 func (impl compatibleApiImpl) ListModel() http.Chain[*openai.ListModelRequest, *openai.ListModelResponseBody] {
-	return http.NewChain(impl.service.ListModelAuthorize, impl.service.ListModel)
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*openai.ListModelRequest, *openai.ListModelResponseBody]),
+		impl.service.ListModel,
+	)
 }
 
 func (impl compatibleApiImpl) CreateSpeech() http.Chain[*openai.CreateSpeechRequestBody, *openai.CreateSpeechResponseBody] {
-	return http.NewChain(impl.service.CreateSpeechAuthorize, impl.service.CreateSpeech)
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*openai.CreateSpeechRequestBody, *openai.CreateSpeechResponseBody]),
+		impl.service.CreateSpeech,
+	)
+}
+
+func (impl compatibleApiImpl) ImageGeneration() http.Chain[*openai.CreateImageRequestBody, *openai.ImageResponseBody] {
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*openai.CreateImageRequestBody, *openai.ImageResponseBody]),
+		impl.service.ImageGeneration,
+	)
+}
+
+func (impl compatibleApiImpl) AudioTranscription() http.Chain[*entity.AudioRequest, *entity.AudioResponse] {
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*entity.AudioRequest, *entity.AudioResponse]),
+		impl.service.AudioTranscription,
+	)
+}
+
+func (impl compatibleApiImpl) AudioTranslation() http.Chain[*entity.AudioRequest, *entity.AudioResponse] {
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*entity.AudioRequest, *entity.AudioResponse]),
+		impl.service.AudioTranslation,
+	)
+}
+
+// AudioPreprocessors replaces the json body preprocessor with multipart form parsing
+func (impl compatibleApiImpl) AudioPreprocessors() []http.EndpointPreprocessor[*entity.AudioRequest, *entity.AudioResponse] {
+	return http.NewPreprocessors[*entity.AudioRequest, *entity.AudioResponse](
+		http.CheckRequestMethodPreprocessor[*entity.AudioRequest, *entity.AudioResponse],
+		http.LoadNormalRequestHeadersPreprocessor[*entity.AudioRequest, *entity.AudioResponse],
+		impl.service.AudioFormPreprocessor,
+	)
+}
+
+// CompatiblePreprocessors replaces the json body preprocessor with the one responds openai errors, the api key
+// is checked by the authorize stage, so the headers are not required by preprocessors
+func CompatiblePreprocessors[request any, response any]() []http.EndpointPreprocessor[request, response] {
+	return http.NewPreprocessors[request, response](
+		http.CheckRequestMethodPreprocessor[request, response],
+		http.CheckRequestHeadersPreprocessor[request, response],
+		http.LoadNormalRequestHeadersPreprocessor[request, response],
+		service.OpenaiBodyPreprocessor[request, response],
+	)
+}
+
+func (impl compatibleApiImpl) Completion() http.Chain[*entity.CompletionRequest, *entity.CompletionResponse] {
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*entity.CompletionRequest, *entity.CompletionResponse]),
+		impl.service.Completion,
+	)
+}
+
+func (impl compatibleApiImpl) Moderation() http.Chain[*entity.ModerationRequest, *entity.ModerationResponse] {
+	return http.NewChain(
+		service.Authorize(service.RenderOpenaiError[*entity.ModerationRequest, *entity.ModerationResponse]),
+		impl.service.Moderation,
+	)
+}
+
+func (impl compatibleApiImpl) Messages() http.Chain[*entity.AnthropicMessageRequest, *entity.AnthropicMessageResponse] {
+	return http.NewChain(
+		service.Authorize(impl.service.RenderAnthropicError),
+		impl.service.Messages,
+	)
 }
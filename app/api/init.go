@@ -7,4 +7,7 @@ import (
 func init() {
 	CompatibleApi = compatibleApiImpl{service: service.NewCompatibleService()}
 	ManagementApi = managementApiImpl{service: service.NewManagementService()}
+
+	// adjust the client weights in background if enabled
+	service.StartWeightTuning()
 }
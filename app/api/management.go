@@ -84,6 +84,13 @@ func (impl managementApiImpl) UpdateWhisperUser() http.Chain[*entity.UpdateWhisp
 	)
 }
 
+func (impl managementApiImpl) ListClientWeightLogs() http.Chain[*entity.ListClientWeightLogsRequest, *entity.ListClientWeightLogsResponse] {
+	return http.NewChain(
+		service.CheckManagementKey[*entity.ListClientWeightLogsRequest, []*entity.ClientWeightLog],
+		impl.service.ListClientWeightLogs,
+	)
+}
+
 func (impl managementApiImpl) ListWhisperUserBalanceLogs() http.Chain[*entity.ListWhisperUserBalanceLogsRequest, *entity.ListWhisperUserBalanceLogsResponse] {
 	return http.NewChain(
 		service.CheckManagementKey[*entity.ListWhisperUserBalanceLogsRequest, []*entity.WhisperUserBalanceLog],
@@ -0,0 +1,132 @@
+package dao
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/database"
+	"github.com/alioth-center/infrastructure/database/sqlite"
+	"github.com/alioth-center/infrastructure/trace"
+	"github.com/shopspring/decimal"
+)
+
+// TestCreateBalanceRecordConcurrently records balances of the same user or client at the same time, the records
+// are serialized by the lock of the row held by `UPDATE ... SET balance = balance + ?` until the transaction ends,
+// which sqlite, mysql (innodb) and postgres all provide, mysql and postgres are tested when testDatabaseEnvs are set.
+func TestCreateBalanceRecordConcurrently(t *testing.T) {
+	type balanceRecord struct {
+		change, remaining decimal.Decimal
+	}
+
+	subjects := []struct {
+		name    string
+		create  func(ctx context.Context, db database.DatabaseV2, id int, change decimal.Decimal) error
+		balance func(ctx context.Context, db database.DatabaseV2, id int) (decimal.Decimal, error)
+		records func(ctx context.Context, db database.DatabaseV2, id int) ([]balanceRecord, error)
+	}{
+		{
+			name: "WhisperUser",
+			create: func(ctx context.Context, db database.DatabaseV2, id int, change decimal.Decimal) error {
+				_, createErr := NewWhisperUserBalanceDatabaseAccessor(db).CreateBalanceRecord(ctx, id, change, model.WhisperUserBalanceActionConsumption)
+				return createErr
+			},
+			balance: func(ctx context.Context, db database.DatabaseV2, id int) (decimal.Decimal, error) {
+				current := &model.WhisperUser{}
+				queryErr := db.GetGormCore(ctx).Where(model.WhisperUserCols.ID, id).First(current).Error
+				return current.Balance, queryErr
+			},
+			records: func(ctx context.Context, db database.DatabaseV2, id int) ([]balanceRecord, error) {
+				records := make([]*model.WhisperUserBalance, 0)
+				queryErr := db.GetGormCore(ctx).Where(model.WhisperUserBalanceCols.UserID, id).Order(model.WhisperUserBalanceCols.ID).Find(&records).Error
+				result := make([]balanceRecord, len(records))
+				for i, record := range records {
+					result[i] = balanceRecord{change: record.BalanceChangeAmount, remaining: record.BalanceRemaining}
+				}
+				return result, queryErr
+			},
+		},
+		{
+			name: "OpenaiClient",
+			create: func(ctx context.Context, db database.DatabaseV2, id int, change decimal.Decimal) error {
+				_, createErr := NewOpenaiClientBalanceDatabaseAccessor(db).CreateBalanceRecord(ctx, id, change, model.OpenaiClientBalanceActionConsumption)
+				return createErr
+			},
+			balance: func(ctx context.Context, db database.DatabaseV2, id int) (decimal.Decimal, error) {
+				current := &model.OpenaiClient{}
+				queryErr := db.GetGormCore(ctx).Where(model.OpenaiClientCols.ID, id).First(current).Error
+				return current.Balance, queryErr
+			},
+			records: func(ctx context.Context, db database.DatabaseV2, id int) ([]balanceRecord, error) {
+				records := make([]*model.OpenaiClientBalance, 0)
+				queryErr := db.GetGormCore(ctx).Where(model.OpenaiClientBalanceCols.ClientID, id).Order(model.OpenaiClientBalanceCols.ID).Find(&records).Error
+				result := make([]balanceRecord, len(records))
+				for i, record := range records {
+					result[i] = balanceRecord{change: record.BalanceChangeAmount, remaining: record.BalanceRemaining}
+				}
+				return result, queryErr
+			},
+		},
+	}
+
+	for _, driverName := range []string{sqlite.DriverName, "mysql", "postgres"} {
+		for _, subject := range subjects {
+			t.Run(driverName+"/"+subject.name, func(t *testing.T) {
+				db := newTestDatabaseOfDriver(t, driverName)
+				user, client, _ := createTestRoute(t, db, "sk-user", "client", "gpt-4o", 1000)
+				id := int(user.ID)
+				if subject.name == "OpenaiClient" {
+					id = int(client.ID)
+				}
+
+				// consumptions and recharges are recorded at the same time
+				changes := make([]decimal.Decimal, 64)
+				for i := range changes {
+					changes[i] = decimal.NewFromFloat(-1.25)
+					if i%4 == 0 {
+						changes[i] = decimal.NewFromInt(3)
+					}
+				}
+
+				wg, expected := sync.WaitGroup{}, decimal.NewFromInt(1000)
+				for _, change := range changes {
+					expected = expected.Add(change)
+					wg.Add(1)
+					go func(change decimal.Decimal) {
+						defer wg.Done()
+						if createErr := subject.create(trace.NewContext(), db, id, change); createErr != nil {
+							t.Errorf("create balance record failed: %v", createErr)
+						}
+					}(change)
+				}
+				wg.Wait()
+
+				current, queryErr := subject.balance(trace.NewContext(), db, id)
+				if queryErr != nil {
+					t.Fatalf("query balance failed: %v", queryErr)
+				}
+				if !current.Equal(expected) {
+					t.Errorf("balance = %s, expected %s", current, expected)
+				}
+
+				// every record remains the balance after the previous record and its own change
+				records, queryErr := subject.records(trace.NewContext(), db, id)
+				if queryErr != nil {
+					t.Fatalf("query balance records failed: %v", queryErr)
+				}
+				if len(records) != len(changes)+1 {
+					t.Fatalf("balance records = %d, expected %d", len(records), len(changes)+1)
+				}
+				for i := 1; i < len(records); i++ {
+					if expected := records[i-1].remaining.Add(records[i].change); !records[i].remaining.Equal(expected) {
+						t.Errorf("remaining of record %d = %s, expected %s", i, records[i].remaining, expected)
+					}
+				}
+				if last := records[len(records)-1]; !last.remaining.Equal(current) {
+					t.Errorf("remaining of the last record = %s, expected %s", last.remaining, current)
+				}
+			})
+		}
+	}
+}
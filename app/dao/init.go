@@ -21,6 +21,7 @@ const (
 	RawsqlOpenaiClientListClients         RawsqlKey = "openai_client.list_clients.sql"
 	RawsqlWhisperUserGetUserInfo          RawsqlKey = "whisper_user.get_user_info.sql"
 	RawsqlOpenaiClientBalanceStatistics   RawsqlKey = "openai_client_balance.statistics.sql"
+	RawsqlOpenaiClientListRoutes          RawsqlKey = "openai_client.list_routes.sql"
 )
 
 var rawSqlNames = []RawsqlKey{
@@ -29,6 +30,7 @@ var rawSqlNames = []RawsqlKey{
 	RawsqlOpenaiClientListClients,
 	RawsqlWhisperUserGetUserInfo,
 	RawsqlOpenaiClientBalanceStatistics,
+	RawsqlOpenaiClientListRoutes,
 }
 
 func LoadRawSqlList(driverName string) {
@@ -0,0 +1,39 @@
+package dao
+
+import (
+	"context"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/database"
+	"github.com/alioth-center/infrastructure/utils/values"
+	"github.com/pkg/errors"
+)
+
+// legacyIndexes are the indexes named before the index names were prefixed with their tables, as sqlite index names
+// are global. Databases migrated before keep them besides the renamed ones, so they are dropped after migration.
+var legacyIndexes = map[string][]string{
+	model.TableNameOpenaiClients:          {"idx_ids"},
+	model.TableNameOpenaiClientBalance:    {"idx_scan", "idx_action", "idx_balance_remaining", "idx_client_id", "idx_created_at"},
+	model.TableNameOpenaiModels:           {"idx_ids", "idx_client_ids"},
+	model.TableNameOpenaiRequests:         {"idx_ids", "idx_client_ids", "idx_model_ids", "idx_user_ids"},
+	model.TableNameWhisperUsers:           {"idx_ids"},
+	model.TableNameWhisperUserBalance:     {"idx_scan", "idx_action", "idx_balance_remaining", "idx_client_id", "idx_created_at"},
+	model.TableNameWhisperUserPermissions: {"idx_ids", "idx_model_ids", "idx_user_ids"},
+}
+
+// DropLegacyIndexes drops the legacy indexes existing in the database, it must run after the models are migrated.
+func DropLegacyIndexes(ctx context.Context, db database.DatabaseV2) error {
+	migrator := db.GetGormCore(ctx).Migrator()
+	for table, indexes := range legacyIndexes {
+		for _, index := range indexes {
+			if !migrator.HasIndex(table, index) {
+				continue
+			}
+			if dropErr := migrator.DropIndex(table, index); dropErr != nil {
+				return errors.Wrap(dropErr, values.BuildStrings("drop legacy index ", index, " of ", table, " failed"))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/trace"
+)
+
+func TestDropLegacyIndexes(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := trace.NewContext()
+
+	// sqlite index names are global, so each legacy name exists on one table only, as earlier migrations left them
+	indexes := []struct {
+		table, legacy, renamed, statement string
+	}{
+		{table: model.TableNameOpenaiClients, legacy: "idx_ids", renamed: "idx_openai_clients_ids", statement: "CREATE INDEX idx_ids ON openai_clients (id)"},
+		{table: model.TableNameWhisperUserBalance, legacy: "idx_scan", renamed: "idx_whisper_user_balance_scan", statement: "CREATE INDEX idx_scan ON whisper_user_balance (user_id, created_at)"},
+		{table: model.TableNameOpenaiRequests, legacy: "idx_client_ids", renamed: "idx_openai_requests_client_ids", statement: "CREATE INDEX idx_client_ids ON openai_requests (client_id)"},
+	}
+	for _, index := range indexes {
+		if execErr := db.GetGormCore(ctx).Exec(index.statement).Error; execErr != nil {
+			t.Fatalf("create legacy index failed: %v", execErr)
+		}
+	}
+
+	// dropping is idempotent, it runs on every start
+	for range 2 {
+		if dropErr := DropLegacyIndexes(ctx, db); dropErr != nil {
+			t.Fatalf("drop legacy indexes failed: %v", dropErr)
+		}
+	}
+
+	migrator := db.GetGormCore(ctx).Migrator()
+	for _, index := range indexes {
+		if migrator.HasIndex(index.table, index.legacy) {
+			t.Errorf("legacy index %s of %s is not dropped", index.legacy, index.table)
+		}
+		if !migrator.HasIndex(index.table, index.renamed) {
+			t.Errorf("renamed index %s of %s is dropped", index.renamed, index.table)
+		}
+	}
+}
@@ -47,11 +47,25 @@ func (ac *OpenaiClientDatabaseAccessor) CheckAllClientsExist(ctx context.Context
 	return notExistClientDescriptions, nil
 }
 
+// GetAvailableClients returns the clients with current balances that the user can call the model on, resolved
+// from the routing snapshot, the database is queried if the user has no route to the model in the snapshot.
 func (ac *OpenaiClientDatabaseAccessor) GetAvailableClients(ctx context.Context, modelName, token, modelType string) (clients []*dto.AvailableClientDTO, err error) {
+	clients, found, snapshotErr := routes.availableClients(ctx, ac.db, token, modelName, modelType)
+	if snapshotErr != nil {
+		return nil, errors.Wrap(snapshotErr, "get available clients failed")
+	}
+	if found {
+		return clients, nil
+	}
+
+	return ac.QueryAvailableClients(ctx, modelName, token, modelType)
+}
+
+// QueryAvailableClients is GetAvailableClients without the routing snapshot, it always queries the database.
+func (ac *OpenaiClientDatabaseAccessor) QueryAvailableClients(ctx context.Context, modelName, token, modelType string) (clients []*dto.AvailableClientDTO, err error) {
 	clients = make([]*dto.AvailableClientDTO, 0)
 	sql := rawSqlList[RawsqlOpenaiClientGetAvailableClients]
-	template := &dto.GetAvailableClientCND{ModelName: modelName, UserApiKey: token, ModelType: modelType}
-	if queryErr := ac.db.ExecuteRawSqlTemplateQuery(ctx, &clients, sql, template); queryErr != nil {
+	if queryErr := ac.db.GetGormCore(ctx).Raw(sql, token, modelName, modelType).Scan(&clients).Error; queryErr != nil {
 		return nil, errors.Wrap(queryErr, "get available clients failed")
 	}
 
@@ -61,8 +75,7 @@ func (ac *OpenaiClientDatabaseAccessor) GetAvailableClients(ctx context.Context,
 func (ac *OpenaiClientDatabaseAccessor) GetClientSecret(ctx context.Context, clientID int) (result *dto.ClientSecretDTO, err error) {
 	result = new(dto.ClientSecretDTO)
 	sql := rawSqlList[RawsqlOpenaiClientGetClientSecrets]
-	template := &dto.GetClientSecretCND{ClientIDs: []int{clientID}}
-	if queryErr := ac.db.ExecuteRawSqlTemplateQuery(ctx, &result, sql, template); queryErr != nil {
+	if queryErr := ac.db.GetGormCore(ctx).Raw(sql, []int{clientID}).Scan(result).Error; queryErr != nil {
 		return nil, errors.Wrap(queryErr, "get client secret failed")
 	}
 
@@ -76,8 +89,7 @@ func (ac *OpenaiClientDatabaseAccessor) GetClientSecrets(ctx context.Context, cl
 
 	result = make([]*dto.ClientSecretDTO, 0, len(clientIDs))
 	sql := rawSqlList[RawsqlOpenaiClientGetClientSecrets]
-	template := &dto.GetClientSecretCND{ClientIDs: clientIDs}
-	if queryErr := ac.db.ExecuteRawSqlTemplateQuery(ctx, &result, sql, template); queryErr != nil {
+	if queryErr := ac.db.GetGormCore(ctx).Raw(sql, clientIDs).Scan(&result).Error; queryErr != nil {
 		return nil, errors.Wrap(queryErr, "get client secrets failed")
 	}
 
@@ -95,5 +107,7 @@ func (ac *OpenaiClientDatabaseAccessor) ListClients(ctx context.Context) (client
 }
 
 func (ac *OpenaiClientDatabaseAccessor) CreateClient(ctx context.Context, client *model.OpenaiClient) (created bool, err error) {
+	defer routes.invalidate()
+
 	return ac.db.CreateSingleDataIfNotExist(ctx, client)
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/alioth-center/akasha-whisper/app/model"
 	"github.com/alioth-center/infrastructure/database"
+	"github.com/alioth-center/infrastructure/utils/values"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
@@ -28,49 +29,23 @@ func (ac *OpenaiClientBalanceDatabaseAccessor) CreateBalanceRecord(ctx context.C
 		recordReason = reason[0]
 	}
 
+	recordID := int64(0)
 	execErr := ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
-		receiver := &model.OpenaiClientBalance{}
-		if queryErr := tx.WithContext(ctx).
-			Model(&model.OpenaiClientBalance{}).
-			Where(model.OpenaiClientBalanceCols.ClientID, clientID).
-			Select(model.OpenaiClientBalanceCols.BalanceRemaining, model.OpenaiClientBalanceCols.ID).
-			Order(clause.OrderByColumn{Column: clause.Column{Name: model.OpenaiClientBalanceCols.CreatedAt}, Desc: true}).
-			Limit(1).
-			Scan(&receiver).
-			Error; queryErr != nil {
-			return queryErr
-		} else if receiver.ID == 0 && action != model.OpenaiClientBalanceActionInitial {
-			return errors.New("client balance not initialized")
-		}
-
-		if action == model.OpenaiClientBalanceActionInitial {
-			receiver.BalanceRemaining = decimal.Zero
-		}
-		after = receiver.BalanceRemaining.Add(changeAmount)
-		record := &model.OpenaiClientBalance{
-			ClientID:            int64(clientID),
-			BalanceChangeAmount: changeAmount,
-			BalanceRemaining:    after,
-			Action:              action,
-			Reason:              recordReason,
-		}
-
-		if createErr := tx.WithContext(ctx).Create(record).Error; createErr != nil {
-			return createErr
-		}
-
-		return nil
+		remaining, id, createErr := ac.createBalanceRecord(ctx, tx, int64(clientID), changeAmount, action, recordReason)
+		after, recordID = remaining, id
+		return createErr
 	})
 	if execErr != nil {
 		return decimal.Zero, execErr
 	}
 
+	routes.setClientBalance(clientID, after, recordID)
 	return after, nil
 }
 
 func (ac *OpenaiClientBalanceDatabaseAccessor) CreateBalanceRecordByName(ctx context.Context, clientName string, changeAmount decimal.Decimal, action model.EnumOpenaiClientBalanceAction, reason string) (after decimal.Decimal, err error) {
+	clientID, recordID := int64(0), int64(0)
 	execErr := ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
-		var clientID int64
 		if queryErr := tx.WithContext(ctx).
 			Model(&model.OpenaiClient{}).
 			Where(model.OpenaiClientCols.Description, clientName).
@@ -83,42 +58,60 @@ func (ac *OpenaiClientBalanceDatabaseAccessor) CreateBalanceRecordByName(ctx con
 			return errors.New("client not found")
 		}
 
-		receiver := &model.OpenaiClientBalance{}
-		if queryErr := tx.WithContext(ctx).
-			Model(&model.OpenaiClientBalance{}).
-			Where(model.OpenaiClientBalanceCols.ClientID, clientID).
-			Select(model.OpenaiClientBalanceCols.BalanceRemaining).
-			Order(clause.OrderByColumn{Column: clause.Column{Name: model.OpenaiClientBalanceCols.CreatedAt}, Desc: true}).
-			Limit(1).
-			Scan(&receiver).
-			Error; queryErr != nil && !errors.Is(queryErr, gorm.ErrRecordNotFound) {
-			return queryErr
-		} else if receiver.ID == 0 {
-			receiver.BalanceRemaining = decimal.Zero
-		}
-
-		after = receiver.BalanceRemaining.Add(changeAmount)
-		record := &model.OpenaiClientBalance{
-			ClientID:            int64(clientID),
-			BalanceChangeAmount: changeAmount,
-			BalanceRemaining:    after,
-			Action:              action,
-			Reason:              reason,
-		}
-
-		if createErr := tx.WithContext(ctx).Create(record).Error; createErr != nil {
-			return createErr
-		}
-
-		return nil
+		remaining, id, createErr := ac.createBalanceRecord(ctx, tx, clientID, changeAmount, action, reason)
+		after, recordID = remaining, id
+		return createErr
 	})
 	if execErr != nil {
 		return decimal.Zero, execErr
 	}
 
+	routes.setClientBalance(int(clientID), after, recordID)
 	return after, nil
 }
 
+// createBalanceRecord updates the current balance of the client and creates the balance record in the transaction,
+// the client row is locked by the update until the transaction ends, so concurrent records of the same client are
+// serialized and the remaining of the record is always consistent.
+func (ac *OpenaiClientBalanceDatabaseAccessor) createBalanceRecord(ctx context.Context, tx *gorm.DB, clientID int64, changeAmount decimal.Decimal, action model.EnumOpenaiClientBalanceAction, reason string) (after decimal.Decimal, recordID int64, err error) {
+	balance := gorm.Expr(values.BuildStrings(model.OpenaiClientCols.Balance, " + ?"), changeAmount)
+	if action == model.OpenaiClientBalanceActionInitial {
+		balance = gorm.Expr("?", changeAmount)
+	}
+	if updateErr := tx.WithContext(ctx).
+		Model(&model.OpenaiClient{}).
+		Where(model.OpenaiClientCols.ID, clientID).
+		UpdateColumn(model.OpenaiClientCols.Balance, balance).
+		Error; updateErr != nil {
+		return decimal.Zero, 0, updateErr
+	}
+
+	receiver := &model.OpenaiClient{}
+	if queryErr := tx.WithContext(ctx).
+		Model(&model.OpenaiClient{}).
+		Where(model.OpenaiClientCols.ID, clientID).
+		Select(model.OpenaiClientCols.Balance).
+		First(receiver).
+		Error; errors.Is(queryErr, gorm.ErrRecordNotFound) {
+		return decimal.Zero, 0, errors.New("client not found")
+	} else if queryErr != nil {
+		return decimal.Zero, 0, queryErr
+	}
+
+	record := &model.OpenaiClientBalance{
+		ClientID:            clientID,
+		BalanceChangeAmount: changeAmount,
+		BalanceRemaining:    receiver.Balance,
+		Action:              action,
+		Reason:              reason,
+	}
+	if createErr := tx.WithContext(ctx).Create(record).Error; createErr != nil {
+		return decimal.Zero, 0, createErr
+	}
+
+	return receiver.Balance, record.ID, nil
+}
+
 func (ac *OpenaiClientBalanceDatabaseAccessor) StatisticsClientBalance(ctx context.Context, startDate time.Time) (result []*dto.OpenaiClientBalanceStatisticsDTO, err error) {
 	result = make([]*dto.OpenaiClientBalanceStatisticsDTO, 0)
 	sql := rawSqlList[RawsqlOpenaiClientBalanceStatistics]
@@ -128,3 +121,26 @@ func (ac *OpenaiClientBalanceDatabaseAccessor) StatisticsClientBalance(ctx conte
 
 	return result, nil
 }
+
+// MigrateBalances fills the current balance of the clients created before the balance column was added, from the
+// latest balance record of each client.
+func (ac *OpenaiClientBalanceDatabaseAccessor) MigrateBalances(ctx context.Context) error {
+	defer routes.invalidate()
+
+	latest := ac.db.GetGormCore(ctx).
+		Model(&model.OpenaiClientBalance{}).
+		Select(database.Column(model.TableNameOpenaiClientBalance, model.OpenaiClientBalanceCols.BalanceRemaining)).
+		Where(clause.Eq{
+			Column: database.Column(model.TableNameOpenaiClientBalance, model.OpenaiClientBalanceCols.ClientID),
+			Value:  clause.Column{Table: model.TableNameOpenaiClients, Name: model.OpenaiClientCols.ID},
+		}).
+		Order(clause.OrderByColumn{Column: clause.Column{Table: model.TableNameOpenaiClientBalance, Name: model.OpenaiClientBalanceCols.CreatedAt}, Desc: true}).
+		Order(clause.OrderByColumn{Column: clause.Column{Table: model.TableNameOpenaiClientBalance, Name: model.OpenaiClientBalanceCols.ID}, Desc: true}).
+		Limit(1)
+
+	return ac.db.GetGormCore(ctx).
+		Model(&model.OpenaiClient{}).
+		Where(clause.Eq{Column: model.OpenaiClientCols.Balance, Value: nil}).
+		UpdateColumn(model.OpenaiClientCols.Balance, gorm.Expr("COALESCE((?), 0)", latest)).
+		Error
+}
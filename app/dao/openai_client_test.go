@@ -0,0 +1,68 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/trace"
+)
+
+func TestOpenaiClientDatabaseAccessor_GetAvailableClientsWithHostileInputs(t *testing.T) {
+	tests := []struct {
+		name      string
+		apiKey    string
+		modelName string
+	}{
+		{name: "single quotes", apiKey: "sk-' OR '1'='1", modelName: "gpt-4o' OR '1'='1"},
+		{name: "double quotes", apiKey: `sk-" OR "1"="1`, modelName: `gpt-4o" OR "1"="1`},
+		{name: "comments", apiKey: "sk-' --", modelName: "gpt-4o' -- "},
+		{name: "stacked statements", apiKey: "sk-'; DROP TABLE whisper_users; --", modelName: "gpt-4o'; DELETE FROM openai_clients; --"},
+		{name: "escaped quotes", apiKey: `sk-\' OR 1=1 --`, modelName: `gpt-4o\'; --`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t)
+			createTestRoute(t, db, "sk-user", "client", "gpt-4o", 1000)
+			createTestRoute(t, db, tt.apiKey, "hostile", tt.modelName, 1000)
+			accessor, ctx := NewOpenaiClientDatabaseAccessor(db), trace.NewContext()
+
+			// the hostile values are bound as values, they only match themselves
+			for _, query := range []struct {
+				apiKey, modelName string
+				matched           bool
+			}{
+				{apiKey: tt.apiKey, modelName: tt.modelName, matched: true},
+				{apiKey: "sk-user", modelName: "gpt-4o", matched: true},
+				{apiKey: tt.apiKey, modelName: "gpt-4o"},
+				{apiKey: "sk-user", modelName: tt.modelName},
+			} {
+				queried, queryErr := accessor.QueryAvailableClients(ctx, query.modelName, query.apiKey, model.OpenaiModelTypeChat)
+				if queryErr != nil {
+					t.Fatalf("query available clients failed: %v", queryErr)
+				}
+				snapshot, getErr := accessor.GetAvailableClients(ctx, query.modelName, query.apiKey, model.OpenaiModelTypeChat)
+				if getErr != nil {
+					t.Fatalf("get available clients failed: %v", getErr)
+				}
+
+				if !query.matched && (len(queried) != 0 || len(snapshot) != 0) {
+					t.Errorf("clients of %q for %q = %d and %d, expected none", query.modelName, query.apiKey, len(queried), len(snapshot))
+				}
+				if query.matched && (len(queried) != 1 || len(snapshot) != 1 || queried[0].ModelName != query.modelName || snapshot[0].ModelName != query.modelName) {
+					t.Errorf("clients of %q for %q = %+v and %+v, expected one client", query.modelName, query.apiKey, queried, snapshot)
+				}
+			}
+
+			// the user is resolved with the hostile key only, and no table is dropped or emptied
+			user, exist, getErr := NewWhisperUserDatabaseAccessor(db).GetWhisperUserByApiKey(ctx, tt.apiKey)
+			if getErr != nil || !exist || user.ApiKey != tt.apiKey {
+				t.Errorf("user of %q = %+v, %v, %v", tt.apiKey, user, exist, getErr)
+			}
+			clients, listErr := accessor.ListClients(ctx)
+			if listErr != nil || len(clients) != 2 {
+				t.Errorf("clients = %d, %v, expected 2", len(clients), listErr)
+			}
+		})
+	}
+}
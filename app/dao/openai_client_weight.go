@@ -0,0 +1,59 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/database"
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+)
+
+type OpenaiClientWeightDatabaseAccessor struct {
+	db database.DatabaseV2
+}
+
+func NewOpenaiClientWeightDatabaseAccessor(db database.DatabaseV2) *OpenaiClientWeightDatabaseAccessor {
+	return &OpenaiClientWeightDatabaseAccessor{db: db}
+}
+
+func (ac *OpenaiClientWeightDatabaseAccessor) CreateWeightRecords(ctx context.Context, records []*model.OpenaiClientWeight) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	return ac.db.GetGormCore(ctx).Create(records).Error
+}
+
+func (ac *OpenaiClientWeightDatabaseAccessor) ListWeightRecordsByClientName(ctx context.Context, clientName string, start, end time.Time, page int, offset int) (records []*model.OpenaiClientWeight, err error) {
+	clientID := int64(0)
+	if queryErr := ac.db.GetGormCore(ctx).
+		Model(&model.OpenaiClient{}).
+		Where(model.OpenaiClientCols.Description, clientName).
+		Select(model.OpenaiClientCols.ID).
+		Scan(&clientID).
+		Error; queryErr != nil {
+		return nil, queryErr
+	}
+	if clientID == 0 {
+		return nil, errors.New("client not found")
+	}
+
+	list := make([]*model.OpenaiClientWeight, 0, page)
+	if queryErr := ac.db.GetGormCore(ctx).
+		Model(&model.OpenaiClientWeight{}).
+		Where(model.OpenaiClientWeightCols.ClientID, clientID).
+		Where(clause.Gte{Column: model.OpenaiClientWeightCols.CreatedAt, Value: start}).
+		Where(clause.Lte{Column: model.OpenaiClientWeightCols.CreatedAt, Value: end}).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: model.OpenaiClientWeightCols.CreatedAt}, Desc: true}).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: model.OpenaiClientWeightCols.ID}, Desc: true}).
+		Offset(offset * page).
+		Limit(page).
+		Find(&list).
+		Error; queryErr != nil {
+		return nil, queryErr
+	}
+
+	return list, nil
+}
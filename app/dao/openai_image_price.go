@@ -0,0 +1,109 @@
+package dao
+
+import (
+	"context"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/database"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OpenaiImagePriceDatabaseAccessor struct {
+	db database.DatabaseV2
+}
+
+func NewOpenaiImagePriceDatabaseAccessor(db database.DatabaseV2) *OpenaiImagePriceDatabaseAccessor {
+	return &OpenaiImagePriceDatabaseAccessor{db: db}
+}
+
+// GetImagePrice returns the price per image of the model with given size and quality, the price with
+// empty quality is used as fallback, found is false if no price is configured for the size.
+func (ac *OpenaiImagePriceDatabaseAccessor) GetImagePrice(ctx context.Context, modelID int, size, quality string) (price decimal.Decimal, found bool, err error) {
+	prices := make([]*model.OpenaiImagePrice, 0, 2)
+	if queryErr := ac.db.GetGormCore(ctx).
+		Model(&model.OpenaiImagePrice{}).
+		Where(model.OpenaiImagePriceCols.ModelID, modelID).
+		Where(model.OpenaiImagePriceCols.Size, size).
+		Where(model.OpenaiImagePriceCols.Quality, []string{quality, ""}).
+		Select(model.OpenaiImagePriceCols.Quality, model.OpenaiImagePriceCols.Price).
+		Scan(&prices).
+		Error; queryErr != nil {
+		return decimal.Zero, false, errors.Wrap(queryErr, "get image price failed")
+	}
+
+	for _, item := range prices {
+		if item.Quality == quality {
+			return item.Price, true, nil
+		}
+	}
+	if len(prices) > 0 {
+		return prices[0].Price, true, nil
+	}
+
+	return decimal.Zero, false, nil
+}
+
+// CreateOrUpdateImagePricesWithClientDescription upserts image prices, prices is a map of model name to its prices.
+func (ac *OpenaiImagePriceDatabaseAccessor) CreateOrUpdateImagePricesWithClientDescription(ctx context.Context, prices map[string][]*model.OpenaiImagePrice, description string) (err error) {
+	if len(prices) == 0 {
+		return nil
+	}
+
+	return ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
+		modelNames := make([]string, 0, len(prices))
+		for name := range prices {
+			modelNames = append(modelNames, name)
+		}
+
+		var clientID int64
+		if queryErr := tx.WithContext(ctx).
+			Model(&model.OpenaiClient{}).
+			Where(model.OpenaiClientCols.Description, description).
+			Select(model.OpenaiClientCols.ID).
+			Scan(&clientID).
+			Error; queryErr != nil {
+			return queryErr
+		}
+		if clientID == 0 {
+			return errors.New("client not found")
+		}
+
+		models := make([]*model.OpenaiModel, 0, len(modelNames))
+		if queryErr := tx.WithContext(ctx).
+			Model(&model.OpenaiModel{}).
+			Where(model.OpenaiModelCols.ClientID, clientID).
+			Where(model.OpenaiModelCols.Model, modelNames).
+			Select(model.OpenaiModelCols.ID, model.OpenaiModelCols.Model).
+			Scan(&models).
+			Error; queryErr != nil {
+			return queryErr
+		}
+
+		updates := make([]*model.OpenaiImagePrice, 0, len(models))
+		for _, modelItem := range models {
+			for _, price := range prices[modelItem.Model] {
+				updates = append(updates, &model.OpenaiImagePrice{
+					ModelID: modelItem.ID,
+					Size:    price.Size,
+					Quality: price.Quality,
+					Price:   price.Price,
+				})
+			}
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+
+		return tx.WithContext(ctx).Model(&model.OpenaiImagePrice{}).Clauses(clause.OnConflict{
+			Columns: []clause.Column{
+				{Name: model.OpenaiImagePriceCols.ModelID},
+				{Name: model.OpenaiImagePriceCols.Size},
+				{Name: model.OpenaiImagePriceCols.Quality},
+			},
+			DoUpdates: clause.AssignmentColumns([]string{model.OpenaiImagePriceCols.Price, model.OpenaiImagePriceCols.UpdatedAt}),
+		}).Create(updates).Error
+	})
+}
@@ -11,6 +11,10 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+// ErrorConflictingRoutingStrategy is returned when the routing strategy of a model differs from the one set on the
+// same model of other clients, a model is routed by one strategy no matter which client is queried first.
+var ErrorConflictingRoutingStrategy = errors.New("routing strategy conflicts with other clients of the model")
+
 type OpenaiModelDatabaseAccessor struct {
 	db database.DatabaseV2
 }
@@ -26,22 +30,29 @@ func (ac *OpenaiModelDatabaseAccessor) GetModelsByClientID(ctx context.Context,
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.ID, "model_id"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.Type, "model_type"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.Model, "model_name"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.UpstreamModel, "model_upstream_name"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.RoutingStrategy, "model_routing_strategy"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.MaxTokens, "model_max_tokens"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.PromptPrice, "model_prompt_price"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.CompletionPrice, "model_completion_price"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.RpmLimit, "model_rpm_limit"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.TpmLimit, "model_tpm_limit"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.AudioVerboseJson, "model_audio_verbose_json"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.UpdatedAt, "last_updated_at"),
 	}
 
 	// select oc.id               as client_id,
 	//        om.id               as model_id,
 	//        om.model            as model_name,
+	//        om.upstream_model   as model_upstream_name,
+	//        om.routing_strategy as model_routing_strategy,
+	//        om.type             as model_type,
 	//        om.max_tokens       as model_max_tokens,
 	//        om.prompt_price     as model_prompt_price,
 	//        om.completion_price as model_completion_price,
 	//        om.rpm_limit        as model_rpm_limit,
 	//        om.tpm_limit        as model_tpm_limit,
+	//        om.audio_verbose_json as model_audio_verbose_json,
 	//        om.updated_at       as last_updated_at
 	// from openai_clients as oc
 	//          join openai_models as om on om.client_id = oc.id and oc.id = ${client_id}
@@ -78,22 +89,30 @@ func (ac *OpenaiModelDatabaseAccessor) GetModelsByClientDescription(ctx context.
 		database.ColumnAlias(model.TableNameOpenaiClients, model.OpenaiClientCols.ID, "client_id"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.ID, "model_id"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.Model, "model_name"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.UpstreamModel, "model_upstream_name"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.RoutingStrategy, "model_routing_strategy"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.Type, "model_type"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.MaxTokens, "model_max_tokens"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.PromptPrice, "model_prompt_price"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.CompletionPrice, "model_completion_price"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.RpmLimit, "model_rpm_limit"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.TpmLimit, "model_tpm_limit"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.AudioVerboseJson, "model_audio_verbose_json"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.UpdatedAt, "last_updated_at"),
 	}
 
 	// select oc.id               as client_id,
 	//        om.id               as model_id,
 	//        om.model            as model_name,
+	//        om.upstream_model   as model_upstream_name,
+	//        om.routing_strategy as model_routing_strategy,
+	//        om.type             as model_type,
 	//        om.max_tokens       as model_max_tokens,
 	//        om.prompt_price     as model_prompt_price,
 	//        om.completion_price as model_completion_price,
 	//        om.rpm_limit        as model_rpm_limit,
 	//        om.tpm_limit        as model_tpm_limit,
+	//        om.audio_verbose_json as model_audio_verbose_json,
 	//        om.updated_at       as last_updated_at
 	// from openai_clients as oc
 	//          join openai_models as om on om.client_id = oc.id and oc.description = ${description}
@@ -130,22 +149,30 @@ func (ac *OpenaiModelDatabaseAccessor) GetAvailableModelsByApiKey(ctx context.Co
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.ClientID, "client_id"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.ID, "model_id"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.Model, "model_name"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.UpstreamModel, "model_upstream_name"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.RoutingStrategy, "model_routing_strategy"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.Type, "model_type"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.MaxTokens, "model_max_tokens"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.PromptPrice, "model_prompt_price"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.CompletionPrice, "model_completion_price"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.RpmLimit, "model_rpm_limit"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.TpmLimit, "model_tpm_limit"),
+		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.AudioVerboseJson, "model_audio_verbose_json"),
 		database.ColumnAlias(model.TableNameOpenaiModels, model.OpenaiModelCols.UpdatedAt, "last_updated_at"),
 	}
 
 	// select om.client_id		  as client_id,
 	//        om.id               as model_id,
 	//        om.model            as model_name,
+	//        om.upstream_model   as model_upstream_name,
+	//        om.routing_strategy as model_routing_strategy,
+	//        om.type             as model_type,
 	//        om.max_tokens       as model_max_tokens,
 	//        om.prompt_price     as model_prompt_price,
 	//        om.completion_price as model_completion_price,
 	//        om.rpm_limit        as model_rpm_limit,
 	//        om.tpm_limit        as model_tpm_limit,
+	//        om.audio_verbose_json as model_audio_verbose_json,
 	//        om.updated_at       as last_updated_at
 	// from whisper_users as wu
 	//          join whisper_user_permissions on wu.id = whisper_user_permissions.user_id and wu.api_key = ${key}
@@ -190,29 +217,40 @@ func (ac *OpenaiModelDatabaseAccessor) GetAvailableModelsByApiKey(ctx context.Co
 }
 
 func (ac *OpenaiModelDatabaseAccessor) CreateOrUpdateModels(ctx context.Context, modelData []*model.OpenaiModel, clientIDs ...int) (err error) {
+	defer routes.invalidate()
+
 	updates := make([]*model.OpenaiModel, 0, len(clientIDs))
 	for _, client := range clientIDs {
 		for _, modelItem := range modelData {
 			updates = append(updates, &model.OpenaiModel{
-				ClientID:        int64(client),
-				Model:           modelItem.Model,
-				Type:            modelItem.Type,
-				MaxTokens:       modelItem.MaxTokens,
-				PromptPrice:     modelItem.PromptPrice,
-				CompletionPrice: modelItem.CompletionPrice,
-				RpmLimit:        modelItem.RpmLimit,
-				TpmLimit:        modelItem.TpmLimit,
+				ClientID:         int64(client),
+				Model:            modelItem.Model,
+				UpstreamModel:    modelItem.UpstreamModel,
+				RoutingStrategy:  modelItem.RoutingStrategy,
+				Type:             modelItem.Type,
+				MaxTokens:        modelItem.MaxTokens,
+				PromptPrice:      modelItem.PromptPrice,
+				CompletionPrice:  modelItem.CompletionPrice,
+				RpmLimit:         modelItem.RpmLimit,
+				TpmLimit:         modelItem.TpmLimit,
+				AudioVerboseJson: modelItem.AudioVerboseJson,
 			})
 		}
 	}
 
+	if checkErr := checkRoutingStrategies(ac.db.GetGormCore(ctx), modelData, clientIDs); checkErr != nil {
+		return checkErr
+	}
+
 	indexKeys := []string{model.OpenaiModelCols.ClientID, model.OpenaiModelCols.Model}
-	updateKeys := []string{model.OpenaiModelCols.MaxTokens, model.OpenaiModelCols.PromptPrice, model.OpenaiModelCols.CompletionPrice, model.OpenaiModelCols.RpmLimit, model.OpenaiModelCols.TpmLimit}
+	updateKeys := []string{model.OpenaiModelCols.UpstreamModel, model.OpenaiModelCols.RoutingStrategy, model.OpenaiModelCols.Type, model.OpenaiModelCols.MaxTokens, model.OpenaiModelCols.PromptPrice, model.OpenaiModelCols.CompletionPrice, model.OpenaiModelCols.RpmLimit, model.OpenaiModelCols.TpmLimit, model.OpenaiModelCols.AudioVerboseJson}
 
 	return ac.db.CreateDataOnDuplicateKeyUpdate(ctx, updates, indexKeys, updateKeys)
 }
 
 func (ac *OpenaiModelDatabaseAccessor) CreateOrUpdateModelWithClientDescriptions(ctx context.Context, modelData []*model.OpenaiModel, descriptions ...string) (err error) {
+	defer routes.invalidate()
+
 	return ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
 		clientIDs := make([]int, 0, len(descriptions))
 		queryErr := tx.WithContext(ctx).
@@ -223,25 +261,31 @@ func (ac *OpenaiModelDatabaseAccessor) CreateOrUpdateModelWithClientDescriptions
 		if queryErr != nil {
 			return queryErr
 		}
+		if checkErr := checkRoutingStrategies(tx.WithContext(ctx), modelData, clientIDs); checkErr != nil {
+			return checkErr
+		}
 
 		updates := make([]*model.OpenaiModel, 0, len(clientIDs))
 		for _, client := range clientIDs {
 			for _, modelItem := range modelData {
 				updates = append(updates, &model.OpenaiModel{
-					ClientID:        int64(client),
-					Model:           modelItem.Model,
-					Type:            modelItem.Type,
-					MaxTokens:       modelItem.MaxTokens,
-					PromptPrice:     modelItem.PromptPrice,
-					CompletionPrice: modelItem.CompletionPrice,
-					RpmLimit:        modelItem.RpmLimit,
-					TpmLimit:        modelItem.TpmLimit,
+					ClientID:         int64(client),
+					Model:            modelItem.Model,
+					UpstreamModel:    modelItem.UpstreamModel,
+					RoutingStrategy:  modelItem.RoutingStrategy,
+					Type:             modelItem.Type,
+					MaxTokens:        modelItem.MaxTokens,
+					PromptPrice:      modelItem.PromptPrice,
+					CompletionPrice:  modelItem.CompletionPrice,
+					RpmLimit:         modelItem.RpmLimit,
+					TpmLimit:         modelItem.TpmLimit,
+					AudioVerboseJson: modelItem.AudioVerboseJson,
 				})
 			}
 		}
 
 		indexKeys := []string{model.OpenaiModelCols.ClientID, model.OpenaiModelCols.Model}
-		updateKeys := []string{model.OpenaiModelCols.MaxTokens, model.OpenaiModelCols.PromptPrice, model.OpenaiModelCols.CompletionPrice, model.OpenaiModelCols.RpmLimit, model.OpenaiModelCols.TpmLimit}
+		updateKeys := []string{model.OpenaiModelCols.UpstreamModel, model.OpenaiModelCols.RoutingStrategy, model.OpenaiModelCols.Type, model.OpenaiModelCols.MaxTokens, model.OpenaiModelCols.PromptPrice, model.OpenaiModelCols.CompletionPrice, model.OpenaiModelCols.RpmLimit, model.OpenaiModelCols.TpmLimit, model.OpenaiModelCols.AudioVerboseJson}
 
 		duplicatedColumns := make([]clause.Column, len(indexKeys))
 		for i, key := range indexKeys {
@@ -254,3 +298,46 @@ func (ac *OpenaiModelDatabaseAccessor) CreateOrUpdateModelWithClientDescriptions
 		}).Create(updates).Error
 	})
 }
+
+// checkRoutingStrategies rejects the models setting a routing strategy different from the one set on the same model
+// of the clients not updated, or on the same model within modelData, empty strategy follows the others.
+func checkRoutingStrategies(db *gorm.DB, modelData []*model.OpenaiModel, clientIDs []int) error {
+	strategies := map[string]string{}
+	for _, modelItem := range modelData {
+		if modelItem.RoutingStrategy == "" {
+			continue
+		}
+		if strategy, exist := strategies[modelItem.Model]; exist && strategy != modelItem.RoutingStrategy {
+			return errors.Wrapf(ErrorConflictingRoutingStrategy, "model %s set with %s and %s", modelItem.Model, strategy, modelItem.RoutingStrategy)
+		}
+		strategies[modelItem.Model] = modelItem.RoutingStrategy
+	}
+	if len(strategies) == 0 {
+		return nil
+	}
+
+	modelNames := make([]string, 0, len(strategies))
+	for name := range strategies {
+		modelNames = append(modelNames, name)
+	}
+
+	existing := make([]*model.OpenaiModel, 0)
+	query := db.Model(&model.OpenaiModel{}).
+		Select(model.OpenaiModelCols.Model, model.OpenaiModelCols.RoutingStrategy).
+		Where(model.OpenaiModelCols.Model, modelNames).
+		Where(clause.Neq{Column: model.OpenaiModelCols.RoutingStrategy, Value: ""})
+	if len(clientIDs) > 0 {
+		query = query.Not(model.OpenaiModelCols.ClientID, clientIDs)
+	}
+	if queryErr := query.Scan(&existing).Error; queryErr != nil {
+		return errors.Wrap(queryErr, "failed to get routing strategies of models")
+	}
+
+	for _, modelItem := range existing {
+		if strategies[modelItem.Model] != modelItem.RoutingStrategy {
+			return errors.Wrapf(ErrorConflictingRoutingStrategy, "model %s is routed by %s on other clients", modelItem.Model, modelItem.RoutingStrategy)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/trace"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+func TestOpenaiModel_CreateOrUpdateModelWithClientDescriptions_RoutingStrategy(t *testing.T) {
+	newModel := func(name, strategy string) *model.OpenaiModel {
+		return &model.OpenaiModel{Model: name, RoutingStrategy: strategy, Type: model.OpenaiModelTypeChat, MaxTokens: 4096, PromptPrice: decimal.NewFromInt(1), CompletionPrice: decimal.NewFromInt(2), RpmLimit: -1, TpmLimit: -1}
+	}
+
+	tests := []struct {
+		name     string
+		client   string
+		models   []*model.OpenaiModel
+		conflict bool
+	}{
+		{name: "SameStrategy", client: "client-b", models: []*model.OpenaiModel{newModel("gpt-4o", "cheapest")}},
+		{name: "EmptyStrategy", client: "client-b", models: []*model.OpenaiModel{newModel("gpt-4o", "")}},
+		{name: "OtherModel", client: "client-b", models: []*model.OpenaiModel{newModel("gpt-4o-mini", "lowest_latency")}},
+		{name: "OnlyClientOfModel", client: "client-a", models: []*model.OpenaiModel{newModel("gpt-4o", "lowest_latency")}},
+		{name: "ConflictWithOtherClient", client: "client-b", models: []*model.OpenaiModel{newModel("gpt-4o", "lowest_latency")}, conflict: true},
+		{name: "ConflictWithinRequest", client: "client-b", models: []*model.OpenaiModel{newModel("gpt-4o-mini", "cheapest"), newModel("gpt-4o-mini", "least_in_flight")}, conflict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t)
+			_, clientA, modelA := createTestRoute(t, db, "sk-user", "client-a", "gpt-4o", 1000)
+			ctx := trace.NewContext()
+			if updateErr := db.GetGormCore(ctx).Model(modelA).UpdateColumn(model.OpenaiModelCols.RoutingStrategy, "cheapest").Error; updateErr != nil {
+				t.Fatalf("update routing strategy failed: %v", updateErr)
+			}
+			clientB := &model.OpenaiClient{Description: "client-b", ApiKey: "sk-upstream", Endpoint: clientA.Endpoint, Weight: 100, Provider: model.OpenaiClientProviderOpenai}
+			if createErr := db.GetGormCore(ctx).Create(clientB).Error; createErr != nil {
+				t.Fatalf("create client failed: %v", createErr)
+			}
+
+			accessor := NewOpenaiModelDatabaseAccessor(db)
+			updateErr := accessor.CreateOrUpdateModelWithClientDescriptions(ctx, tt.models, tt.client)
+			if conflict := errors.Is(updateErr, ErrorConflictingRoutingStrategy); conflict != tt.conflict {
+				t.Fatalf("create or update models = %v, expected conflict %v", updateErr, tt.conflict)
+			}
+			if !tt.conflict && updateErr != nil {
+				t.Fatalf("create or update models failed: %v", updateErr)
+			}
+
+			// rejected models are not written to the client
+			models, queryErr := accessor.GetModelsByClientDescription(ctx, "client-b")
+			if queryErr != nil {
+				t.Fatalf("get models failed: %v", queryErr)
+			}
+			if expected := tt.client == "client-b" && !tt.conflict; (len(models) > 0) != expected {
+				t.Errorf("models of client-b = %d, expected written %v", len(models), expected)
+			}
+		})
+	}
+}
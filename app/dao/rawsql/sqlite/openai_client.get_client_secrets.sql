@@ -0,0 +1 @@
+SELECT oc.id, oc.api_key, oc.endpoint, oc.weight, oc.provider, oc.balance FROM openai_clients AS oc WHERE oc.id IN ?
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT oc.id, oc.description, oc.api_key, oc.endpoint, oc.weight, oc.provider, oc.balance, oc.weight_min_factor, oc.weight_max_factor FROM openai_clients AS oc
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT wu.id, wu.email, wu.api_key, wu.role, wu.language, wu.allow_ips, wu.moderated, wu.rpm_limit, wu.tpm_limit, wu.concurrency_limit, wu.updated_at, wu.balance FROM whisper_users AS wu WHERE wu.id = ?
\ No newline at end of file
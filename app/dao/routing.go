@@ -0,0 +1,128 @@
+package dao
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/database"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// routingSnapshotTTL is the max age of the routing snapshot, it is reloaded after expired to catch up the
+// changes made by other instances.
+const routingSnapshotTTL = time.Minute
+
+// routes is the routing snapshot shared by all accessors, it is reloaded after management writes, and the
+// balances are updated in place by balance records.
+var routes = &routingSnapshot{}
+
+// routingSnapshot caches the routes of users, permissions, models and clients with current balances, so the
+// available clients can be resolved without a database round trip.
+type routingSnapshot struct {
+	mu       sync.RWMutex
+	loadedAt time.Time
+	routes   map[routeKey][]*dto.RouteDTO
+	users    map[int]routeBalance
+	clients  map[int]routeBalance
+}
+
+type routeKey struct {
+	apiKey    string
+	modelName string
+	modelType string
+}
+
+// routeBalance is the current balance and the id of the balance record it comes from, a balance from an earlier
+// record never overwrites a later one, balances loaded from the database have zero record id.
+type routeBalance struct {
+	balance  decimal.Decimal
+	recordID int64
+}
+
+// availableClients returns the clients that the user can call the model on with current balances, found is
+// false if the user has no route to the model in the snapshot.
+func (s *routingSnapshot) availableClients(ctx context.Context, db database.DatabaseV2, apiKey, modelName, modelType string) (clients []*dto.AvailableClientDTO, found bool, err error) {
+	s.mu.RLock()
+	if time.Since(s.loadedAt) < routingSnapshotTTL {
+		clients, found = s.lookup(routeKey{apiKey: apiKey, modelName: modelName, modelType: modelType})
+		s.mu.RUnlock()
+		return clients, found, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the snapshot may be loaded by another request while waiting for the lock
+	if time.Since(s.loadedAt) >= routingSnapshotTTL {
+		if loadErr := s.load(ctx, db); loadErr != nil {
+			return nil, false, loadErr
+		}
+	}
+
+	clients, found = s.lookup(routeKey{apiKey: apiKey, modelName: modelName, modelType: modelType})
+	return clients, found, nil
+}
+
+// lookup copies the routes of the key with current balances, the lock must be held by the caller.
+func (s *routingSnapshot) lookup(key routeKey) (clients []*dto.AvailableClientDTO, found bool) {
+	matched, found := s.routes[key]
+	clients = make([]*dto.AvailableClientDTO, 0, len(matched))
+	for _, route := range matched {
+		client := route.AvailableClientDTO
+		client.UserBalance, client.ClientBalance = s.users[client.UserID].balance, s.clients[client.ClientID].balance
+		clients = append(clients, &client)
+	}
+
+	return clients, found
+}
+
+// load replaces the snapshot with the routes in the database, the write lock must be held by the caller.
+func (s *routingSnapshot) load(ctx context.Context, db database.DatabaseV2) error {
+	result := make([]*dto.RouteDTO, 0)
+	if queryErr := db.GetGormCore(ctx).Raw(rawSqlList[RawsqlOpenaiClientListRoutes]).Scan(&result).Error; queryErr != nil {
+		return errors.Wrap(queryErr, "load routing snapshot failed")
+	}
+
+	s.routes, s.users, s.clients = map[routeKey][]*dto.RouteDTO{}, map[int]routeBalance{}, map[int]routeBalance{}
+	for _, route := range result {
+		key := routeKey{apiKey: route.UserApiKey, modelName: route.ModelName, modelType: route.ModelType}
+		s.routes[key] = append(s.routes[key], route)
+		s.users[route.UserID] = routeBalance{balance: route.UserBalance}
+		s.clients[route.ClientID] = routeBalance{balance: route.ClientBalance}
+	}
+
+	s.loadedAt = time.Now()
+	return nil
+}
+
+// invalidate marks the snapshot stale, it is reloaded by the next lookup.
+func (s *routingSnapshot) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.loadedAt = time.Time{}
+}
+
+// setUserBalance updates the balance of the user with the balance record.
+func (s *routingSnapshot) setUserBalance(userID int, balance decimal.Decimal, recordID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, exist := s.users[userID]; exist && current.recordID < recordID {
+		s.users[userID] = routeBalance{balance: balance, recordID: recordID}
+	}
+}
+
+// setClientBalance updates the balance of the client with the balance record.
+func (s *routingSnapshot) setClientBalance(clientID int, balance decimal.Decimal, recordID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, exist := s.clients[clientID]; exist && current.recordID < recordID {
+		s.clients[clientID] = routeBalance{balance: balance, recordID: recordID}
+	}
+}
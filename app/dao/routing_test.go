@@ -0,0 +1,178 @@
+package dao
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/database"
+	"github.com/alioth-center/infrastructure/trace"
+	"github.com/shopspring/decimal"
+)
+
+func TestRoutingSnapshot_TTL(t *testing.T) {
+	db := newTestDatabase(t)
+	_, client, _ := createTestRoute(t, db, "sk-user", "client", "gpt-4o", 1000)
+	accessor, ctx := NewOpenaiClientDatabaseAccessor(db), trace.NewContext()
+
+	assertWeight := func(expected int64) {
+		t.Helper()
+		clients, getErr := accessor.GetAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat)
+		if getErr != nil {
+			t.Fatalf("get available clients failed: %v", getErr)
+		}
+		if len(clients) != 1 || clients[0].ClientWeight != expected {
+			t.Fatalf("available clients = %+v, expected one client with weight %d", clients, expected)
+		}
+	}
+	assertWeight(100)
+
+	// changes made by other instances are not seen before the snapshot expires
+	if updateErr := db.GetGormCore(ctx).Model(&model.OpenaiClient{}).Where(model.OpenaiClientCols.ID, client.ID).UpdateColumn(model.OpenaiClientCols.Weight, 10).Error; updateErr != nil {
+		t.Fatalf("update client weight failed: %v", updateErr)
+	}
+	assertWeight(100)
+
+	routes.mu.Lock()
+	routes.loadedAt = time.Now().Add(-routingSnapshotTTL)
+	routes.mu.Unlock()
+	assertWeight(10)
+}
+
+func TestRoutingSnapshot_SetBalances(t *testing.T) {
+	db := newTestDatabase(t)
+	user, client, _ := createTestRoute(t, db, "sk-user", "client", "gpt-4o", 1000)
+	accessor, ctx := NewOpenaiClientDatabaseAccessor(db), trace.NewContext()
+	if _, getErr := accessor.GetAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat); getErr != nil {
+		t.Fatalf("get available clients failed: %v", getErr)
+	}
+	loadedAt := routes.loadedAt
+
+	// balance records update the snapshot in place, without reloading it
+	if _, createErr := NewWhisperUserBalanceDatabaseAccessor(db).CreateBalanceRecord(ctx, int(user.ID), decimal.NewFromInt(-100), model.WhisperUserBalanceActionConsumption); createErr != nil {
+		t.Fatalf("create user balance record failed: %v", createErr)
+	}
+	if _, createErr := NewOpenaiClientBalanceDatabaseAccessor(db).CreateBalanceRecord(ctx, int(client.ID), decimal.NewFromInt(-50), model.OpenaiClientBalanceActionConsumption); createErr != nil {
+		t.Fatalf("create client balance record failed: %v", createErr)
+	}
+
+	// balances of earlier records, written back later by slower requests, are ignored
+	routes.setUserBalance(int(user.ID), decimal.NewFromInt(1), 1)
+	routes.setClientBalance(int(client.ID), decimal.NewFromInt(1), 1)
+
+	clients, getErr := accessor.GetAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat)
+	if getErr != nil {
+		t.Fatalf("get available clients failed: %v", getErr)
+	}
+	if !routes.loadedAt.Equal(loadedAt) {
+		t.Errorf("routing snapshot reloaded by balance records")
+	}
+	if len(clients) != 1 || !clients[0].UserBalance.Equal(decimal.NewFromInt(900)) || !clients[0].ClientBalance.Equal(decimal.NewFromInt(950)) {
+		t.Errorf("available clients = %+v, expected user balance 900 and client balance 950", clients)
+	}
+}
+
+func TestRoutingSnapshot_InvalidateByManagementWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(ctx context.Context, db database.DatabaseV2, user *model.WhisperUser, client *model.OpenaiClient) error
+	}{
+		{
+			name: "create client",
+			write: func(ctx context.Context, db database.DatabaseV2, _ *model.WhisperUser, _ *model.OpenaiClient) error {
+				_, createErr := NewOpenaiClientDatabaseAccessor(db).CreateClient(ctx, &model.OpenaiClient{Description: "another", ApiKey: "sk-another", Endpoint: "https://api.openai.com/v1", Weight: 1})
+				return createErr
+			},
+		},
+		{
+			name: "update models",
+			write: func(ctx context.Context, db database.DatabaseV2, _ *model.WhisperUser, client *model.OpenaiClient) error {
+				return NewOpenaiModelDatabaseAccessor(db).CreateOrUpdateModels(ctx, []*model.OpenaiModel{{Model: "gpt-4o", Type: model.OpenaiModelTypeChat, MaxTokens: 4096, PromptPrice: decimal.NewFromInt(5), CompletionPrice: decimal.NewFromInt(10), RpmLimit: -1, TpmLimit: -1}}, int(client.ID))
+			},
+		},
+		{
+			name: "sync permissions",
+			write: func(ctx context.Context, db database.DatabaseV2, user *model.WhisperUser, client *model.OpenaiClient) error {
+				return NewWhisperUserPermissionDatabaseAccessor(db).SyncPermissions(ctx, int(user.ID), map[string][]string{client.Description: {"gpt-4o"}})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t)
+			user, client, _ := createTestRoute(t, db, "sk-user", "client", "gpt-4o", 1000)
+			accessor, ctx := NewOpenaiClientDatabaseAccessor(db), trace.NewContext()
+			if _, getErr := accessor.GetAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat); getErr != nil {
+				t.Fatalf("get available clients failed: %v", getErr)
+			}
+
+			if writeErr := tt.write(ctx, db, user, client); writeErr != nil {
+				t.Fatalf("write failed: %v", writeErr)
+			}
+			if !routes.loadedAt.IsZero() {
+				t.Fatalf("routing snapshot is not invalidated")
+			}
+
+			clients, getErr := accessor.GetAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat)
+			if getErr != nil {
+				t.Fatalf("get available clients failed: %v", getErr)
+			}
+			queried, queryErr := accessor.QueryAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat)
+			if queryErr != nil {
+				t.Fatalf("query available clients failed: %v", queryErr)
+			}
+			if len(clients) != len(queried) || len(clients) != 1 || !clients[0].ModelPromptPrice.Equal(queried[0].ModelPromptPrice) {
+				t.Errorf("available clients = %+v, expected %+v", clients, queried)
+			}
+		})
+	}
+}
+
+func BenchmarkOpenaiClientDatabaseAccessor_GetAvailableClients(b *testing.B) {
+	db := newTestDatabase(b)
+	user, client, _ := createTestRoute(b, db, "sk-user", "client", "gpt-4o", 1000000)
+	accessor, ctx := NewOpenaiClientDatabaseAccessor(db), trace.NewContext()
+
+	// a ledger of a long running gateway, every request writes a balance record of the user and the client
+	const ledgerSize = 50000
+	userRecords, clientRecords := make([]*model.WhisperUserBalance, ledgerSize), make([]*model.OpenaiClientBalance, ledgerSize)
+	for i := range ledgerSize {
+		remaining := decimal.NewFromInt(int64(1000000 - i))
+		userRecords[i] = &model.WhisperUserBalance{UserID: user.ID, BalanceChangeAmount: decimal.NewFromInt(-1), BalanceRemaining: remaining, Action: model.WhisperUserBalanceActionConsumption}
+		clientRecords[i] = &model.OpenaiClientBalance{ClientID: client.ID, BalanceChangeAmount: decimal.NewFromInt(-1), BalanceRemaining: remaining, Action: model.OpenaiClientBalanceActionConsumption}
+	}
+	for _, records := range []any{userRecords, clientRecords} {
+		if createErr := db.GetGormCore(ctx).CreateInBatches(records, 500).Error; createErr != nil {
+			b.Fatalf("create ledger failed: %v", createErr)
+		}
+	}
+
+	// other users route to the same model
+	for i := range 200 {
+		other := &model.WhisperUser{Email: "user" + strconv.Itoa(i) + "@example.com", ApiKey: "sk-user-" + strconv.Itoa(i), Role: model.WhisperUserRoleUser, Balance: decimal.NewFromInt(100)}
+		if createErr := db.GetGormCore(ctx).Create(other).Error; createErr != nil {
+			b.Fatalf("create user failed: %v", createErr)
+		}
+		if _, createErr := NewWhisperUserPermissionDatabaseAccessor(db).CreatePermissionRecord(ctx, int(other.ID), int(client.ID), "gpt-4o"); createErr != nil {
+			b.Fatalf("create permission failed: %v", createErr)
+		}
+	}
+
+	b.Run("snapshot", func(b *testing.B) {
+		for range b.N {
+			if _, getErr := accessor.GetAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat); getErr != nil {
+				b.Fatalf("get available clients failed: %v", getErr)
+			}
+		}
+	})
+	b.Run("query", func(b *testing.B) {
+		for range b.N {
+			if _, queryErr := accessor.QueryAvailableClients(ctx, "gpt-4o", "sk-user", model.OpenaiModelTypeChat); queryErr != nil {
+				b.Fatalf("query available clients failed: %v", queryErr)
+			}
+		}
+	})
+}
@@ -19,29 +19,30 @@ func NewWhisperUserDatabaseAccessor(db database.DatabaseV2) *WhisperUserDatabase
 	return &WhisperUserDatabaseAccessor{db: db}
 }
 
-func (ac *WhisperUserDatabaseAccessor) CheckWhisperUserApiKey(ctx context.Context, apiKey string) (exist bool, allowIPs string, err error) {
-	user := new(model.WhisperUser)
+// GetWhisperUserByApiKey returns the identity, allowed ips, moderation switch and rate limits of the user.
+func (ac *WhisperUserDatabaseAccessor) GetWhisperUserByApiKey(ctx context.Context, apiKey string) (user *model.WhisperUser, exist bool, err error) {
+	user = new(model.WhisperUser)
 	queryErr := ac.db.GetGormCore(ctx).
 		Model(&model.WhisperUser{}).
 		Where(model.WhisperUserCols.ApiKey, apiKey).
-		Select(model.WhisperUserCols.AllowIps).
+		Select(model.WhisperUserCols.ID, model.WhisperUserCols.ApiKey, model.WhisperUserCols.AllowIps, model.WhisperUserCols.Moderated, model.WhisperUserCols.RpmLimit, model.WhisperUserCols.TpmLimit, model.WhisperUserCols.ConcurrencyLimit).
 		First(user).
 		Error
 	if queryErr == nil {
-		return true, user.AllowIps, nil
+		return user, true, nil
 	}
 	if errors.Is(queryErr, gorm.ErrRecordNotFound) {
-		return false, "", nil
+		return nil, false, nil
 	}
 
-	return false, "", queryErr
+	return nil, false, queryErr
 }
 
 func (ac *WhisperUserDatabaseAccessor) ListWhisperUsers(ctx context.Context, page, limit int) ([]model.WhisperUser, error) {
 	users := make([]model.WhisperUser, 0)
 	if queryErr := ac.db.GetGormCore(ctx).
 		Model(&model.WhisperUser{}).
-		Select(model.WhisperUserCols.ID, model.WhisperUserCols.ApiKey, model.WhisperUserCols.Email, model.WhisperUserCols.Language, model.WhisperUserCols.AllowIps).
+		Select(model.WhisperUserCols.ID, model.WhisperUserCols.ApiKey, model.WhisperUserCols.Email, model.WhisperUserCols.Language, model.WhisperUserCols.AllowIps, model.WhisperUserCols.Moderated, model.WhisperUserCols.RpmLimit, model.WhisperUserCols.TpmLimit, model.WhisperUserCols.ConcurrencyLimit).
 		Offset(page * limit).
 		Limit(limit).
 		Scan(&users).
@@ -66,6 +67,8 @@ func (ac *WhisperUserDatabaseAccessor) ListWhisperUserApiKeys(ctx context.Contex
 }
 
 func (ac *WhisperUserDatabaseAccessor) CreateWhisperUser(ctx context.Context, user *model.WhisperUser) (created bool, err error) {
+	defer routes.invalidate()
+
 	return ac.db.CreateSingleDataIfNotExist(ctx, user)
 }
 
@@ -128,5 +131,30 @@ func (ac *WhisperUserDatabaseAccessor) GetWhisperUserInfo(ctx context.Context, u
 }
 
 func (ac *WhisperUserDatabaseAccessor) UpdateWhisperUser(ctx context.Context, user *model.WhisperUser) error {
+	defer routes.invalidate()
+
 	return ac.db.UpdateDataBySingleCondition(ctx, user, model.WhisperUserCols.ID, user.ID)
 }
+
+// UpdateWhisperUserModerated updates moderated flag separately, zero value is ignored by UpdateWhisperUser.
+func (ac *WhisperUserDatabaseAccessor) UpdateWhisperUserModerated(ctx context.Context, userID int, moderated bool) error {
+	return ac.db.GetGormCore(ctx).
+		Model(&model.WhisperUser{}).
+		Where(model.WhisperUserCols.ID, userID).
+		Update(model.WhisperUserCols.Moderated, moderated).
+		Error
+}
+
+// UpdateWhisperUserLimits updates rate limits separately, limits is a map of column to value, as zero value
+// is ignored by UpdateWhisperUser.
+func (ac *WhisperUserDatabaseAccessor) UpdateWhisperUserLimits(ctx context.Context, userID int, limits map[string]any) error {
+	if len(limits) == 0 {
+		return nil
+	}
+
+	return ac.db.GetGormCore(ctx).
+		Model(&model.WhisperUser{}).
+		Where(model.WhisperUserCols.ID, userID).
+		Updates(limits).
+		Error
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/alioth-center/akasha-whisper/app/model"
 	"github.com/alioth-center/infrastructure/database"
+	"github.com/alioth-center/infrastructure/utils/values"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
@@ -26,24 +27,35 @@ func (ac *WhisperUserBalanceDatabaseAccessor) CreateBalanceRecord(ctx context.Co
 		recordReason = reason[0]
 	}
 
+	recordID := int64(0)
 	execErr := ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
-		receiver := &model.WhisperUserBalance{}
+		// update the current balance first, the row is locked until the transaction ends, so concurrent
+		// records of the same user are serialized and the remaining of the record is always consistent
+		balance := gorm.Expr(values.BuildStrings(model.WhisperUserCols.Balance, " + ?"), changeAmount)
+		if action == model.WhisperUserBalanceActionInitial {
+			balance = gorm.Expr("?", changeAmount)
+		}
+		if updateErr := tx.WithContext(ctx).
+			Model(&model.WhisperUser{}).
+			Where(model.WhisperUserCols.ID, userID).
+			UpdateColumn(model.WhisperUserCols.Balance, balance).
+			Error; updateErr != nil {
+			return updateErr
+		}
+
+		receiver := &model.WhisperUser{}
 		if queryErr := tx.WithContext(ctx).
-			Model(&model.WhisperUserBalance{}).
-			Where(model.WhisperUserBalanceCols.UserID, userID).
-			Select(model.WhisperUserBalanceCols.BalanceRemaining).
-			Order(clause.OrderByColumn{Column: clause.Column{Name: model.WhisperUserBalanceCols.CreatedAt}, Desc: true}).
+			Model(&model.WhisperUser{}).
+			Where(model.WhisperUserCols.ID, userID).
+			Select(model.WhisperUserCols.Balance).
 			First(receiver).
-			Error; queryErr != nil && !errors.Is(queryErr, gorm.ErrRecordNotFound) {
+			Error; errors.Is(queryErr, gorm.ErrRecordNotFound) {
+			return errors.New("user not found")
+		} else if queryErr != nil {
 			return queryErr
-		} else if errors.Is(queryErr, gorm.ErrRecordNotFound) && action != model.WhisperUserBalanceActionInitial {
-			return errors.New("user balance not initialized")
 		}
 
-		if action == model.WhisperUserBalanceActionInitial {
-			receiver.BalanceRemaining = decimal.Zero
-		}
-		after = receiver.BalanceRemaining.Add(changeAmount)
+		after = receiver.Balance
 		record := &model.WhisperUserBalance{
 			UserID:              int64(userID),
 			BalanceChangeAmount: changeAmount,
@@ -56,12 +68,14 @@ func (ac *WhisperUserBalanceDatabaseAccessor) CreateBalanceRecord(ctx context.Co
 			return createErr
 		}
 
+		recordID = record.ID
 		return nil
 	})
 	if execErr != nil {
 		return decimal.Zero, execErr
 	}
 
+	routes.setUserBalance(userID, after, recordID)
 	return after, nil
 }
 
@@ -74,6 +88,7 @@ func (ac *WhisperUserBalanceDatabaseAccessor) ListBalanceRecords(ctx context.Con
 		Where(clause.Gte{Column: model.WhisperUserBalanceCols.CreatedAt, Value: start}).
 		Where(clause.Lte{Column: model.WhisperUserBalanceCols.CreatedAt, Value: end}).
 		Order(clause.OrderByColumn{Column: clause.Column{Name: model.WhisperUserBalanceCols.CreatedAt}, Desc: true}).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: model.WhisperUserBalanceCols.ID}, Desc: true}).
 		Offset(offset * page).
 		Limit(page).
 		Find(&list).
@@ -85,7 +100,8 @@ func (ac *WhisperUserBalanceDatabaseAccessor) ListBalanceRecords(ctx context.Con
 }
 
 func (ac *WhisperUserBalanceDatabaseAccessor) BatchCreateBalanceRecord(ctx context.Context, userID []int, changeAmount decimal.Decimal, action model.EnumWhisperUserBalanceAction, reason string) error {
-	return ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
+	records := make([]model.WhisperUserBalance, 0, len(userID))
+	execErr := ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
 		users := int64(0)
 		if queryErr := tx.WithContext(ctx).
 			Model(&model.WhisperUser{}).
@@ -99,11 +115,30 @@ func (ac *WhisperUserBalanceDatabaseAccessor) BatchCreateBalanceRecord(ctx conte
 			return errors.New("data not consistent")
 		}
 
-		records := make([]model.WhisperUserBalance, 0, len(userID))
-		for _, id := range userID {
+		// update the current balances first, the rows are locked until the transaction ends
+		if updateErr := tx.WithContext(ctx).
+			Model(&model.WhisperUser{}).
+			Where(model.WhisperUserCols.ID, userID).
+			UpdateColumn(model.WhisperUserCols.Balance, gorm.Expr(values.BuildStrings(model.WhisperUserCols.Balance, " + ?"), changeAmount)).
+			Error; updateErr != nil {
+			return updateErr
+		}
+
+		balances := make([]model.WhisperUser, 0, len(userID))
+		if queryErr := tx.WithContext(ctx).
+			Model(&model.WhisperUser{}).
+			Where(model.WhisperUserCols.ID, userID).
+			Select(model.WhisperUserCols.ID, model.WhisperUserCols.Balance).
+			Find(&balances).
+			Error; queryErr != nil {
+			return queryErr
+		}
+
+		for _, user := range balances {
 			records = append(records, model.WhisperUserBalance{
-				UserID:              int64(id),
+				UserID:              user.ID,
 				BalanceChangeAmount: changeAmount,
+				BalanceRemaining:    user.Balance,
 				Action:              action,
 				Reason:              reason,
 			})
@@ -117,4 +152,36 @@ func (ac *WhisperUserBalanceDatabaseAccessor) BatchCreateBalanceRecord(ctx conte
 
 		return nil
 	})
+	if execErr != nil {
+		return execErr
+	}
+
+	for _, record := range records {
+		routes.setUserBalance(int(record.UserID), record.BalanceRemaining, record.ID)
+	}
+
+	return nil
+}
+
+// MigrateBalances fills the current balance of the users created before the balance column was added, from the
+// latest balance record of each user.
+func (ac *WhisperUserBalanceDatabaseAccessor) MigrateBalances(ctx context.Context) error {
+	defer routes.invalidate()
+
+	latest := ac.db.GetGormCore(ctx).
+		Model(&model.WhisperUserBalance{}).
+		Select(database.Column(model.TableNameWhisperUserBalance, model.WhisperUserBalanceCols.BalanceRemaining)).
+		Where(clause.Eq{
+			Column: database.Column(model.TableNameWhisperUserBalance, model.WhisperUserBalanceCols.UserID),
+			Value:  clause.Column{Table: model.TableNameWhisperUsers, Name: model.WhisperUserCols.ID},
+		}).
+		Order(clause.OrderByColumn{Column: clause.Column{Table: model.TableNameWhisperUserBalance, Name: model.WhisperUserBalanceCols.CreatedAt}, Desc: true}).
+		Order(clause.OrderByColumn{Column: clause.Column{Table: model.TableNameWhisperUserBalance, Name: model.WhisperUserBalanceCols.ID}, Desc: true}).
+		Limit(1)
+
+	return ac.db.GetGormCore(ctx).
+		Model(&model.WhisperUser{}).
+		Where(clause.Eq{Column: model.WhisperUserCols.Balance, Value: nil}).
+		UpdateColumn(model.WhisperUserCols.Balance, gorm.Expr("COALESCE((?), 0)", latest)).
+		Error
 }
@@ -19,6 +19,8 @@ func NewWhisperUserPermissionDatabaseAccessor(db database.DatabaseV2) *WhisperUs
 }
 
 func (ac *WhisperUserPermissionDatabaseAccessor) CreatePermissionRecord(ctx context.Context, userID, clientID int, models ...string) (created []string, err error) {
+	defer routes.invalidate()
+
 	if len(models) == 0 {
 		return []string{}, nil
 	}
@@ -55,6 +57,8 @@ func (ac *WhisperUserPermissionDatabaseAccessor) CreatePermissionRecord(ctx cont
 }
 
 func (ac *WhisperUserPermissionDatabaseAccessor) SyncPermissions(ctx context.Context, userID int, permissions map[string][]string) error {
+	defer routes.invalidate()
+
 	return ac.db.GetGormCore(ctx).Transaction(func(tx *gorm.DB) error {
 		// 1. query clients exists, if not, return error
 		clientNames := make([]string, 0, len(permissions))
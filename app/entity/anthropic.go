@@ -0,0 +1,128 @@
+package entity
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AnthropicMessageRequest anthropic messages request
+// reference https://docs.anthropic.com/en/api/messages
+type AnthropicMessageRequest struct {
+	Model         string               `json:"model" vc:"key:model,required"`
+	Messages      []AnthropicMessage   `json:"messages" vc:"key:messages,required"`
+	System        json.RawMessage      `json:"system,omitempty"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Metadata      *AnthropicMetadata   `json:"metadata,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	TopK          int                  `json:"top_k,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+// AnthropicMessage message of anthropic messages request, content can be a string or an array of content blocks
+type AnthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type AnthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// AnthropicContentBlock content block of anthropic messages, types are text, image, tool_use and tool_result
+// reference https://docs.anthropic.com/en/api/messages#body-messages-content
+type AnthropicContentBlock struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *AnthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage       `json:"content,omitempty"`
+	IsError   bool                  `json:"is_error,omitempty"`
+}
+
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Url       string `json:"url,omitempty"`
+}
+
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// AnthropicMessageResponse anthropic messages response, also used as the message of message_start event
+// reference https://docs.anthropic.com/en/api/messages
+type AnthropicMessageResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicErrorResponse error response in anthropic format
+// reference https://docs.anthropic.com/en/api/errors
+type AnthropicErrorResponse struct {
+	Type  string         `json:"type"`
+	Error AnthropicError `json:"error"`
+}
+
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// AnthropicStreamEvent server sent event of anthropic streaming messages
+// reference https://docs.anthropic.com/en/api/messages-streaming
+type AnthropicStreamEvent struct {
+	Type         string                    `json:"type"`
+	Message      *AnthropicMessageResponse `json:"message,omitempty"`
+	Index        int                       `json:"index"`
+	ContentBlock *AnthropicContentBlock    `json:"content_block,omitempty"`
+	Delta        *AnthropicStreamDelta     `json:"delta,omitempty"`
+	Usage        *AnthropicUsage           `json:"usage,omitempty"`
+	Error        *AnthropicError           `json:"error,omitempty"`
+}
+
+// AnthropicStreamDelta delta of content_block_delta and message_delta events
+type AnthropicStreamDelta struct {
+	Type        string `json:"type,omitempty"`
+	Text        string `json:"text,omitempty"`
+	PartialJson string `json:"partial_json,omitempty"`
+	StopReason  string `json:"stop_reason,omitempty"`
+}
+
+// AnthropicModelListResponse anthropic list models response
+// reference https://docs.anthropic.com/en/api/models-list
+type AnthropicModelListResponse struct {
+	Data    []AnthropicModel `json:"data"`
+	HasMore bool             `json:"has_more"`
+}
+
+type AnthropicModel struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,249 @@
+package entity
+
+import (
+	"encoding/json"
+
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+)
+
+// AudioRequest multipart form of audio transcription and translation
+// reference https://platform.openai.com/docs/api-reference/audio/createTranscription
+type AudioRequest struct {
+	File           []byte
+	FileName       string
+	Model          string
+	Language       string
+	Prompt         string
+	ResponseFormat string
+	Temperature    string
+}
+
+// AudioResponse json response of audio transcription and translation, usage is only reported by newer models
+type AudioResponse struct {
+	Text  string      `json:"text"`
+	Usage *AudioUsage `json:"usage,omitempty"`
+}
+
+// AudioUsage usage of audio transcription, seconds is set if the usage type is duration
+// reference https://platform.openai.com/docs/api-reference/audio/json-object
+type AudioUsage struct {
+	Type    string  `json:"type"`
+	Seconds float64 `json:"seconds,omitempty"`
+}
+
+// AudioVerboseResponse verbose_json response of audio transcription and translation
+// reference https://platform.openai.com/docs/api-reference/audio/verbose-json-object
+type AudioVerboseResponse struct {
+	Task     string         `json:"task"`
+	Language string         `json:"language"`
+	Duration float64        `json:"duration"`
+	Text     string         `json:"text"`
+	Segments []AudioSegment `json:"segments,omitempty"`
+}
+
+type AudioSegment struct {
+	ID    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// CompletionRequest legacy text completion request
+// reference https://platform.openai.com/docs/api-reference/completions/create
+type CompletionRequest struct {
+	Model            string             `json:"model" vc:"key:model,required"`
+	Prompt           json.RawMessage    `json:"prompt,omitempty"`
+	Suffix           string             `json:"suffix,omitempty"`
+	MaxTokens        int                `json:"max_tokens,omitempty"`
+	Temperature      *float64           `json:"temperature,omitempty"`
+	TopP             *float64           `json:"top_p,omitempty"`
+	N                int                `json:"n,omitempty"`
+	Stream           bool               `json:"stream,omitempty"`
+	StreamOptions    json.RawMessage    `json:"stream_options,omitempty"`
+	LogProbs         *int               `json:"logprobs,omitempty"`
+	Echo             bool               `json:"echo,omitempty"`
+	Stop             json.RawMessage    `json:"stop,omitempty"`
+	PresencePenalty  float64            `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float64            `json:"frequency_penalty,omitempty"`
+	BestOf           int                `json:"best_of,omitempty"`
+	LogitBias        map[string]float64 `json:"logit_bias,omitempty"`
+	Seed             *int               `json:"seed,omitempty"`
+	User             string             `json:"user,omitempty"`
+}
+
+// CompletionResponse legacy text completion response, also used as the chunk of streaming response
+// reference https://platform.openai.com/docs/api-reference/completions/object
+type CompletionResponse struct {
+	ID                string              `json:"id"`
+	Object            string              `json:"object"`
+	Created           int64               `json:"created"`
+	Model             string              `json:"model"`
+	SystemFingerprint string              `json:"system_fingerprint,omitempty"`
+	Choices           []CompletionChoice  `json:"choices"`
+	Usage             *openai.UsageObject `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string          `json:"text"`
+	Index        int             `json:"index"`
+	LogProbs     json.RawMessage `json:"logprobs"`
+	FinishReason string          `json:"finish_reason"`
+}
+
+// ModerationRequest moderation request, input can be a string or an array of strings
+// reference https://platform.openai.com/docs/api-reference/moderations/create
+type ModerationRequest struct {
+	Model string          `json:"model,omitempty"`
+	Input json.RawMessage `json:"input" vc:"key:input,required"`
+}
+
+// ModerationResponse moderation response, categories are kept as maps to pass through new categories
+// reference https://platform.openai.com/docs/api-reference/moderations/object
+type ModerationResponse struct {
+	ID      string             `json:"id"`
+	Model   string             `json:"model"`
+	Results []ModerationResult `json:"results"`
+}
+
+type ModerationResult struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+// OpenaiErrorResponse error response in openai format
+// reference https://platform.openai.com/docs/guides/error-codes
+type OpenaiErrorResponse struct {
+	Error OpenaiError `json:"error"`
+}
+
+type OpenaiError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// ChatRequest chat completion request with tool calls, which are not supported by openai.CompleteChatRequestBody
+// reference https://platform.openai.com/docs/api-reference/chat/create
+type ChatRequest struct {
+	Model         string          `json:"model"`
+	Messages      []ChatMessage   `json:"messages"`
+	MaxTokens     int             `json:"max_tokens,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	Stop          []string        `json:"stop,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	StreamOptions json.RawMessage `json:"stream_options,omitempty"`
+	Tools         []openai.Tools  `json:"tools,omitempty"`
+	ToolChoice    any             `json:"tool_choice,omitempty"`
+	User          string          `json:"user,omitempty"`
+}
+
+type ChatMessage struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content,omitempty"`
+	ToolCalls  []ChatToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+}
+
+// ChatContentPart part of the array content of chat message, types are text and image_url
+// reference https://platform.openai.com/docs/api-reference/chat/create#chat-create-messages
+type ChatContentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageUrl *ChatImageUrl `json:"image_url,omitempty"`
+}
+
+type ChatImageUrl struct {
+	Url    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ChatToolCall struct {
+	Index    *int                 `json:"index,omitempty"`
+	ID       string               `json:"id,omitempty"`
+	Type     string               `json:"type,omitempty"`
+	Function ChatToolCallFunction `json:"function"`
+}
+
+type ChatToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// ChatResponse chat completion response, also used as the chunk of streaming response
+// reference https://platform.openai.com/docs/api-reference/chat/object
+type ChatResponse struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []ChatChoice        `json:"choices"`
+	Usage   *openai.UsageObject `json:"usage,omitempty"`
+}
+
+type ChatChoice struct {
+	Index        int          `json:"index"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+// ChatCompletionRequest chat completion request of the compatible endpoint, only the fields used by the gateway
+// are parsed, other fields of the body are kept as is, so that new parameters are forwarded to the upstream
+// reference https://platform.openai.com/docs/api-reference/chat/create
+type ChatCompletionRequest struct {
+	Model               string          `json:"model" vc:"key:model,required"`
+	Messages            []ChatMessage   `json:"messages"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	StreamOptions       json.RawMessage `json:"stream_options,omitempty"`
+	User                string          `json:"user,omitempty"`
+
+	// fields is the raw body, messages are always forwarded from it
+	fields map[string]json.RawMessage
+}
+
+func (r *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
+	type parsed ChatCompletionRequest
+	if err := json.Unmarshal(data, (*parsed)(r)); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &r.fields)
+}
+
+// MarshalJSON marshals the raw body with model, token caps and stream options replaced by the parsed fields.
+func (r *ChatCompletionRequest) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]json.RawMessage, len(r.fields)+2)
+	for key, value := range r.fields {
+		fields[key] = value
+	}
+
+	replaces := map[string]any{"model": r.Model, "stream": r.Stream}
+	if _, exist := fields["stream"]; !exist && !r.Stream {
+		delete(replaces, "stream")
+	}
+	for key, value := range map[string]int{"max_tokens": r.MaxTokens, "max_completion_tokens": r.MaxCompletionTokens} {
+		// token caps are only replaced if the caller specified them, zero means no cap
+		if _, exist := fields[key]; exist && value > 0 {
+			replaces[key] = value
+		} else {
+			delete(fields, key)
+		}
+	}
+	for key, value := range replaces {
+		raw, marshalErr := json.Marshal(value)
+		if marshalErr != nil {
+			return nil, marshalErr
+		}
+		fields[key] = raw
+	}
+	if len(r.StreamOptions) > 0 {
+		fields["stream_options"] = r.StreamOptions
+	}
+
+	return json.Marshal(fields)
+}
@@ -10,19 +10,42 @@ type ListClientsRequest = http.NoBody
 type ListClientResponse = http.BaseResponse[[]*ClientItem]
 
 type ClientItem struct {
-	ID       int             `json:"id"`
-	Name     string          `json:"name"`
-	ApiKey   string          `json:"api_key"`
-	Endpoint string          `json:"endpoint"`
-	Weight   int             `json:"weight"`
-	Balance  decimal.Decimal `json:"balance"`
+	ID              int             `json:"id"`
+	Name            string          `json:"name"`
+	ApiKey          string          `json:"api_key"`
+	Endpoint        string          `json:"endpoint"`
+	Weight          int             `json:"weight"`
+	EffectiveWeight int             `json:"effective_weight"`
+	WeightMinFactor float64         `json:"weight_min_factor"`
+	WeightMaxFactor float64         `json:"weight_max_factor"`
+	Provider        string          `json:"provider"`
+	Balance         decimal.Decimal `json:"balance"`
+	Reserved        decimal.Decimal `json:"reserved_balance"`
+	Health          ClientHealth    `json:"health"`
 }
 
+// ClientHealth health of the client upstream tracked from live traffic, error rate and latency are moving averages
+type ClientHealth struct {
+	CircuitState        string  `json:"circuit_state"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	Requests            int64   `json:"requests"`
+	Failures            int64   `json:"failures"`
+	InFlight            int     `json:"in_flight"`
+	ErrorRate           float64 `json:"error_rate"`
+	RateLimitRate       float64 `json:"rate_limit_rate"`
+	LatencyMs           int64   `json:"latency_ms"`
+}
+
+// CreateClientRequest create client request, the effective weight tuned from live traffic is bounded by
+// weight_min_factor and weight_max_factor times of the weight, unset means 0.1 and 2
 type CreateClientRequest struct {
-	Name     string `json:"name" vc:"key:name,required"`
-	ApiKey   string `json:"api_key" vc:"key:api_key,required"`
-	Endpoint string `json:"endpoint" vc:"key:endpoint,required"`
-	Weight   int    `json:"weight" vc:"key:weight,required"`
+	Name            string  `json:"name" vc:"key:name,required"`
+	ApiKey          string  `json:"api_key" vc:"key:api_key,required"`
+	Endpoint        string  `json:"endpoint" vc:"key:endpoint,required"`
+	Weight          int     `json:"weight" vc:"key:weight,required"`
+	Provider        string  `json:"provider,omitempty" vc:"key:provider"`
+	WeightMinFactor float64 `json:"weight_min_factor,omitempty" vc:"key:weight_min_factor"`
+	WeightMaxFactor float64 `json:"weight_max_factor,omitempty" vc:"key:weight_max_factor"`
 }
 
 type CreateClientResponse = http.BaseResponse[[]*CreateClientScanModelItem]
@@ -31,3 +54,20 @@ type CreateClientScanModelItem struct {
 	ModelName string `json:"model_name"`
 	CreatedAt int64  `json:"created_at"`
 }
+
+type ListClientWeightLogsRequest = http.NoBody
+
+type ListClientWeightLogsResponse = http.BaseResponse[[]*ClientWeightLog]
+
+// ClientWeightLog adjustment of the effective weight of the client made by the weight tuner
+type ClientWeightLog struct {
+	ID              int     `json:"id"`
+	Weight          int     `json:"weight"`
+	PreviousWeight  int     `json:"previous_weight"`
+	EffectiveWeight int     `json:"effective_weight"`
+	ErrorRate       float64 `json:"error_rate"`
+	RateLimitRate   float64 `json:"rate_limit_rate"`
+	LatencyMs       int64   `json:"latency_ms"`
+	Reason          string  `json:"reason"`
+	CreatedAt       string  `json:"created_at"`
+}
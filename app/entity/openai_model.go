@@ -10,14 +10,18 @@ type ListClientModelRequest = http.NoBody
 type ListClientModelResponse = http.BaseResponse[[]*ModelItem]
 
 type ModelItem struct {
-	ID              int             `json:"id"`
-	Name            string          `json:"name"`
-	MaxTokens       int             `json:"max_tokens"`
-	RpmLimit        int             `json:"rpm_limit"`
-	TpmLimit        int             `json:"tpm_limit"`
-	PromptPrice     decimal.Decimal `json:"prompt_price"`
-	CompletionPrice decimal.Decimal `json:"completion_price"`
-	LastUpdatedAt   int64           `json:"last_updated_at"`
+	ID               int             `json:"id"`
+	Name             string          `json:"name"`
+	UpstreamModel    string          `json:"upstream_model,omitempty"`
+	RoutingStrategy  string          `json:"routing_strategy,omitempty"`
+	Type             string          `json:"type"`
+	MaxTokens        int             `json:"max_tokens"`
+	RpmLimit         int             `json:"rpm_limit"`
+	TpmLimit         int             `json:"tpm_limit"`
+	AudioVerboseJson bool            `json:"audio_verbose_json,omitempty"`
+	PromptPrice      decimal.Decimal `json:"prompt_price"`
+	CompletionPrice  decimal.Decimal `json:"completion_price"`
+	LastUpdatedAt    int64           `json:"last_updated_at"`
 }
 
 type CreateClientModelRequest struct {
@@ -25,12 +29,23 @@ type CreateClientModelRequest struct {
 }
 
 type CreateClientModelItem struct {
-	Name            string          `json:"name" vc:"key:name,required"`
-	MaxTokens       int             `json:"max_tokens" vc:"key:max_tokens,required"`
-	PromptPrice     decimal.Decimal `json:"prompt_price" vc:"key:prompt_price,required"`
-	CompletionPrice decimal.Decimal `json:"completion_price" vc:"key:completion_price,required"`
-	RpmLimit        int             `json:"rpm_limit,omitempty"`
-	TpmLimit        int             `json:"tpm_limit,omitempty"`
+	Name             string                 `json:"name" vc:"key:name,required"`
+	UpstreamModel    string                 `json:"upstream_model,omitempty"`
+	RoutingStrategy  string                 `json:"routing_strategy,omitempty"`
+	Type             string                 `json:"type,omitempty"`
+	MaxTokens        int                    `json:"max_tokens" vc:"key:max_tokens,required"`
+	PromptPrice      decimal.Decimal        `json:"prompt_price" vc:"key:prompt_price,required"`
+	CompletionPrice  decimal.Decimal        `json:"completion_price" vc:"key:completion_price,required"`
+	RpmLimit         int                    `json:"rpm_limit,omitempty"`
+	TpmLimit         int                    `json:"tpm_limit,omitempty"`
+	ImagePrices      []CreateImagePriceItem `json:"image_prices,omitempty"`
+	AudioVerboseJson bool                   `json:"audio_verbose_json,omitempty"`
+}
+
+type CreateImagePriceItem struct {
+	Size    string          `json:"size" vc:"key:size,required"`
+	Quality string          `json:"quality,omitempty"`
+	Price   decimal.Decimal `json:"price" vc:"key:price,required"`
 }
 
 type CreateResponse struct {
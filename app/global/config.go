@@ -31,10 +31,18 @@ type LogConfig struct {
 }
 
 type AppConfig struct {
-	MaxToken        int    `yaml:"max_token"`
-	ManagementToken string `yaml:"management_token"`
-	PriceTokenUnit  int64  `yaml:"price_token_unit"`
-	LoginTokenKey   string `yaml:"login_token_key"`
+	MaxToken                int                 `yaml:"max_token"`
+	ManagementToken         string              `yaml:"management_token"`
+	PriceTokenUnit          int64               `yaml:"price_token_unit"`
+	LoginTokenKey           string              `yaml:"login_token_key"`
+	ModerationModel         string              `yaml:"moderation_model"`
+	MaxRetries              int                 `yaml:"max_retries"`
+	LoadBalance             string              `yaml:"load_balance"`
+	ModelFallbacks          map[string][]string `yaml:"model_fallbacks"`
+	CircuitBreakerThreshold int                 `yaml:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown  int                 `yaml:"circuit_breaker_cooldown"`
+	SessionAffinityIdle     int                 `yaml:"session_affinity_idle"`
+	WeightTuningInterval    int                 `yaml:"weight_tuning_interval"`
 }
 
 type DatabaseConfig struct {
@@ -10,7 +10,9 @@ var (
 
 	OpenaiClientDatabaseInstance          *dao.OpenaiClientDatabaseAccessor
 	OpenaiClientBalanceDatabaseInstance   *dao.OpenaiClientBalanceDatabaseAccessor
+	OpenaiClientWeightDatabaseInstance    *dao.OpenaiClientWeightDatabaseAccessor
 	OpenaiModelDatabaseInstance           *dao.OpenaiModelDatabaseAccessor
+	OpenaiImagePriceDatabaseInstance      *dao.OpenaiImagePriceDatabaseAccessor
 	OpenaiRequestDatabaseInstance         *dao.OpenaiRequestDatabaseAccessor
 	WhisperUserDatabaseInstance           *dao.WhisperUserDatabaseAccessor
 	WhisperUserBalanceDatabaseInstance    *dao.WhisperUserBalanceDatabaseAccessor
@@ -2,6 +2,7 @@ package global
 
 import (
 	"context"
+	"os"
 	"path/filepath"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 
 	"github.com/alioth-center/akasha-whisper/app/dao"
 	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
 	"github.com/alioth-center/infrastructure/config"
 	acdb "github.com/alioth-center/infrastructure/database"
 	"github.com/alioth-center/infrastructure/database/mysql"
@@ -25,7 +27,7 @@ import (
 )
 
 var syncModels = []any{
-	&model.OpenaiClient{}, &model.OpenaiClientBalance{}, &model.OpenaiModel{}, &model.OpenaiRequest{},
+	&model.OpenaiClient{}, &model.OpenaiClientBalance{}, &model.OpenaiClientWeight{}, &model.OpenaiModel{}, &model.OpenaiRequest{}, &model.OpenaiImagePrice{},
 	&model.WhisperUser{}, &model.WhisperUserBalance{}, &model.WhisperUserPermission{},
 }
 
@@ -57,6 +59,32 @@ func initializeConfig() {
 	if readErr != nil {
 		panic(readErr)
 	}
+
+	// failover retries, unset means default 2 retries, negative means disable failover
+	if Config.App.MaxRetries == 0 {
+		Config.App.MaxRetries = 2
+	} else if Config.App.MaxRetries < 0 {
+		Config.App.MaxRetries = 0
+	}
+
+	// sqlite database file, unset means ./data/akasha_whisper.db
+	if Config.Database.Driver == sqlite.DriverName && Config.Database.Host == "" {
+		Config.Database.Host = "./data/akasha_whisper.db"
+	}
+
+	// circuit breaker, unset means opening after 5 consecutive failures and probing after 30 seconds, negative
+	// threshold means disable circuit breaker
+	if Config.App.CircuitBreakerThreshold == 0 {
+		Config.App.CircuitBreakerThreshold = 5
+	}
+	if Config.App.CircuitBreakerCooldown <= 0 {
+		Config.App.CircuitBreakerCooldown = 30
+	}
+
+	// load balance algorithm, unset means weighted random
+	if Config.App.LoadBalance == "" {
+		Config.App.LoadBalance = "weighted_random"
+	}
 }
 
 func initializeLogger() {
@@ -132,8 +160,13 @@ func initializeDatabase() {
 
 		database = mysqlDB
 	case sqlite.DriverName:
+		// host is the database file for sqlite, the directory is created if not exists
+		if mkdirErr := os.MkdirAll(filepath.Dir(Config.Database.Host), 0o755); mkdirErr != nil {
+			panic(mkdirErr)
+		}
 		sqliteCfg := sqlite.Config{
-			Database: "./data/akasha_whisper.db",
+			// wait for the lock instead of failing, balance records of concurrent requests are serialized by the lock
+			Database: values.BuildStrings(Config.Database.Host, "?_pragma=busy_timeout(5000)"),
 		}
 
 		models := syncModels
@@ -153,19 +186,37 @@ func initializeDatabase() {
 	DatabaseInstance = database
 	OpenaiClientDatabaseInstance = dao.NewOpenaiClientDatabaseAccessor(database)
 	OpenaiClientBalanceDatabaseInstance = dao.NewOpenaiClientBalanceDatabaseAccessor(database)
+	OpenaiClientWeightDatabaseInstance = dao.NewOpenaiClientWeightDatabaseAccessor(database)
 	OpenaiModelDatabaseInstance = dao.NewOpenaiModelDatabaseAccessor(database)
+	OpenaiImagePriceDatabaseInstance = dao.NewOpenaiImagePriceDatabaseAccessor(database)
 	OpenaiRequestDatabaseInstance = dao.NewOpenaiRequestDatabaseAccessor(database)
 	WhisperUserDatabaseInstance = dao.NewWhisperUserDatabaseAccessor(database)
 	WhisperUserBalanceDatabaseInstance = dao.NewWhisperUserBalanceDatabaseAccessor(database)
 	WhisperUserPermissionDatabaseInstance = dao.NewWhisperUserPermissionDatabaseAccessor(database)
 
 	dao.LoadRawSqlList(Config.Database.Driver)
+
+	// drop the indexes renamed with table prefixes, they are left besides the renamed ones by earlier migrations
+	ctx := trace.NewContext()
+	if Config.Database.SyncModels {
+		if dropErr := dao.DropLegacyIndexes(ctx, database); dropErr != nil {
+			panic(dropErr)
+		}
+	}
+
+	// fill current balances of the users and clients created before the balance columns were added
+	if migrateErr := WhisperUserBalanceDatabaseInstance.MigrateBalances(ctx); migrateErr != nil {
+		panic(migrateErr)
+	}
+	if migrateErr := OpenaiClientBalanceDatabaseInstance.MigrateBalances(ctx); migrateErr != nil {
+		panic(migrateErr)
+	}
 }
 
 func initializeCache() {
 	LoginCookieCacheInstance = memory.NewMemoryCache(memory.Config{EnableInitiativeClean: true, CleanIntervalSecond: 600, MaxCleanMicroSecond: 1000, MaxCleanPercentage: 100})
 	OpenaiClientCacheInstance = concurrency.NewMap[int, openai.Client]()
-	OpenaiClientSecretsCacheInstance = concurrency.NewMap[int, *openai.Config]()
+	OpenaiClientSecretsCacheInstance = concurrency.NewMap[int, *dto.ClientSecretDTO]()
 }
 
 func initializeBloomFilter(ctx context.Context) {
@@ -1,63 +1,45 @@
 package dto
 
-import (
-	"strconv"
-	"strings"
-
-	"github.com/alioth-center/infrastructure/utils/values"
-	"github.com/shopspring/decimal"
-)
+import "github.com/shopspring/decimal"
 
 type ClientCheckDTO struct {
 	ID   int    `gorm:"column:id"`
 	Name string `gorm:"column:description"`
 }
 
-type GetAvailableClientCND struct {
-	UserApiKey string
-	ModelName  string
-	ModelType  string
-}
-
-func (cnd *GetAvailableClientCND) ParseTemplate(tmpl string) string {
-	condition := map[string]string{
-		"user_api_key": cnd.UserApiKey,
-		"model_name":   cnd.ModelName,
-		"model_type":   cnd.ModelType,
-	}
-
-	return values.NewRawSqlTemplateWithMap(tmpl, condition).Parse()
-}
-
-type GetClientSecretCND struct {
-	ClientIDs []int
+type AvailableClientDTO struct {
+	ClientID              int             `gorm:"column:client_id"`
+	ClientWeight          int64           `gorm:"column:client_weight"`
+	ClientBalance         decimal.Decimal `gorm:"column:client_balance"`
+	UserID                int             `gorm:"column:user_id"`
+	UserBalance           decimal.Decimal `gorm:"column:user_balance"`
+	UserRole              string          `gorm:"column:user_role"`
+	ModelID               int             `gorm:"column:model_id"`
+	ModelName             string          `gorm:"column:model_name"`
+	ModelUpstreamName     string          `gorm:"column:model_upstream_name"`
+	ModelRoutingStrategy  string          `gorm:"column:model_routing_strategy"`
+	ModelMaxToken         int             `gorm:"column:model_max_token"`
+	ModelPromptPrice      decimal.Decimal `gorm:"column:model_prompt_price"`
+	ModelCompletionPrice  decimal.Decimal `gorm:"column:model_completion_price"`
+	ModelRpmLimit         int             `gorm:"column:model_rpm_limit"`
+	ModelTpmLimit         int             `gorm:"column:model_tpm_limit"`
+	ModelAudioVerboseJson bool            `gorm:"column:model_audio_verbose_json"`
 }
 
-func (cnd *GetClientSecretCND) ParseTemplate(tmpl string) string {
-	conditions := make([]string, 0, len(cnd.ClientIDs))
-	for _, clientID := range cnd.ClientIDs {
-		conditions = append(conditions, strconv.Itoa(clientID))
+// UpstreamModel returns the model name sent to the upstream of the client, the public name is used if not mapped.
+func (c *AvailableClientDTO) UpstreamModel() string {
+	if c.ModelUpstreamName != "" {
+		return c.ModelUpstreamName
 	}
 
-	condition := map[string]string{
-		"openai_client_id": strings.Join(conditions, ","),
-	}
-
-	return values.NewRawSqlTemplateWithMap(tmpl, condition).Parse()
+	return c.ModelName
 }
 
-type AvailableClientDTO struct {
-	ClientID             int             `gorm:"column:client_id"`
-	ClientWeight         int64           `gorm:"column:client_weight"`
-	ClientBalance        decimal.Decimal `gorm:"column:client_balance"`
-	UserID               int             `gorm:"column:user_id"`
-	UserBalance          decimal.Decimal `gorm:"column:user_balance"`
-	UserRole             string          `gorm:"column:user_role"`
-	ModelID              int             `gorm:"column:model_id"`
-	ModelName            string          `gorm:"column:model_name"`
-	ModelMaxToken        int             `gorm:"column:model_max_token"`
-	ModelPromptPrice     decimal.Decimal `gorm:"column:model_prompt_price"`
-	ModelCompletionPrice decimal.Decimal `gorm:"column:model_completion_price"`
+// RouteDTO is a route of the routing snapshot, the user can call the model on the client.
+type RouteDTO struct {
+	AvailableClientDTO
+	UserApiKey string `gorm:"column:user_api_key"`
+	ModelType  string `gorm:"column:model_type"`
 }
 
 type ClientSecretDTO struct {
@@ -65,6 +47,7 @@ type ClientSecretDTO struct {
 	ClientKey      string          `gorm:"column:api_key"`
 	ClientEndpoint string          `gorm:"column:endpoint"`
 	ClientWeight   int             `gorm:"column:weight"`
+	ClientProvider string          `gorm:"column:provider"`
 	ClientBalance  decimal.Decimal `gorm:"column:balance"`
 }
 
@@ -74,5 +57,8 @@ type ListClientDTO struct {
 	ClientKey         string          `gorm:"column:api_key"`
 	ClientEndpoint    string          `gorm:"column:endpoint"`
 	ClientWeight      int             `gorm:"column:weight"`
+	ClientProvider    string          `gorm:"column:provider"`
 	ClientBalance     decimal.Decimal `gorm:"column:balance"`
+	WeightMinFactor   float64         `gorm:"column:weight_min_factor"`
+	WeightMaxFactor   float64         `gorm:"column:weight_max_factor"`
 }
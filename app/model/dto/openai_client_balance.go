@@ -1,6 +1,8 @@
 package dto
 
 import (
+	"database/sql/driver"
+	"fmt"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -9,7 +11,47 @@ import (
 type OpenaiClientBalanceStatisticsDTO struct {
 	ClientID     int             `gorm:"column:client_id" json:"client_id"`
 	ClientName   string          `gorm:"column:client_name" json:"client_name"`
-	DateDay      time.Time       `gorm:"column:date_day" json:"date_day"`
+	DateDay      StatisticsDate  `gorm:"column:date_day" json:"date_day"`
 	TotalCost    decimal.Decimal `gorm:"column:total_cost" json:"total_cost"`
 	RequestCount int             `gorm:"column:request_count" json:"request_count"`
 }
+
+// StatisticsDate is a date calculated in sql, mysql without parse_time and sqlite return it as text.
+type StatisticsDate struct {
+	time.Time
+}
+
+func (d *StatisticsDate) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		d.Time = time.Time{}
+		return nil
+	case time.Time:
+		d.Time = v
+		return nil
+	case []byte:
+		return d.parse(string(v))
+	case string:
+		return d.parse(v)
+	default:
+		return fmt.Errorf("unsupported statistics date type %T", value)
+	}
+}
+
+func (d StatisticsDate) Value() (driver.Value, error) {
+	return d.Time, nil
+}
+
+func (d *StatisticsDate) parse(text string) error {
+	if len(text) < len(time.DateOnly) {
+		return fmt.Errorf("invalid statistics date %q", text)
+	}
+
+	date, parseErr := time.Parse(time.DateOnly, text[:len(time.DateOnly)])
+	if parseErr != nil {
+		return parseErr
+	}
+
+	d.Time = date
+	return nil
+}
@@ -7,15 +7,18 @@ import (
 )
 
 type RelatedModelDTO struct {
-	ModelID         int             `gorm:"column:model_id"`
-	ModelName       string          `gorm:"column:model_name"`
-	ModelType       string          `gorm:"column:model_type"`
-	MaxTokens       int             `gorm:"column:model_max_tokens"`
-	ModelRpmLimit   int             `gorm:"column:model_rpm_limit"`
-	ModelTpmLimit   int             `gorm:"column:model_tpm_limit"`
-	LastUpdatedAt   time.Time       `gorm:"column:last_updated_at"`
-	PromptPrice     decimal.Decimal `gorm:"column:model_prompt_price"`
-	CompletionPrice decimal.Decimal `gorm:"column:model_completion_price"`
+	ModelID          int             `gorm:"column:model_id"`
+	ModelName        string          `gorm:"column:model_name"`
+	UpstreamModel    string          `gorm:"column:model_upstream_name"`
+	RoutingStrategy  string          `gorm:"column:model_routing_strategy"`
+	ModelType        string          `gorm:"column:model_type"`
+	MaxTokens        int             `gorm:"column:model_max_tokens"`
+	ModelRpmLimit    int             `gorm:"column:model_rpm_limit"`
+	ModelTpmLimit    int             `gorm:"column:model_tpm_limit"`
+	AudioVerboseJson bool            `gorm:"column:model_audio_verbose_json"`
+	LastUpdatedAt    time.Time       `gorm:"column:last_updated_at"`
+	PromptPrice      decimal.Decimal `gorm:"column:model_prompt_price"`
+	CompletionPrice  decimal.Decimal `gorm:"column:model_completion_price"`
 }
 
 type ClientModelDTO struct {
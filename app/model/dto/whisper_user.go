@@ -12,12 +12,16 @@ type WhisperUserInfo struct {
 }
 
 type WhisperUserInfoDTO struct {
-	ID        int             `gorm:"column:id"`
-	Email     string          `gorm:"column:email"`
-	ApiKey    string          `gorm:"column:api_key"`
-	Role      string          `gorm:"column:role"`
-	Language  string          `gorm:"column:language"`
-	AllowIps  string          `gorm:"column:allow_ips"`
-	UpdatedAt time.Time       `gorm:"column:updated_at"`
-	Balance   decimal.Decimal `gorm:"column:balance"`
+	ID               int             `gorm:"column:id"`
+	Email            string          `gorm:"column:email"`
+	ApiKey           string          `gorm:"column:api_key"`
+	Role             string          `gorm:"column:role"`
+	Language         string          `gorm:"column:language"`
+	AllowIps         string          `gorm:"column:allow_ips"`
+	Moderated        bool            `gorm:"column:moderated"`
+	RpmLimit         int             `gorm:"column:rpm_limit"`
+	TpmLimit         int             `gorm:"column:tpm_limit"`
+	ConcurrencyLimit int             `gorm:"column:concurrency_limit"`
+	UpdatedAt        time.Time       `gorm:"column:updated_at"`
+	Balance          decimal.Decimal `gorm:"column:balance"`
 }
@@ -1,18 +1,35 @@
 package model
 
-import "time"
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type OpenaiClientProviderEnum = string
+
+const (
+	OpenaiClientProviderOpenai    OpenaiClientProviderEnum = "openai"    // openai and openai compatible upstreams
+	OpenaiClientProviderAzure     OpenaiClientProviderEnum = "azure"     // azure openai, model name is used as deployment name
+	OpenaiClientProviderAnthropic OpenaiClientProviderEnum = "anthropic" // anthropic native messages api
+	OpenaiClientProviderGemini    OpenaiClientProviderEnum = "gemini"    // google gemini native generate content api
+)
 
 // OpenaiClient openai service secret
 //
 // Reference: https://docs.alioth.center/akasha-whisper-database.html#openai-clients
 type OpenaiClient struct {
-	ID          int64     `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;index:idx_ids"`
-	Description string    `gorm:"column:description;type:varchar(64);not null;comment:openai_service_description;uniqueIndex:idx_desc"`
-	ApiKey      string    `gorm:"column:api_key;type:varchar(256);not null;comment:openai_service_api_key;index:idx_api_key"`
-	Endpoint    string    `gorm:"column:endpoint;type:varchar(64);not null;comment:openai_service_endpoint;index:idx_endpoint"`
-	Weight      int       `gorm:"column:weight;type:integer;not null;comment:openai_service_weight;index:idx_weight"`
-	CreatedAt   time.Time `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
-	UpdatedAt   time.Time `gorm:"column:updated_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	ID              int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;index:idx_openai_clients_ids"`
+	Description     string          `gorm:"column:description;type:varchar(64);not null;comment:openai_service_description;uniqueIndex:idx_desc"`
+	ApiKey          string          `gorm:"column:api_key;type:varchar(256);not null;comment:openai_service_api_key;index:idx_api_key"`
+	Endpoint        string          `gorm:"column:endpoint;type:varchar(64);not null;comment:openai_service_endpoint;index:idx_endpoint"`
+	Weight          int             `gorm:"column:weight;type:integer;not null;comment:openai_service_weight;index:idx_weight"`
+	Provider        string          `gorm:"column:provider;type:varchar(16);not null;default:openai;comment:openai_service_provider"`
+	WeightMinFactor float64         `gorm:"column:weight_min_factor;type:decimal(10,6);not null;default:0.1;comment:openai_service_weight_tuning_min_factor"`
+	WeightMaxFactor float64         `gorm:"column:weight_max_factor;type:decimal(10,6);not null;default:2;comment:openai_service_weight_tuning_max_factor"`
+	Balance         decimal.Decimal `gorm:"column:balance;type:decimal(16,8);comment:openai_service_balance"`
+	CreatedAt       time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt       time.Time       `gorm:"column:updated_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
 }
 
 func (c OpenaiClient) TableName() string {
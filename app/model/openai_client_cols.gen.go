@@ -10,6 +10,8 @@ type openaiclientCols struct {
 	ApiKey      string
 	Endpoint    string
 	Weight      string
+	Provider    string
+	Balance     string
 	CreatedAt   string
 	UpdatedAt   string
 }
@@ -20,6 +22,8 @@ var OpenaiClientCols = &openaiclientCols{
 	ApiKey:      "api_key",
 	Endpoint:    "endpoint",
 	Weight:      "weight",
+	Provider:    "provider",
+	Balance:     "balance",
 	CreatedAt:   "created_at",
 	UpdatedAt:   "updated_at",
 }
@@ -0,0 +1,26 @@
+package model
+
+import (
+	"time"
+)
+
+// OpenaiClientWeight openai client weight adjustment record, written by the weight tuner when the effective weight
+// of the client changes, Weight is the manual weight set by the administrator as the baseline
+//
+// Reference: https://docs.alioth.center/akasha-whisper-database.html#openai-client-weight
+type OpenaiClientWeight struct {
+	ID              int64     `gorm:"column:id;type:integer;autoIncrement:true;primaryKey:true"`
+	ClientID        int64     `gorm:"column:client_id;type:integer;not null;index:idx_openai_client_weight_client_id"`
+	Weight          int       `gorm:"column:weight;type:integer;not null;comment:openai_client_manual_weight"`
+	PreviousWeight  int       `gorm:"column:previous_weight;type:integer;not null;comment:openai_client_previous_effective_weight"`
+	EffectiveWeight int       `gorm:"column:effective_weight;type:integer;not null;comment:openai_client_effective_weight"`
+	ErrorRate       float64   `gorm:"column:error_rate;type:decimal(10,6);not null;default:0"`
+	RateLimitRate   float64   `gorm:"column:rate_limit_rate;type:decimal(10,6);not null;default:0"`
+	LatencyMs       int64     `gorm:"column:latency_ms;type:integer;not null;default:0"`
+	Reason          string    `gorm:"column:reason;type:varchar(255);not null;default:''"`
+	CreatedAt       time.Time `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP;index:idx_openai_client_weight_created_at"`
+}
+
+func (m OpenaiClientWeight) TableName() string {
+	return TableNameOpenaiClientWeight
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// OpenaiImagePrice openai image model price per generated image
+//
+// Reference: https://docs.alioth.center/akasha-whisper-database.html#openai-image-prices
+type OpenaiImagePrice struct {
+	ID        int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;index:idx_openai_image_prices_ids"`
+	ModelID   int64           `gorm:"column:model_id;type:integer;not null;comment:openai_model_id;uniqueIndex:idx_prices;index:idx_openai_image_prices_model_ids"`
+	Size      string          `gorm:"column:size;type:varchar(16);not null;comment:openai_image_size;uniqueIndex:idx_prices"`
+	Quality   string          `gorm:"column:quality;type:varchar(16);not null;default:'';comment:openai_image_quality;uniqueIndex:idx_prices"`
+	Price     decimal.Decimal `gorm:"column:price;type:decimal(16,8);not null;comment:openai_image_price"`
+	CreatedAt time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time       `gorm:"column:updated_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (p OpenaiImagePrice) TableName() string {
+	return TableNameOpenaiImagePrices
+}
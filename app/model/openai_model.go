@@ -6,21 +6,39 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-// OpenaiModel openai model
+type EnumOpenaiModelType = string
+
+const (
+	OpenaiModelTypeChat          EnumOpenaiModelType = "chat"          // 1. 对话：Chat - Chat completion models
+	OpenaiModelTypeEmbedding     EnumOpenaiModelType = "embedding"     // 2. 嵌入：Embedding - Text embedding models
+	OpenaiModelTypeSpeech        EnumOpenaiModelType = "speech"        // 3. 语音：Speech - Text to speech models
+	OpenaiModelTypeImage         EnumOpenaiModelType = "image"         // 4. 图片：Image - Image generation models, billed per image
+	OpenaiModelTypeTranscription EnumOpenaiModelType = "transcription" // 5. 转录：Transcription - Speech to text models, billed per audio second
+	OpenaiModelTypeCompletion    EnumOpenaiModelType = "completion"    // 6. 补全：Completion - Legacy text completion models
+	OpenaiModelTypeModeration    EnumOpenaiModelType = "moderation"    // 7. 审核：Moderation - Content moderation models
+)
+
+// OpenaiModel openai model, Model is the public name called by users, UpstreamModel is the name sent to the
+// upstream of the client, empty means the same as Model, so a model can be served by clients with different names.
+// RoutingStrategy selects the client serving the model, empty means the load_balance of the config, AudioVerboseJson
+// marks transcription models returning verbose_json with the duration of the audio
 //
 // Reference: https://docs.alioth.center/akasha-whisper-database.html#openai-models
 type OpenaiModel struct {
-	ID              int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;uniqueIndex:idx_ids"`
-	ClientID        int64           `gorm:"column:client_id;type:integer;not null;comment:openai_client_id;uniqueIndex:idx_ids;uniqueIndex:idx_names;index:idx_client_ids"`
-	Model           string          `gorm:"column:model;type:varchar(32);not null;comment:openai_model_name;index:idx_name;uniqueIndex:idx_names"`
-	Type            string          `gorm:"column:type;type:varchar(64);not null;comment:openai_model_type;default:chat;index:idx_type"`
-	MaxTokens       int             `gorm:"column:max_tokens;type:integer;not null;comment:openai_max_tokens"`
-	PromptPrice     decimal.Decimal `gorm:"column:prompt_price;type:decimal(16,8);not null;comment:openai_prompt_price"`
-	CompletionPrice decimal.Decimal `gorm:"column:completion_price;type:decimal(16,8);not null;comment:openai_completion_price"`
-	RpmLimit        int             `gorm:"column:rpm_limit;type:integer;not null;default:-1;comment:openai_rpm_limit"`
-	TpmLimit        int             `gorm:"column:tpm_limit;type:integer;not null;default:-1;comment:openai_tpm_limit"`
-	CreatedAt       time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
-	UpdatedAt       time.Time       `gorm:"column:updated_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	ID               int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;uniqueIndex:idx_openai_models_ids"`
+	ClientID         int64           `gorm:"column:client_id;type:integer;not null;comment:openai_client_id;uniqueIndex:idx_openai_models_ids;uniqueIndex:idx_names;index:idx_openai_models_client_ids"`
+	Model            string          `gorm:"column:model;type:varchar(32);not null;comment:openai_model_name;index:idx_name;uniqueIndex:idx_names"`
+	UpstreamModel    string          `gorm:"column:upstream_model;type:varchar(128);not null;default:'';comment:openai_upstream_model_name"`
+	RoutingStrategy  string          `gorm:"column:routing_strategy;type:varchar(32);not null;default:'';comment:openai_model_routing_strategy"`
+	Type             string          `gorm:"column:type;type:varchar(64);not null;comment:openai_model_type;default:chat;index:idx_type"`
+	MaxTokens        int             `gorm:"column:max_tokens;type:integer;not null;comment:openai_max_tokens"`
+	PromptPrice      decimal.Decimal `gorm:"column:prompt_price;type:decimal(16,8);not null;comment:openai_prompt_price"`
+	CompletionPrice  decimal.Decimal `gorm:"column:completion_price;type:decimal(16,8);not null;comment:openai_completion_price"`
+	RpmLimit         int             `gorm:"column:rpm_limit;type:integer;not null;default:-1;comment:openai_rpm_limit"`
+	TpmLimit         int             `gorm:"column:tpm_limit;type:integer;not null;default:-1;comment:openai_tpm_limit"`
+	AudioVerboseJson bool            `gorm:"column:audio_verbose_json;type:boolean;not null;default:false;comment:openai_model_audio_verbose_json"`
+	CreatedAt        time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt        time.Time       `gorm:"column:updated_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
 }
 
 func (m OpenaiModel) TableName() string {
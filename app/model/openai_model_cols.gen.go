@@ -5,29 +5,35 @@
 package model
 
 type openaimodelCols struct {
-	ID              string
-	ClientID        string
-	Model           string
-	Type            string
-	MaxTokens       string
-	PromptPrice     string
-	CompletionPrice string
-	RpmLimit        string
-	TpmLimit        string
-	CreatedAt       string
-	UpdatedAt       string
+	ID               string
+	ClientID         string
+	Model            string
+	UpstreamModel    string
+	RoutingStrategy  string
+	Type             string
+	MaxTokens        string
+	PromptPrice      string
+	CompletionPrice  string
+	RpmLimit         string
+	TpmLimit         string
+	AudioVerboseJson string
+	CreatedAt        string
+	UpdatedAt        string
 }
 
 var OpenaiModelCols = &openaimodelCols{
-	ID:              "id",
-	ClientID:        "client_id",
-	Model:           "model",
-	Type:            "type",
-	MaxTokens:       "max_tokens",
-	PromptPrice:     "prompt_price",
-	CompletionPrice: "completion_price",
-	RpmLimit:        "rpm_limit",
-	TpmLimit:        "tpm_limit",
-	CreatedAt:       "created_at",
-	UpdatedAt:       "updated_at",
+	ID:               "id",
+	ClientID:         "client_id",
+	Model:            "model",
+	UpstreamModel:    "upstream_model",
+	RoutingStrategy:  "routing_strategy",
+	Type:             "type",
+	MaxTokens:        "max_tokens",
+	PromptPrice:      "prompt_price",
+	CompletionPrice:  "completion_price",
+	RpmLimit:         "rpm_limit",
+	TpmLimit:         "tpm_limit",
+	AudioVerboseJson: "audio_verbose_json",
+	CreatedAt:        "created_at",
+	UpdatedAt:        "updated_at",
 }
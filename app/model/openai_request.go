@@ -6,20 +6,28 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+type OpenaiRequestStatusEnum = string
+
+const (
+	OpenaiRequestStatusSuccess OpenaiRequestStatusEnum = "success" // request forwarded and completed
+	OpenaiRequestStatusFlagged OpenaiRequestStatusEnum = "flagged" // request rejected by moderation
+)
+
 // OpenaiRequest openai request
 //
 // Reference: https://docs.alioth.center/akasha-whisper-database.html#openai-requests
 type OpenaiRequest struct {
-	ID                   int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;index:idx_ids"`
-	ClientID             int64           `gorm:"column:client_id;type:integer;not null;comment:openai_client_id;index:idx_client_ids"`
+	ID                   int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;index:idx_openai_requests_ids"`
+	ClientID             int64           `gorm:"column:client_id;type:integer;not null;comment:openai_client_id;index:idx_openai_requests_client_ids"`
 	RequestID            string          `gorm:"column:request_id;type:varchar(64);not null;comment:openai_request_id;index:idx_request_ids"`
 	TraceID              string          `gorm:"column:trace_id;type:varchar(64);not null;comment:openai_trace_id;index:idx_trace_ids"`
-	ModelID              int64           `gorm:"column:model_id;type:integer;not null;comment:openai_model_id;index:idx_model_ids"`
-	UserID               int64           `gorm:"column:user_id;type:integer;not null;comment:openai_user_id;index:idx_user_ids"`
+	ModelID              int64           `gorm:"column:model_id;type:integer;not null;comment:openai_model_id;index:idx_openai_requests_model_ids"`
+	UserID               int64           `gorm:"column:user_id;type:integer;not null;comment:openai_user_id;index:idx_openai_requests_user_ids"`
 	RequestIP            string          `gorm:"column:request_ip;type:varchar(40);not null;comment:openai_request_ip;index:idx_request_ips"`
 	PromptTokenUsage     int             `gorm:"column:prompt_token_usage;type:integer;not null;comment:openai_prompt_token_usage"`
 	CompletionTokenUsage int             `gorm:"column:completion_token_usage;type:integer;not null;comment:openai_completion_token_usage"`
 	BalanceCost          decimal.Decimal `gorm:"column:balance_cost;type:decimal(16,8);not null;comment:openai_balance_cost;index:idx_balance_costs"`
+	Status               string          `gorm:"column:status;type:varchar(16);not null;default:success;comment:openai_request_status;index:idx_statuses"`
 	CreatedAt            time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
 }
 
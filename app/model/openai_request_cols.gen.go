@@ -15,6 +15,7 @@ type openairequestCols struct {
 	PromptTokenUsage     string
 	CompletionTokenUsage string
 	BalanceCost          string
+	Status               string
 	CreatedAt            string
 }
 
@@ -29,5 +30,6 @@ var OpenaiRequestCols = &openairequestCols{
 	PromptTokenUsage:     "prompt_token_usage",
 	CompletionTokenUsage: "completion_token_usage",
 	BalanceCost:          "balance_cost",
+	Status:               "status",
 	CreatedAt:            "created_at",
 }
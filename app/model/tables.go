@@ -5,6 +5,8 @@ const (
 	TableNameOpenaiModels           = "openai_models"
 	TableNameOpenaiRequests         = "openai_requests"
 	TableNameOpenaiClientBalance    = "openai_client_balance"
+	TableNameOpenaiClientWeight     = "openai_client_weight"
+	TableNameOpenaiImagePrices      = "openai_image_prices"
 	TableNameWhisperUsers           = "whisper_users"
 	TableNameWhisperUserPermissions = "whisper_user_permissions"
 	TableNameWhisperUserBalance     = "whisper_user_balance"
@@ -1,6 +1,10 @@
 package model
 
-import "time"
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
 
 type WhisperUserRoleEnum = string
 
@@ -13,14 +17,19 @@ const (
 //
 // Reference: https://docs.alioth.center/akasha-whisper-database.html#whisper-users
 type WhisperUser struct {
-	ID        int64     `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;index:idx_ids"`
-	Email     string    `gorm:"column:email;type:varchar(64);not null;comment:whisper_user_email;uniqueIndex:idx_emails"`
-	ApiKey    string    `gorm:"column:api_key;type:varchar(64);not null;comment:whisper_user_api_key;uniqueIndex:idx_api_keys"`
-	Role      string    `gorm:"column:role;type:varchar(10);not null;comment:whisper_user_role;index:idx_roles"`
-	Language  string    `gorm:"column:language;type:varchar(2);not null;default:en;comment:whisper_user_language"`
-	AllowIps  string    `gorm:"column:allow_ips;type:varchar(128);not null;comment:whisper_user_allow_ips;index:idx_allow_ips"`
-	CreatedAt time.Time `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
-	UpdatedAt time.Time `gorm:"column:updated_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	ID               int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey;index:idx_whisper_users_ids"`
+	Email            string          `gorm:"column:email;type:varchar(64);not null;comment:whisper_user_email;uniqueIndex:idx_emails"`
+	ApiKey           string          `gorm:"column:api_key;type:varchar(64);not null;comment:whisper_user_api_key;uniqueIndex:idx_api_keys"`
+	Role             string          `gorm:"column:role;type:varchar(10);not null;comment:whisper_user_role;index:idx_roles"`
+	Language         string          `gorm:"column:language;type:varchar(2);not null;default:en;comment:whisper_user_language"`
+	AllowIps         string          `gorm:"column:allow_ips;type:varchar(128);not null;comment:whisper_user_allow_ips;index:idx_allow_ips"`
+	Moderated        bool            `gorm:"column:moderated;type:boolean;not null;default:false;comment:whisper_user_moderated"`
+	RpmLimit         int             `gorm:"column:rpm_limit;type:integer;not null;default:-1;comment:whisper_user_rpm_limit"`
+	TpmLimit         int             `gorm:"column:tpm_limit;type:integer;not null;default:-1;comment:whisper_user_tpm_limit"`
+	ConcurrencyLimit int             `gorm:"column:concurrency_limit;type:integer;not null;default:-1;comment:whisper_user_concurrency_limit"`
+	Balance          decimal.Decimal `gorm:"column:balance;type:decimal(16,8);comment:whisper_user_balance"`
+	CreatedAt        time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt        time.Time       `gorm:"column:updated_at;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
 }
 
 func (u WhisperUser) TableName() string {
@@ -21,12 +21,12 @@ const (
 // Reference: https://docs.alioth.center/akasha-whisper-database.html#whisper-user-balance
 type WhisperUserBalance struct {
 	ID                  int64           `gorm:"column:id;type:integer;autoIncrement:true;primaryKey:true"`
-	UserID              int64           `gorm:"column:user_id;type:integer;not null;index:idx_client_id;index:idx_scan"`
+	UserID              int64           `gorm:"column:user_id;type:integer;not null;index:idx_whisper_user_balance_user_id;index:idx_whisper_user_balance_scan"`
 	BalanceChangeAmount decimal.Decimal `gorm:"column:balance_change_amount;type:decimal(16,8);not null;default:0"`
-	BalanceRemaining    decimal.Decimal `gorm:"column:balance_remaining;type:decimal(16,8);not null;default:0;index:idx_balance_remaining"`
-	Action              string          `gorm:"column:action;type:varchar(32);not null;index:idx_action"`
+	BalanceRemaining    decimal.Decimal `gorm:"column:balance_remaining;type:decimal(16,8);not null;default:0;index:idx_whisper_user_balance_balance_remaining"`
+	Action              string          `gorm:"column:action;type:varchar(32);not null;index:idx_whisper_user_balance_action"`
 	Reason              string          `gorm:"column:reason;type:varchar(255);not null;default:''"`
-	CreatedAt           time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP;index:idx_created_at;index:idx_scan"`
+	CreatedAt           time.Time       `gorm:"column:created_at;type:timestamp;not null;default:CURRENT_TIMESTAMP;index:idx_whisper_user_balance_created_at;index:idx_whisper_user_balance_scan"`
 }
 
 func (m WhisperUserBalance) TableName() string {
@@ -5,23 +5,33 @@
 package model
 
 type whisperuserCols struct {
-	ID        string
-	Email     string
-	ApiKey    string
-	Role      string
-	Language  string
-	AllowIps  string
-	CreatedAt string
-	UpdatedAt string
+	ID               string
+	Email            string
+	ApiKey           string
+	Role             string
+	Language         string
+	AllowIps         string
+	Moderated        string
+	RpmLimit         string
+	TpmLimit         string
+	ConcurrencyLimit string
+	Balance          string
+	CreatedAt        string
+	UpdatedAt        string
 }
 
 var WhisperUserCols = &whisperuserCols{
-	ID:        "id",
-	Email:     "email",
-	ApiKey:    "api_key",
-	Role:      "role",
-	Language:  "language",
-	AllowIps:  "allow_ips",
-	CreatedAt: "created_at",
-	UpdatedAt: "updated_at",
+	ID:               "id",
+	Email:            "email",
+	ApiKey:           "api_key",
+	Role:             "role",
+	Language:         "language",
+	AllowIps:         "allow_ips",
+	Moderated:        "moderated",
+	RpmLimit:         "rpm_limit",
+	TpmLimit:         "tpm_limit",
+	ConcurrencyLimit: "concurrency_limit",
+	Balance:          "balance",
+	CreatedAt:        "created_at",
+	UpdatedAt:        "updated_at",
 }
@@ -2,6 +2,7 @@ package router
 
 import (
 	"github.com/alioth-center/akasha-whisper/app/api"
+	"github.com/alioth-center/akasha-whisper/app/entity"
 	"github.com/alioth-center/infrastructure/network/http"
 	"github.com/alioth-center/infrastructure/thirdparty/openai"
 )
@@ -9,30 +10,75 @@ import (
 var compatibleRouter = http.NewRouter("v1")
 
 var OpenAiCompatibleRouterGroup = []http.EndPointInterface{
-	http.NewEndPointBuilder[*openai.CompleteChatRequestBody, *openai.CompleteChatResponseBody]().
-		SetNecessaryHeaders("Authorization").
+	http.NewEndPointBuilder[*entity.ChatCompletionRequest, *entity.ChatResponse]().
 		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatiblePreprocessors[*entity.ChatCompletionRequest, *entity.ChatResponse]()...).
 		SetHandlerChain(api.CompatibleApi.CompleteChat()).
 		SetAllowMethods(http.POST).
+		SetAdditionalHeaders("X-Session-Id").
 		SetRouter(compatibleRouter.Group("/chat/completions")).
 		Build(),
+	http.NewEndPointBuilder[*entity.AnthropicMessageRequest, *entity.AnthropicMessageResponse]().
+		SetCustomRender(true).
+		SetHandlerChain(api.CompatibleApi.Messages()).
+		SetAllowMethods(http.POST).
+		SetAdditionalHeaders("X-Session-Id").
+		SetRouter(compatibleRouter.Group("/messages")).
+		Build(),
+	http.NewEndPointBuilder[*entity.CompletionRequest, *entity.CompletionResponse]().
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatiblePreprocessors[*entity.CompletionRequest, *entity.CompletionResponse]()...).
+		SetHandlerChain(api.CompatibleApi.Completion()).
+		SetAllowMethods(http.POST).
+		SetRouter(compatibleRouter.Group("/completions")).
+		Build(),
 	http.NewEndPointBuilder[*openai.EmbeddingRequestBody, *openai.EmbeddingResponseBody]().
-		SetNecessaryHeaders("Authorization").
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatiblePreprocessors[*openai.EmbeddingRequestBody, *openai.EmbeddingResponseBody]()...).
 		SetHandlerChain(api.CompatibleApi.Embedding()).
 		SetAllowMethods(http.POST).
 		SetRouter(compatibleRouter.Group("/embeddings")).
 		Build(),
+	http.NewEndPointBuilder[*entity.ModerationRequest, *entity.ModerationResponse]().
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatiblePreprocessors[*entity.ModerationRequest, *entity.ModerationResponse]()...).
+		SetHandlerChain(api.CompatibleApi.Moderation()).
+		SetAllowMethods(http.POST).
+		SetRouter(compatibleRouter.Group("/moderations")).
+		Build(),
 	http.NewEndPointBuilder[*openai.ListModelRequest, *openai.ListModelResponseBody]().
-		SetNecessaryHeaders("Authorization").
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatiblePreprocessors[*openai.ListModelRequest, *openai.ListModelResponseBody]()...).
 		SetHandlerChain(api.CompatibleApi.ListModel()).
 		SetAllowMethods(http.GET).
 		SetRouter(compatibleRouter.Group("/models")).
 		Build(),
-	// yet have some problem which cannot return audio file correctly
-	// http.NewEndPointBuilder[*openai.CreateSpeechRequestBody, *openai.CreateSpeechResponseBody]().
-	// 	SetNecessaryHeaders("Authorization").
-	//	SetHandlerChain(api.CompatibleApi.CreateSpeech()).
-	//	SetAllowMethods(http.POST).
-	//	SetRouter(http.NewRouter("/audio/speech")).
-	//	Build(),
+	http.NewEndPointBuilder[*openai.CreateImageRequestBody, *openai.ImageResponseBody]().
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatiblePreprocessors[*openai.CreateImageRequestBody, *openai.ImageResponseBody]()...).
+		SetHandlerChain(api.CompatibleApi.ImageGeneration()).
+		SetAllowMethods(http.POST).
+		SetRouter(compatibleRouter.Group("/images/generations")).
+		Build(),
+	http.NewEndPointBuilder[*openai.CreateSpeechRequestBody, *openai.CreateSpeechResponseBody]().
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatiblePreprocessors[*openai.CreateSpeechRequestBody, *openai.CreateSpeechResponseBody]()...).
+		SetHandlerChain(api.CompatibleApi.CreateSpeech()).
+		SetAllowMethods(http.POST).
+		SetRouter(compatibleRouter.Group("/audio/speech")).
+		Build(),
+	http.NewEndPointBuilder[*entity.AudioRequest, *entity.AudioResponse]().
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatibleApi.AudioPreprocessors()...).
+		SetHandlerChain(api.CompatibleApi.AudioTranscription()).
+		SetAllowMethods(http.POST).
+		SetRouter(compatibleRouter.Group("/audio/transcriptions")).
+		Build(),
+	http.NewEndPointBuilder[*entity.AudioRequest, *entity.AudioResponse]().
+		SetCustomRender(true).
+		SetCustomPreprocessors(api.CompatibleApi.AudioPreprocessors()...).
+		SetHandlerChain(api.CompatibleApi.AudioTranslation()).
+		SetAllowMethods(http.POST).
+		SetRouter(compatibleRouter.Group("/audio/translations")).
+		Build(),
 }
@@ -44,6 +44,15 @@ var ManagementRouterGroup = []http.EndPointInterface{
 		SetGinMiddlewares(api.ManagementApi.PreCheckCookie()...).
 		SetRouter(managementRouter.Group("client/:client_name/balance")).
 		Build(),
+	http.NewEndPointBuilder[*entity.ListClientWeightLogsRequest, *entity.ListClientWeightLogsResponse]().
+		SetNecessaryHeaders(http.HeaderAuthorization).
+		SetNecessaryParams("client_name").
+		SetAdditionalQueries("page", "offset", "start", "end").
+		SetHandlerChain(api.ManagementApi.ListClientWeightLogs()).
+		SetAllowMethods(http.GET).
+		SetGinMiddlewares(api.ManagementApi.PreCheckCookie()...).
+		SetRouter(managementRouter.Group("client/:client_name/weight_logs")).
+		Build(),
 	http.NewEndPointBuilder[*entity.ListClientModelRequest, *entity.ListClientModelResponse]().
 		SetNecessaryHeaders(http.HeaderAuthorization).
 		SetNecessaryParams("client_name").
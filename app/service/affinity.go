@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/utils/values"
+)
+
+// SessionHeader is the request header carrying the session id of the conversation.
+const SessionHeader = "X-Session-Id"
+
+// SessionAffinity remembers the client serving each session, so that follow-up requests of the conversation are
+// routed to the same upstream account and hit its prompt cache, keyed by user, model and session.
+var SessionAffinity = NewAffinityStore()
+
+// requestSessionKey is the context key of the session of the request stored by SetRequestSession.
+type requestSessionKey struct{}
+
+// AffinityStore binds sessions to clients, sessions idle longer than session_affinity_idle are expired.
+type AffinityStore struct {
+	mu       sync.Mutex
+	sweptAt  time.Time
+	sessions map[string]*sessionAffinity
+}
+
+type sessionAffinity struct {
+	clientID int
+	usedAt   time.Time
+}
+
+func NewAffinityStore() *AffinityStore {
+	return &AffinityStore{sweptAt: time.Now(), sessions: map[string]*sessionAffinity{}}
+}
+
+// Get returns the client bound to the session, exist is false if the session is not bound or expired.
+func (s *AffinityStore) Get(key string) (clientID int, exist bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exist := s.sessions[key]
+	if !exist || time.Since(session.usedAt) > s.idle() {
+		return 0, false
+	}
+
+	return session.clientID, true
+}
+
+// Bind binds the session to the client and refreshes its idle time, expired sessions are swept at most once per
+// idle time.
+func (s *AffinityStore) Bind(key string, clientID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.sweptAt) > s.idle() {
+		for sessionKey, session := range s.sessions {
+			if now.Sub(session.usedAt) > s.idle() {
+				delete(s.sessions, sessionKey)
+			}
+		}
+		s.sweptAt = now
+	}
+
+	s.sessions[key] = &sessionAffinity{clientID: clientID, usedAt: now}
+}
+
+func (s *AffinityStore) idle() time.Duration {
+	return time.Duration(global.Config.App.SessionAffinityIdle) * time.Second
+}
+
+// SetRequestSession stores the session of the request to the request context, the session is the X-Session-Id
+// header if present, otherwise the user of the request, otherwise the hash of the prefix of the conversation,
+// such as the system prompt and the first message. Nothing is stored if session affinity is disabled.
+func SetRequestSession[request any, response any](ctx http.Context[request, response], user string, prefix ...[]byte) {
+	if global.Config.App.SessionAffinityIdle <= 0 {
+		return
+	}
+
+	session := ctx.HeaderParams().GetString(SessionHeader)
+	switch {
+	case session != "":
+		session = values.BuildStrings("header:", session)
+	case user != "":
+		session = values.BuildStrings("user:", user)
+	case len(prefix) > 0:
+		hash := sha256.New()
+		for _, part := range prefix {
+			hash.Write(part)
+			hash.Write([]byte{0})
+		}
+		session = values.BuildStrings("prefix:", hex.EncodeToString(hash.Sum(nil)))
+	default:
+		return
+	}
+
+	ctx.SetValue(requestSessionKey{}, session)
+}
+
+// sessionAffinityKey returns the affinity key of the session of the request for the model, sessions of different
+// users never share clients, ok is false if the request has no session.
+func sessionAffinityKey(ctx context.Context, modelName string) (key string, ok bool) {
+	session, _ := ctx.Value(requestSessionKey{}).(string)
+	user, authorized := AuthorizedUser(ctx)
+	if session == "" || !authorized {
+		return "", false
+	}
+
+	return values.BuildStrings(strconv.FormatInt(user.ID, 10), ":", modelName, ":", session), true
+}
+
+// preferSessionClient moves the client bound to the session of the request to the first, the clients must be
+// healthy and affordable already, so the session moves to another client if its client cannot serve.
+func preferSessionClient(ctx context.Context, modelName string, clients []*dto.AvailableClientDTO) []*dto.AvailableClientDTO {
+	key, ok := sessionAffinityKey(ctx, modelName)
+	if !ok {
+		return clients
+	}
+
+	clientID, exist := SessionAffinity.Get(key)
+	if !exist {
+		return clients
+	}
+
+	for i, client := range clients {
+		if client.ClientID != clientID {
+			continue
+		}
+
+		if i > 0 {
+			global.Logger.Info(logger.NewFields(ctx).WithMessage("session affinity").WithData(map[string]any{"model": modelName, "client_id": clientID}))
+		}
+		result := make([]*dto.AvailableClientDTO, 0, len(clients))
+		result = append(result, client)
+		result = append(result, clients[:i]...)
+		return append(result, clients[i+1:]...)
+	}
+
+	return clients
+}
+
+// bindSessionClient binds the session of the request to the client served it.
+func bindSessionClient(ctx context.Context, metadata *dto.AvailableClientDTO) {
+	if key, ok := sessionAffinityKey(ctx, metadata.ModelName); ok {
+		SessionAffinity.Bind(key, metadata.ClientID)
+	}
+}
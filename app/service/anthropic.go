@@ -0,0 +1,452 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	nethttp "net/http"
+	"strings"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+	"github.com/alioth-center/infrastructure/utils/values"
+)
+
+func (srv *CompatibleService) Messages(ctx http.Context[*entity.AnthropicMessageRequest, *entity.AnthropicMessageResponse]) {
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
+	chatRequest := srv.anthropicToChatRequest(request)
+
+	// calculate prompt token
+	inputMessages := make([]string, len(chatRequest.Messages))
+	for i, message := range chatRequest.Messages {
+		inputMessages[i] = (&openai.ChatMessageObject{Content: message.Content}).GetStringContent()
+	}
+	promptToken := CalculatePromptToken(inputMessages...)
+
+	// check rate limits and concurrency of the user
+	release, refund, quotaErr := AcquireUserQuota(ctx, promptToken)
+	if quotaErr != nil {
+		AbortWithAnthropicError(ctx, quotaErr)
+		return
+	}
+	defer release()
+
+	// check inputs with moderation model if the user is moderated
+	flagged, moderateErr := srv.moderationGate(ctx, apiKey, inputMessages, ctx.ExtraParams().GetString(http.RemoteIPKey))
+	if moderateErr != nil {
+		AbortWithAnthropicError(ctx, moderateErr)
+		return
+	}
+	if flagged {
+		AbortWithAnthropicError(ctx, ErrorContentFlagged)
+		return
+	}
+
+	// get available openai clients, follow-up requests of the session prefer the client served it
+	SetRequestSession(ctx, chatRequest.User, srv.chatSessionPrefix(chatRequest.Messages)...)
+	clients, getErr := GetAvailableClients(ctx, apiKey, request.Model, promptToken, model.OpenaiModelTypeChat)
+	if getErr != nil {
+		refund()
+		AbortWithAnthropicError(ctx, getErr)
+		return
+	}
+
+	// hold the estimated cost until the real cost is billed, so concurrent requests cannot overspend the balance
+	clients, reservation, reserveErr := ReserveClients(ctx, clients, promptToken, EstimateCompletionToken(request.MaxTokens, promptToken))
+	if reserveErr != nil {
+		refund()
+		AbortWithAnthropicError(ctx, reserveErr)
+		return
+	}
+	defer reservation.Release()
+
+	// nothing is written to the caller before the upstream accepted the request, so it can be retried, upstream
+	// errors are translated to anthropic format with the same relay rules as openai errors, nothing is billed
+	response, metadata, executeErr := ExecuteWithFailover(ctx, clients, promptToken, func(_ openai.Client, metadata *dto.AvailableClientDTO) (*nethttp.Response, error) {
+		chatRequest.Model = metadata.UpstreamModel()
+		payload, marshalErr := json.Marshal(chatRequest)
+		if marshalErr != nil {
+			return nil, errors.Wrap(marshalErr, "marshal request failed")
+		}
+
+		response, executeErr := ExecuteRawOpenaiRequest(ctx, metadata.ClientID, "chat/completions", bytes.NewReader(payload), http.ContentTypeJson)
+		if executeErr != nil {
+			return nil, executeErr
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, NewUpstreamResponseError(response)
+		}
+
+		return response, nil
+	})
+	if executeErr != nil {
+		AbortWithAnthropicError(ctx, executeErr)
+		return
+	}
+	defer response.Body.Close()
+
+	realPromptToken, realCompletionToken, requestID := promptToken, int64(0), ""
+	if !request.Stream {
+		result := &entity.ChatResponse{}
+		if decodeErr := json.NewDecoder(response.Body).Decode(result); decodeErr != nil {
+			AbortWithAnthropicError(ctx, &UpstreamError{Err: errors.Wrap(decodeErr, "decode chat response failed")})
+			return
+		}
+		if result.Usage != nil {
+			realPromptToken, realCompletionToken = int64(result.Usage.PromptTokens), int64(result.Usage.CompletionTokens)
+		}
+		requestID = result.ID
+
+		responseJson, _ := json.Marshal(srv.chatToAnthropicResponse(metadata.ModelName, result))
+		ctx.CustomRender().Header().Set(http.HeaderContentType, http.ContentTypeJson)
+		ctx.CustomRender().WriteHeaderNow()
+		if _, writeErr := ctx.CustomRender().Write(responseJson); writeErr != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
+		}
+	} else {
+		ctx.CustomRender().Header().Set(http.HeaderContentType, "text/event-stream")
+		ctx.CustomRender().Header().Set("Cache-Control", "no-cache")
+		ctx.CustomRender().Header().Set("Connection", "keep-alive")
+		ctx.CustomRender().WriteHeaderNow()
+
+		realPromptToken, realCompletionToken, requestID = srv.streamChatAsAnthropic(ctx, ctx.CustomRender(), metadata.ModelName, promptToken, response.Body)
+	}
+
+	// consume success, update balances
+	srv.settleTokenUsage(ctx, metadata, ctx.ExtraParams().GetString(http.RemoteIPKey), requestID, promptToken, realPromptToken, realCompletionToken)
+
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+// streamChatAsAnthropic translates openai chat chunks to anthropic message events, returns token usage and request id.
+//
+// events are sent in the order: message_start, (content_block_start, content_block_delta..., content_block_stop)...,
+// message_delta, message_stop, every text or tool call is a content block.
+func (srv *CompatibleService) streamChatAsAnthropic(ctx http.Context[*entity.AnthropicMessageRequest, *entity.AnthropicMessageResponse], writer gin.ResponseWriter, modelName string, promptToken int64, body io.Reader) (realPromptToken, realCompletionToken int64, requestID string) {
+	send := func(event string, data any) {
+		if encodeErr := sse.Encode(writer, sse.Event{Event: event, Data: data}); encodeErr != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("encode response failed").WithData(encodeErr))
+			return
+		}
+		writer.Flush()
+	}
+
+	blockIndex, blockType, stopReason := -1, "", "end_turn"
+	closeBlock := func() {
+		if blockType != "" {
+			send("content_block_stop", map[string]any{"type": "content_block_stop", "index": blockIndex})
+			blockType = ""
+		}
+	}
+	openBlock := func(block map[string]any) {
+		closeBlock()
+		blockIndex, blockType = blockIndex+1, block["type"].(string)
+		send("content_block_start", map[string]any{"type": "content_block_start", "index": blockIndex, "content_block": block})
+	}
+
+	realPromptToken, started := promptToken, false
+	for event := range http.ParseServerSentEventFromBody(body, 4096, 256) {
+		data := strings.TrimSpace(string(event.Data))
+		if data == "" || data == "[DONE]" {
+			continue
+		}
+
+		chunk := &entity.ChatResponse{}
+		if unmarshalErr := json.Unmarshal([]byte(data), chunk); unmarshalErr != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("unmarshal chat chunk failed").WithData(unmarshalErr))
+			continue
+		}
+		if !started {
+			started, requestID = true, chunk.ID
+			send("message_start", map[string]any{"type": "message_start", "message": &entity.AnthropicMessageResponse{
+				ID:      chunk.ID,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   modelName,
+				Content: []entity.AnthropicContentBlock{},
+				Usage:   entity.AnthropicUsage{InputTokens: int(promptToken)},
+			}})
+			send("ping", map[string]any{"type": "ping"})
+		}
+		if chunk.Usage != nil {
+			realPromptToken, realCompletionToken = int64(chunk.Usage.PromptTokens), int64(chunk.Usage.CompletionTokens)
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				stopReason = srv.anthropicStopReason(*choice.FinishReason)
+			}
+			if choice.Delta == nil {
+				continue
+			}
+
+			var text string
+			if json.Unmarshal(choice.Delta.Content, &text) == nil && text != "" {
+				if blockType != "text" {
+					openBlock(map[string]any{"type": "text", "text": ""})
+				}
+				send("content_block_delta", map[string]any{"type": "content_block_delta", "index": blockIndex, "delta": map[string]any{"type": "text_delta", "text": text}})
+			}
+
+			for _, call := range choice.Delta.ToolCalls {
+				if call.ID != "" {
+					// a new tool call begins with its id and name
+					openBlock(map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]any{}})
+				}
+				if call.Function.Arguments != "" && blockType == "tool_use" {
+					send("content_block_delta", map[string]any{"type": "content_block_delta", "index": blockIndex, "delta": map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments}})
+				}
+			}
+		}
+	}
+
+	closeBlock()
+	send("message_delta", map[string]any{"type": "message_delta", "delta": map[string]any{"stop_reason": stopReason, "stop_sequence": nil}, "usage": map[string]any{"output_tokens": realCompletionToken}})
+	send("message_stop", map[string]any{"type": "message_stop"})
+
+	return realPromptToken, realCompletionToken, requestID
+}
+
+// RenderAnthropicError writes the authorization failure as anthropic error body.
+func (srv *CompatibleService) RenderAnthropicError(ctx http.Context[*entity.AnthropicMessageRequest, *entity.AnthropicMessageResponse], status int, _, _, message string) {
+	ctx.SetStatusCode(status)
+	WriteAnthropicError(ctx.CustomRender(), status, message)
+}
+
+// anthropicToChatRequest translates anthropic messages request to openai chat completion request,
+// system prompt becomes the first system message, tool_result blocks become tool messages.
+func (srv *CompatibleService) anthropicToChatRequest(request *entity.AnthropicMessageRequest) *entity.ChatRequest {
+	chatRequest := &entity.ChatRequest{
+		Model:       request.Model,
+		Messages:    make([]entity.ChatMessage, 0, len(request.Messages)+1),
+		MaxTokens:   min(request.MaxTokens, global.Config.App.MaxToken),
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stop:        request.StopSequences,
+		Stream:      request.Stream,
+	}
+	if request.Stream {
+		chatRequest.StreamOptions = json.RawMessage(`{"include_usage": true}`)
+	}
+	if request.Metadata != nil {
+		chatRequest.User = request.Metadata.UserID
+	}
+
+	if system := srv.anthropicText(request.System); system != "" {
+		chatRequest.Messages = append(chatRequest.Messages, entity.ChatMessage{Role: "system", Content: srv.jsonString(system)})
+	}
+	for _, message := range request.Messages {
+		chatRequest.Messages = append(chatRequest.Messages, srv.anthropicToChatMessages(message)...)
+	}
+
+	for _, tool := range request.Tools {
+		chatRequest.Tools = append(chatRequest.Tools, openai.Tools{
+			Type:     "function",
+			Function: openai.ToolFunction{Name: tool.Name, Description: tool.Description, Parameters: tool.InputSchema},
+		})
+	}
+	if request.ToolChoice != nil {
+		switch request.ToolChoice.Type {
+		case "any":
+			chatRequest.ToolChoice = "required"
+		case "tool":
+			chatRequest.ToolChoice = map[string]any{"type": "function", "function": map[string]any{"name": request.ToolChoice.Name}}
+		case "none":
+			chatRequest.ToolChoice = "none"
+		default:
+			chatRequest.ToolChoice = "auto"
+		}
+	}
+
+	return chatRequest
+}
+
+func (srv *CompatibleService) anthropicToChatMessages(message entity.AnthropicMessage) []entity.ChatMessage {
+	var text string
+	if json.Unmarshal(message.Content, &text) == nil {
+		return []entity.ChatMessage{{Role: message.Role, Content: srv.jsonString(text)}}
+	}
+
+	var blocks []entity.AnthropicContentBlock
+	if json.Unmarshal(message.Content, &blocks) != nil {
+		return []entity.ChatMessage{{Role: message.Role, Content: message.Content}}
+	}
+
+	// assistant message carries text and tool calls
+	if message.Role == "assistant" {
+		texts, result := make([]string, 0, len(blocks)), entity.ChatMessage{Role: message.Role}
+		for _, block := range blocks {
+			switch block.Type {
+			case "text":
+				texts = append(texts, block.Text)
+			case "tool_use":
+				arguments := string(block.Input)
+				if arguments == "" {
+					arguments = "{}"
+				}
+				result.ToolCalls = append(result.ToolCalls, entity.ChatToolCall{ID: block.ID, Type: "function", Function: entity.ChatToolCallFunction{Name: block.Name, Arguments: arguments}})
+			}
+		}
+		if len(texts) > 0 {
+			result.Content = srv.jsonString(strings.Join(texts, ""))
+		}
+
+		return []entity.ChatMessage{result}
+	}
+
+	// user message carries text, images and tool results, tool results must follow the tool calls directly
+	results, parts := make([]entity.ChatMessage, 0, 1), make([]map[string]any, 0, len(blocks))
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, map[string]any{"type": "text", "text": block.Text})
+		case "image":
+			if block.Source == nil {
+				continue
+			}
+			url := block.Source.Url
+			if block.Source.Type == "base64" {
+				url = values.BuildStrings("data:", block.Source.MediaType, ";base64,", block.Source.Data)
+			}
+			parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}})
+		case "tool_result":
+			results = append(results, entity.ChatMessage{Role: "tool", ToolCallID: block.ToolUseID, Content: srv.jsonString(srv.anthropicText(block.Content))})
+		}
+	}
+	if len(parts) > 0 {
+		content, _ := json.Marshal(parts)
+		results = append(results, entity.ChatMessage{Role: message.Role, Content: content})
+	}
+
+	return results
+}
+
+// chatToAnthropicResponse translates openai chat completion response to anthropic messages response.
+func (srv *CompatibleService) chatToAnthropicResponse(modelName string, response *entity.ChatResponse) *entity.AnthropicMessageResponse {
+	result := &entity.AnthropicMessageResponse{
+		ID:      response.ID,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   modelName,
+		Content: []entity.AnthropicContentBlock{},
+	}
+	if response.Usage != nil {
+		result.Usage = entity.AnthropicUsage{InputTokens: response.Usage.PromptTokens, OutputTokens: response.Usage.CompletionTokens}
+	}
+	if len(response.Choices) == 0 || response.Choices[0].Message == nil {
+		return result
+	}
+
+	choice := response.Choices[0]
+	var text string
+	if json.Unmarshal(choice.Message.Content, &text) == nil && text != "" {
+		result.Content = append(result.Content, entity.AnthropicContentBlock{Type: "text", Text: text})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		input := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+		result.Content = append(result.Content, entity.AnthropicContentBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+	}
+	if choice.FinishReason != nil {
+		stopReason := srv.anthropicStopReason(*choice.FinishReason)
+		result.StopReason = &stopReason
+	}
+
+	return result
+}
+
+func (srv *CompatibleService) anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicText returns the text of content which can be a string or an array of text blocks.
+func (srv *CompatibleService) anthropicText(content json.RawMessage) string {
+	if len(content) == 0 {
+		return ""
+	}
+
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+
+	var blocks []entity.AnthropicContentBlock
+	if json.Unmarshal(content, &blocks) != nil {
+		return string(content)
+	}
+	texts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+func (srv *CompatibleService) jsonString(text string) json.RawMessage {
+	content, _ := json.Marshal(text)
+	return content
+}
+
+// AbortWithAnthropicError maps the error with the same rules as AbortWithOpenaiError and writes it as anthropic error
+// response, then aborts the chain.
+func AbortWithAnthropicError[request any, response any](ctx http.Context[request, response], err error) {
+	status, body := OpenaiErrorOf(err)
+	if status >= http.StatusInternalServerError {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("serve anthropic request failed").WithData(map[string]any{"status": status, "error": err.Error()}))
+	}
+
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		SetRetryAfter(ctx, rateLimitErr)
+	}
+
+	ctx.SetStatusCode(status)
+	WriteAnthropicError(ctx.CustomRender(), status, body.Error.Message)
+	ctx.Abort()
+}
+
+// WriteAnthropicError writes an anthropic format error to the writer, error type is decided by status code.
+func WriteAnthropicError(writer gin.ResponseWriter, status int, message string) {
+	errorType := "api_error"
+	switch status {
+	case http.StatusBadRequest:
+		errorType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errorType = "authentication_error"
+	case http.StatusPaymentRequired:
+		errorType = "billing_error"
+	case http.StatusForbidden:
+		errorType = "permission_error"
+	case http.StatusNotFound:
+		errorType = "not_found_error"
+	case http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		errorType = "overloaded_error"
+	}
+
+	payload, _ := json.Marshal(&entity.AnthropicErrorResponse{Type: "error", Error: entity.AnthropicError{Type: errorType, Message: message}})
+	writer.Header().Set(http.HeaderContentType, http.ContentTypeJson)
+	writer.WriteHeader(status)
+	_, _ = writer.Write(payload)
+}
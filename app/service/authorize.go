@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/pkg/errors"
+)
+
+// ErrorUnauthorizedRequest is returned when the handler requires the user but the request is not authorized.
+var ErrorUnauthorizedRequest = errors.New("unauthorized request")
+
+// authorizedUserKey is the context key of the whisper user resolved by Authorize.
+type authorizedUserKey struct{}
+
+// AuthorizeErrorRender writes the authorization failure in the error format of the endpoint.
+type AuthorizeErrorRender[request any, response any] func(ctx http.Context[request, response], status int, errorType, code, message string)
+
+// Authorize returns the authentication stage of compatible endpoints. It resolves the whisper user of the api key
+// once, rejects the request if the client ip is not allowed, and stores the user to the request context for the
+// downstream handlers, see AuthorizedUser. Failures are written by render and abort the chain.
+func Authorize[request any, response any](render AuthorizeErrorRender[request, response]) http.Handler[request, response] {
+	return func(ctx http.Context[request, response]) {
+		user, exist, err := GetWhisperUser(ctx, RequestApiKey(ctx))
+		if err != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("check api key available failed").WithData(err))
+			render(ctx, http.StatusInternalServerError, "server_error", "", "internal server error")
+			ctx.Abort()
+			return
+		}
+
+		if !exist {
+			render(ctx, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "incorrect api key provided")
+			ctx.Abort()
+			return
+		}
+
+		// check allow ip
+		if !CheckAllowIP(ctx, ctx.ClientIP(), strings.Split(user.AllowIps, ",")) {
+			render(ctx, http.StatusForbidden, "invalid_request_error", "ip_not_allowed", "request ip is not allowed")
+			ctx.Abort()
+			return
+		}
+
+		ctx.SetValue(authorizedUserKey{}, user)
+	}
+}
+
+// AuthorizedUser returns the whisper user stored by Authorize, ok is false if the request is not authorized.
+func AuthorizedUser(ctx context.Context) (user *model.WhisperUser, ok bool) {
+	user, ok = ctx.Value(authorizedUserKey{}).(*model.WhisperUser)
+	return user, ok && user != nil
+}
+
+// AuthorizedApiKey returns the api key of the user resolved by Authorize, handlers must route and bill with it
+// instead of the request headers, as the headers may carry another key than the authorized one. Empty if the
+// request is not authorized.
+func AuthorizedApiKey(ctx context.Context) string {
+	user, ok := AuthorizedUser(ctx)
+	if !ok {
+		return ""
+	}
+
+	return user.ApiKey
+}
+
+// RequestApiKey returns the api key of the request, x-api-key header is preferred as anthropic sdk sends it,
+// otherwise the bearer token of authorization header.
+func RequestApiKey[request any, response any](ctx http.Context[request, response]) string {
+	if apiKey := ctx.NormalHeaders().ApiKey; apiKey != "" {
+		return apiKey
+	}
+
+	return ctx.NormalHeaders().Authorization
+}
+
+// RenderOpenaiError writes the failure as openai error body, only for endpoints with custom render.
+func RenderOpenaiError[request any, response any](ctx http.Context[request, response], status int, errorType, code, message string) {
+	ctx.SetStatusCode(status)
+	WriteOpenaiError(ctx.CustomRender(), status, errorType, code, message)
+}
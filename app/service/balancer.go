@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/utils/values"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	LoadBalanceWeightedRandom           = "weighted_random"             // pick client randomly with probability proportional to weight
+	LoadBalanceSmoothWeightedRoundRobin = "smooth_weighted_round_robin" // pick client in turn as nginx does, proportional to weight
+	LoadBalancePriority                 = "priority"                    // always pick the client with the highest weight
+)
+
+const (
+	RoutingStrategyCheapest      = "cheapest"        // pick the client with the lowest estimated cost of the request
+	RoutingStrategyLowestLatency = "lowest_latency"  // pick the client with the lowest observed latency, time to first token for streams
+	RoutingStrategyLeastInFlight = "least_in_flight" // pick the client with the fewest requests in flight
+)
+
+// IsValidRoutingStrategy checks the routing strategy of the model is supported, empty strategy means the load_balance
+// of the config, and the load balance algorithms are also accepted as strategies.
+func IsValidRoutingStrategy(strategy string) bool {
+	switch strategy {
+	case "", LoadBalanceWeightedRandom, LoadBalanceSmoothWeightedRoundRobin, LoadBalancePriority,
+		RoutingStrategyCheapest, RoutingStrategyLowestLatency, RoutingStrategyLeastInFlight:
+		return true
+	default:
+		return false
+	}
+}
+
+// smoothWeightedStates stores the current weights of smooth weighted round-robin, keyed by model and endpoint.
+var smoothWeightedStates sync.Map
+
+type smoothWeightedState struct {
+	mu      sync.Mutex
+	current map[int]int64
+}
+
+// SortClientsByStrategy orders the clients with the routing strategy of the model, the first client is selected to
+// serve the request, and the others follow as failover candidates. weights must be calculated already. The strategy
+// is the one set on the model, clients of a model cannot set different ones, the configured load_balance if not set.
+func SortClientsByStrategy(ctx context.Context, group string, promptToken int64, clients []*dto.AvailableClientDTO) []*dto.AvailableClientDTO {
+	// clients with the highest weight come first, used as the fallback order of the other algorithms
+	clients = values.SortArray(clients, func(a, b *dto.AvailableClientDTO) bool { return a.ClientWeight > b.ClientWeight })
+	if len(clients) <= 1 {
+		return clients
+	}
+
+	strategy := global.Config.App.LoadBalance
+	for _, client := range clients {
+		if client.ModelRoutingStrategy != "" {
+			strategy = client.ModelRoutingStrategy
+			break
+		}
+	}
+
+	var reason any
+	switch strategy {
+	case LoadBalancePriority:
+		reason = map[string]any{"weight": clients[0].ClientWeight}
+	case LoadBalanceSmoothWeightedRoundRobin:
+		clients = sortClientsBySmoothWeightedRoundRobin(group, clients)
+		reason = map[string]any{"weight": clients[0].ClientWeight}
+	case RoutingStrategyCheapest:
+		var cost decimal.Decimal
+		clients, cost = sortClientsByEstimatedCost(clients, promptToken)
+		reason = map[string]any{"estimated_cost": cost.String()}
+	case RoutingStrategyLowestLatency:
+		clients = sortClientsByHealth(clients, func(health ClientHealthSnapshot) int64 { return int64(health.Latency) })
+		reason = map[string]any{"latency_ms": ClientHealth.Snapshot(clients[0].ClientID).Latency.Milliseconds()}
+	case RoutingStrategyLeastInFlight:
+		clients = sortClientsByHealth(clients, func(health ClientHealthSnapshot) int64 { return int64(health.InFlight) })
+		reason = map[string]any{"in_flight": ClientHealth.Snapshot(clients[0].ClientID).InFlight}
+	default:
+		clients = sortClientsByWeightedRandom(clients)
+		reason = map[string]any{"weight": clients[0].ClientWeight}
+	}
+
+	global.Logger.Info(logger.NewFields(ctx).WithMessage("routing decision").WithData(map[string]any{"group": group, "strategy": strategy, "client_id": clients[0].ClientID, "candidates": len(clients), "reason": reason}))
+	return clients
+}
+
+// sortClientsByEstimatedCost orders the clients by the estimated cost of the request ascending, clients with the
+// same cost keep the weight order. The completion is estimated as long as the prompt, at least one token, so the
+// completion prices are compared as well. The estimated cost of the first client is returned.
+func sortClientsByEstimatedCost(clients []*dto.AvailableClientDTO, promptToken int64) ([]*dto.AvailableClientDTO, decimal.Decimal) {
+	tokens := decimal.NewFromInt(max(promptToken, 1))
+	costs := make(map[int]decimal.Decimal, len(clients))
+	for _, client := range clients {
+		costs[client.ClientID] = client.ModelPromptPrice.Add(client.ModelCompletionPrice).Mul(tokens).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit))
+	}
+
+	result := make([]*dto.AvailableClientDTO, len(clients))
+	copy(result, clients)
+	sort.SliceStable(result, func(i, j int) bool {
+		if failoverOnly(result[i]) != failoverOnly(result[j]) {
+			return failoverOnly(result[j])
+		}
+
+		return costs[result[i].ClientID].LessThan(costs[result[j].ClientID])
+	})
+	return result, costs[result[0].ClientID]
+}
+
+// sortClientsByHealth orders the clients by the metric of the health ascending, clients with the same metric keep
+// the weight order, clients without traffic have zero metrics and come first, so that they are observed.
+func sortClientsByHealth(clients []*dto.AvailableClientDTO, metric func(health ClientHealthSnapshot) int64) []*dto.AvailableClientDTO {
+	metrics := make(map[int]int64, len(clients))
+	for _, client := range clients {
+		metrics[client.ClientID] = metric(ClientHealth.Snapshot(client.ClientID))
+	}
+
+	result := make([]*dto.AvailableClientDTO, len(clients))
+	copy(result, clients)
+	sort.SliceStable(result, func(i, j int) bool {
+		if failoverOnly(result[i]) != failoverOnly(result[j]) {
+			return failoverOnly(result[j])
+		}
+
+		return metrics[result[i].ClientID] < metrics[result[j].ClientID]
+	})
+	return result
+}
+
+// failoverOnly checks the client has no weight, such clients are only used for failover with every strategy.
+func failoverOnly(client *dto.AvailableClientDTO) bool {
+	return client.ClientWeight <= 0
+}
+
+// sortClientsByWeightedRandom shuffles the clients with weighted random sampling without replacement,
+// each client gets key = random^(1/weight) and the clients are sorted by key descending.
+//
+// Reference: https://en.wikipedia.org/wiki/Reservoir_sampling#Algorithm_A-Res
+func sortClientsByWeightedRandom(clients []*dto.AvailableClientDTO) []*dto.AvailableClientDTO {
+	keys := make(map[int]float64, len(clients))
+	for _, client := range clients {
+		if client.ClientWeight <= 0 {
+			// clients without weight are only used for failover
+			keys[client.ClientID] = -1
+			continue
+		}
+
+		keys[client.ClientID] = math.Pow(rand.Float64(), 1/float64(client.ClientWeight))
+	}
+
+	result := make([]*dto.AvailableClientDTO, len(clients))
+	copy(result, clients)
+	sort.SliceStable(result, func(i, j int) bool { return keys[result[i].ClientID] > keys[result[j].ClientID] })
+	return result
+}
+
+// sortClientsBySmoothWeightedRoundRobin selects a client with smooth weighted round-robin, the selected client
+// is moved to the first, the others keep the weight order.
+//
+// Reference: https://github.com/phusion/nginx/commit/27e94984486058d73157038f7950a0a36ecc6e35
+func sortClientsBySmoothWeightedRoundRobin(group string, clients []*dto.AvailableClientDTO) []*dto.AvailableClientDTO {
+	loaded, _ := smoothWeightedStates.LoadOrStore(group, &smoothWeightedState{current: map[int]int64{}})
+	state := loaded.(*smoothWeightedState)
+
+	state.mu.Lock()
+	selected, total := -1, int64(0)
+	for i, client := range clients {
+		weight := max(client.ClientWeight, 0)
+		state.current[client.ClientID] += weight
+		total += weight
+		if selected < 0 || state.current[client.ClientID] > state.current[clients[selected].ClientID] {
+			selected = i
+		}
+	}
+	state.current[clients[selected].ClientID] -= total
+	state.mu.Unlock()
+
+	result := make([]*dto.AvailableClientDTO, 0, len(clients))
+	result = append(result, clients[selected])
+	result = append(result, clients[:selected]...)
+	return append(result, clients[selected+1:]...)
+}
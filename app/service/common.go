@@ -2,11 +2,18 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	nethttp "net/http"
 	"strings"
 
+	"github.com/gin-gonic/gin"
+
 	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model"
 	"github.com/alioth-center/akasha-whisper/app/model/dto"
 	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/network/http"
 	"github.com/alioth-center/infrastructure/thirdparty/openai"
 	"github.com/alioth-center/infrastructure/utils/network"
 	"github.com/alioth-center/infrastructure/utils/values"
@@ -15,16 +22,16 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-func CheckApiKeyAvailable(ctx context.Context, key string) (exist bool, allowIPs string, err error) {
+func GetWhisperUser(ctx context.Context, key string) (user *model.WhisperUser, exist bool, err error) {
 	token := strings.TrimPrefix(key, "Bearer ")
 
 	// check from bloom filter first
 	if token == "" || !global.BearerTokenBloomFilterInstance.CheckKey(token) {
-		return false, "", nil
+		return nil, false, nil
 	}
 
 	// check from database
-	return global.WhisperUserDatabaseInstance.CheckWhisperUserApiKey(ctx, token)
+	return global.WhisperUserDatabaseInstance.GetWhisperUserByApiKey(ctx, token)
 }
 
 func CheckAllowIP(_ context.Context, ip string, allowIPs []string) bool {
@@ -41,59 +48,384 @@ func CheckAllowIP(_ context.Context, ip string, allowIPs []string) bool {
 	})) > 0
 }
 
-func GetAvailableClient(ctx context.Context, key string, modelName string, promptToken int64, endpoint string) (client openai.Client, metadata *dto.AvailableClientDTO, err error) {
+// GetAvailableClient returns the client serving the request without failover, the first client of GetAvailableClients
+// that has rate limit quota takes it, the next one is selected if the quota is taken by concurrent requests.
+// releaseQuota gives the quota back, it must be called if the upstream fails.
+func GetAvailableClient(ctx context.Context, key string, modelName string, promptToken int64, endpoint string) (client openai.Client, metadata *dto.AvailableClientDTO, releaseQuota func(), err error) {
+	clients, getErr := GetAvailableClients(ctx, key, modelName, promptToken, endpoint)
+	if getErr != nil {
+		return nil, nil, nil, getErr
+	}
+
+	for _, candidate := range clients {
+		release, acquireErr := AcquireClientQuota(candidate, promptToken)
+		if acquireErr != nil {
+			err = earlierRetry(err, acquireErr)
+			continue
+		}
+
+		openaiClient, getClientErr := GetOpenaiClient(ctx, candidate)
+		if getClientErr != nil {
+			release()
+			return nil, nil, nil, getClientErr
+		}
+
+		global.Logger.Info(logger.NewFields(ctx).WithMessage("effective client calculated").WithData(candidate))
+		return openaiClient, candidate, release, nil
+	}
+
+	global.Logger.Warn(logger.NewFields(ctx).WithMessage("all clients rate limited").WithData(map[string]any{"model": modelName, "error": err.Error()}))
+	return nil, nil, nil, err
+}
+
+// GetAvailableClients returns all clients that have enough balance for the model, ordered by the routing strategy
+// of the model, the first client is selected and the others are candidates for failover. clients saturated by
+// the rpm and tpm limits are skipped, a *RateLimitError is returned if all clients are saturated.
+// The rate limit quota is not taken here, it is taken by the client serving the request, see ExecuteWithFailover.
+// ErrorNoAvailableClient is returned if the user has no permission of the model, and ErrorInsufficientBalance
+// is returned if the balances of the user or all clients cannot afford the request, ErrorNoHealthyClient is
+// returned if the circuits of all clients are open.
+//
+// The clients of the fallback models configured for the model are appended in order, so the first fallback model
+// that can serve is selected if the model cannot, and failover walks the chain if the upstreams keep failing.
+// Fallback models without permission of the user are skipped, errors of the model are returned if none can serve.
+func GetAvailableClients(ctx context.Context, key string, modelName string, promptToken int64, endpoint string) (clients []*dto.AvailableClientDTO, err error) {
 	token := strings.TrimPrefix(key, "Bearer ")
 
+	clients, err = getModelClients(ctx, token, modelName, promptToken, endpoint)
+	if err != nil && !errors.Is(err, ErrorInsufficientBalance) && !errors.Is(err, ErrorNoHealthyClient) && !errors.As(err, new(*RateLimitError)) {
+		return nil, err
+	}
+
+	for _, fallback := range global.Config.App.ModelFallbacks[modelName] {
+		fallbackClients, fallbackErr := getModelClients(ctx, token, fallback, promptToken, endpoint)
+		if fallbackErr != nil {
+			global.Logger.Info(logger.NewFields(ctx).WithMessage("fallback model unavailable").WithData(map[string]any{"model": modelName, "fallback": fallback, "error": fallbackErr.Error()}))
+			continue
+		}
+
+		if len(clients) == 0 {
+			global.Logger.Warn(logger.NewFields(ctx).WithMessage("model fallback").WithData(map[string]any{"model": modelName, "fallback": fallback, "reason": err.Error()}))
+		}
+		clients = append(clients, fallbackClients...)
+	}
+
+	if len(clients) == 0 {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// getModelClients returns the clients of the model, see GetAvailableClients, the clients are only checked against
+// the rate limits.
+func getModelClients(ctx context.Context, token string, modelName string, promptToken int64, endpoint string) (clients []*dto.AvailableClientDTO, err error) {
 	clients, queryErr := global.OpenaiClientDatabaseInstance.GetAvailableClients(ctx, modelName, token, endpoint)
 	if queryErr != nil {
 		global.Logger.Info(logger.NewFields(ctx).WithMessage("query available clients failed").WithData(queryErr))
-		return nil, nil, queryErr
+		return nil, queryErr
+	}
+
+	// the user has no permission of the model, or the model does not exist
+	if len(clients) == 0 {
+		return nil, ErrorNoAvailableClient
+	}
+
+	// skip clients with open circuit, they serve requests again after the probe succeeds
+	clients = values.FilterArray(clients, func(client *dto.AvailableClientDTO) bool {
+		return ClientHealth.Available(client.ClientID)
+	})
+	if len(clients) == 0 {
+		return nil, ErrorNoHealthyClient
 	}
 
-	// filter clients, only return clients that have enough balance
-	values.FilterArray(clients, func(client *dto.AvailableClientDTO) bool {
+	// route with the weights tuned from live traffic and balances, manual weights if weight tuning is disabled
+	applyEffectiveWeights(clients)
+
+	// filter clients, only return clients that have enough balance, amounts held by in-flight requests are not spendable
+	clients = values.FilterArray(clients, func(client *dto.AvailableClientDTO) bool {
 		promptPrice := client.ModelPromptPrice.Mul(decimal.NewFromInt(promptToken)).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit))
-		affordable := client.ClientBalance.GreaterThanOrEqual(promptPrice) && client.UserBalance.GreaterThanOrEqual(promptPrice)
+		clientAvailable := client.ClientBalance.Sub(BalanceReservations.ClientReserved(client.ClientID))
+		userAvailable := client.UserBalance.Sub(BalanceReservations.UserReserved(client.UserID))
+
+		return clientAvailable.IsPositive() && userAvailable.IsPositive() && clientAvailable.GreaterThanOrEqual(promptPrice) && userAvailable.GreaterThanOrEqual(promptPrice)
+	})
+
+	// no client can afford the request, return error
+	if len(clients) == 0 {
+		return nil, ErrorInsufficientBalance
+	}
+
+	// order clients with the routing strategy of the model, the first one serves the request
+	clients = SortClientsByStrategy(ctx, values.BuildStrings(endpoint, ":", modelName), promptToken, clients)
+
+	// prefer the client served the session of the request, so the prompt cache of the upstream account is hit
+	clients = preferSessionClient(ctx, modelName, clients)
 
-		if affordable {
-			// update client weight, weight = balance/price * weight
-			client.ClientWeight = client.ClientBalance.Div(client.ModelPromptPrice).Mul(decimal.NewFromInt(client.ClientWeight)).IntPart()
+	// skip clients saturated by the rpm and tpm limits of the model
+	limited := &RateLimitError{Message: values.BuildStrings("rate limit reached for all clients of model ", modelName)}
+	clients = values.FilterArray(clients, func(client *dto.AvailableClientDTO) bool {
+		allowed, retryAfter := ClientModelLimiter.Allow(ClientModelLimitKey(client.ClientID, client.ModelID), client.ModelRpmLimit, client.ModelTpmLimit, promptToken)
+		if !allowed && (limited.RetryAfter == 0 || retryAfter < limited.RetryAfter) {
+			limited.RetryAfter = retryAfter
 		}
 
-		return affordable
+		return allowed
 	})
-
-	// no available client, return error
 	if len(clients) == 0 {
-		return nil, nil, ErrorNoAvailableClient
+		global.Logger.Warn(logger.NewFields(ctx).WithMessage("all clients rate limited").WithData(map[string]any{"model": modelName, "retry_after": limited.RetryAfter.String()}))
+		return nil, limited
 	}
 
-	// sort clients by weight
-	clients = values.SortArray(clients, func(a, b *dto.AvailableClientDTO) bool { return a.ClientWeight > b.ClientWeight })
+	return clients, nil
+}
 
-	// get openai client from cache
-	effectiveClient := clients[0]
-	global.Logger.Info(logger.NewFields(ctx).WithMessage("effective client calculated").WithData(effectiveClient))
-	openaiClient, exist := global.OpenaiClientCacheInstance.Get(effectiveClient.ClientID)
+// GetOpenaiClient returns the openai client of the client from cache, lazy initialized if not cached.
+func GetOpenaiClient(ctx context.Context, metadata *dto.AvailableClientDTO) (client openai.Client, err error) {
+	openaiClient, exist := global.OpenaiClientCacheInstance.Get(metadata.ClientID)
 	if !exist {
-		// lazy initialize openai client
-		secret, querySecretErr := global.OpenaiClientDatabaseInstance.GetClientSecret(ctx, effectiveClient.ClientID)
+		// lazy initialize openai client, non-openai providers are served by provider adapters
+		openaiClientConfig, executor, querySecretErr := GetClientConfig(ctx, metadata.ClientID)
 		if querySecretErr != nil {
-			global.Logger.Error(logger.NewFields(ctx).WithMessage("query client secret failed").WithData(map[string]any{"metadata": effectiveClient, "error": querySecretErr}))
-			return nil, nil, querySecretErr
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("query client secret failed").WithData(map[string]any{"metadata": metadata, "error": querySecretErr}))
+			return nil, querySecretErr
+		}
+
+		openaiClient = openai.NewCustomClient(*openaiClientConfig, executor, global.Logger)
+		global.OpenaiClientCacheInstance.Set(metadata.ClientID, openaiClient)
+		global.Logger.Info(logger.NewFields(ctx).WithMessage("openai client initialized").WithData(map[string]any{"metadata": metadata, "client": openaiClient}))
+	}
+
+	return openaiClient, nil
+}
+
+// ExecuteWithFailover calls the upstream with the clients in order until it succeeds, at most max_retries
+// clients of each model are retried after the first one, so the fallback models are still tried if all the
+// clients of the model fail, and only retryable errors move on to the next client.
+// Each client takes the rate limit quota of promptToken before it is called, and gives it back if it fails, clients
+// without quota are skipped. execute must not write anything to the caller, so that the request can be retried
+// transparently.
+func ExecuteWithFailover[T any](ctx context.Context, clients []*dto.AvailableClientDTO, promptToken int64, execute func(client openai.Client, metadata *dto.AvailableClientDTO) (T, error)) (result T, metadata *dto.AvailableClientDTO, err error) {
+	attempts, limited := map[string]int{}, error(nil)
+	for attempt, candidate := range clients {
+		if attempts[candidate.ModelName] > global.Config.App.MaxRetries {
+			continue
+		}
+
+		// the quota is taken by concurrent requests after the clients are routed
+		releaseQuota, acquireErr := AcquireClientQuota(candidate, promptToken)
+		if acquireErr != nil {
+			limited = earlierRetry(limited, acquireErr)
+			continue
+		}
+
+		// the held balance follows the client serving the request, clients cannot cover it are skipped
+		if moveErr := requestReservation(ctx).MoveTo(candidate); moveErr != nil {
+			releaseQuota()
+			global.Logger.Warn(logger.NewFields(ctx).WithMessage("reserve balance on failover client failed").WithData(map[string]any{"client_id": candidate.ClientID, "model": candidate.ModelName, "error": moveErr.Error()}))
+			if err == nil {
+				err = moveErr
+			}
+			continue
+		}
+		attempts[candidate.ModelName]++
+
+		metadata = candidate
+		client, getClientErr := GetOpenaiClient(ctx, metadata)
+		if getClientErr != nil {
+			releaseQuota()
+			return result, metadata, getClientErr
+		}
+
+		result, err = execute(client, metadata)
+		if err == nil {
+			bindSessionClient(ctx, metadata)
+			return result, metadata, nil
+		}
+		releaseQuota()
+		if upstreamErr := (*UpstreamError)(nil); !errors.As(err, &upstreamErr) {
+			err = &UpstreamError{Err: err}
+		}
+
+		global.Logger.Warn(logger.NewFields(ctx).WithMessage("upstream call failed").WithData(map[string]any{"client_id": metadata.ClientID, "model": metadata.ModelName, "attempt": attempt + 1, "error": err.Error()}))
+		if !IsRetryableUpstreamError(err) {
+			return result, metadata, err
 		}
+	}
+
+	if err == nil && limited != nil {
+		global.Logger.Warn(logger.NewFields(ctx).WithMessage("all clients rate limited").WithData(map[string]any{"error": limited.Error()}))
+		err = limited
+	}
+
+	return result, metadata, err
+}
+
+// earlierRetry returns the rate limit error that can be retried earlier, err is returned if it is not a rate limit.
+func earlierRetry(err, limitErr error) error {
+	if err == nil {
+		return limitErr
+	}
+
+	current, next := (*RateLimitError)(nil), (*RateLimitError)(nil)
+	if errors.As(err, &current) && errors.As(limitErr, &next) && next.RetryAfter < current.RetryAfter {
+		return limitErr
+	}
+
+	return err
+}
+
+// IsRetryableUpstreamError checks the upstream error can be retried with another client, network errors,
+// 429 and 5xx responses are retryable, errors without status code are treated as network errors.
+func IsRetryableUpstreamError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *openai.ResponseStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= http.StatusInternalServerError
+	}
 
-		openaiClientConfig := openai.Config{
-			ApiKey:  secret.ClientKey,
-			BaseUrl: secret.ClientEndpoint,
+	var responseErr *UpstreamResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode == http.StatusTooManyRequests || responseErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	return true
+}
+
+// UpstreamResponseError is the unsuccessful response of raw upstream requests, the body is kept to relay to the caller.
+type UpstreamResponseError struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+func (e *UpstreamResponseError) Error() string {
+	return values.BuildStrings("upstream response status code unexpected: ", values.IntToString(e.StatusCode), ", body: ", string(e.Body))
+}
+
+// NewUpstreamResponseError reads and closes the body of the unsuccessful raw upstream response.
+func NewUpstreamResponseError(response *nethttp.Response) *UpstreamResponseError {
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+
+	return &UpstreamResponseError{StatusCode: response.StatusCode, ContentType: response.Header.Get(http.HeaderContentType), Body: body}
+}
+
+// GetClientConfig returns the api key, endpoint and request executor of the client, query from database if not cached.
+func GetClientConfig(ctx context.Context, clientID int) (config *openai.Config, executor http.Client, err error) {
+	secret, exist := global.OpenaiClientSecretsCacheInstance.Get(clientID)
+	if !exist {
+		querySecret, querySecretErr := global.OpenaiClientDatabaseInstance.GetClientSecret(ctx, clientID)
+		if querySecretErr != nil {
+			return nil, nil, querySecretErr
 		}
-		openaiClient = openai.NewClient(openaiClientConfig, global.Logger)
-		global.OpenaiClientCacheInstance.Set(effectiveClient.ClientID, openaiClient)
-		global.OpenaiClientSecretsCacheInstance.Set(effectiveClient.ClientID, &openaiClientConfig)
-		global.Logger.Info(logger.NewFields(ctx).WithMessage("openai client initialized").WithData(map[string]any{"metadata": effectiveClient, "client": openaiClient}))
+
+		secret = querySecret
+		global.OpenaiClientSecretsCacheInstance.Set(clientID, secret)
 	}
 
-	return openaiClient, effectiveClient, nil
+	config, executor = NewUpstream(secret.ClientProvider, secret.ClientEndpoint, secret.ClientKey)
+	return config, ClientHealth.Wrap(clientID, executor), nil
+}
+
+// ExecuteRawOpenaiRequest sends a POST request to the endpoint of the client without parsing the response,
+// so that the response body can be streamed to the caller, the response body must be closed by the caller.
+func ExecuteRawOpenaiRequest(ctx context.Context, clientID int, path string, body io.Reader, contentType string) (response *nethttp.Response, err error) {
+	config, executor, getConfigErr := GetClientConfig(ctx, clientID)
+	if getConfigErr != nil {
+		return nil, errors.Wrap(getConfigErr, "query client secret failed")
+	}
+
+	baseUrl := config.BaseUrl
+	if baseUrl == "" {
+		baseUrl = defaultOpenaiBaseUrl
+	}
+
+	request, buildErr := http.NewRequestBuilder().
+		WithContext(ctx).
+		WithMethod(http.POST).
+		WithPath(values.BuildStrings(strings.TrimSuffix(baseUrl, "/"), "/", path)).
+		WithBearerToken(config.ApiKey).
+		WithContentType(contentType).
+		WithBody(body).
+		Build()
+	if buildErr != nil {
+		return nil, errors.Wrap(buildErr, "build raw openai request failed")
+	}
+
+	response, executeErr := executor.ExecuteRawRequest(request)
+	if executeErr != nil {
+		return nil, &UpstreamError{Err: executeErr}
+	}
+
+	return response, nil
+}
+
+// RestoreResponseModel replaces the model of the upstream json response with the model name called by the user,
+// the payload is returned as is if the model is not mapped to another upstream name or it is not a json object.
+func RestoreResponseModel(payload []byte, metadata *dto.AvailableClientDTO) []byte {
+	if metadata.UpstreamModel() == metadata.ModelName {
+		return payload
+	}
+
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal(payload, &fields) != nil {
+		return payload
+	}
+	if _, exist := fields["model"]; !exist {
+		return payload
+	}
+
+	fields["model"], _ = json.Marshal(metadata.ModelName)
+	restored, marshalErr := json.Marshal(fields)
+	if marshalErr != nil {
+		return payload
+	}
+
+	return restored
+}
+
+// WriteOpenaiError writes an openai format error to the writer, used by custom render endpoints.
+func WriteOpenaiError(writer gin.ResponseWriter, status int, errorType, code, message string) {
+	_, response := newOpenaiError(status, errorType, code, message)
+	WriteOpenaiErrorResponse(writer, status, response)
+}
+
+// WriteJsonResponse writes the body as json to the writer, used by custom render endpoints.
+func WriteJsonResponse(writer gin.ResponseWriter, status int, body any) error {
+	payload, marshalErr := json.Marshal(body)
+	if marshalErr != nil {
+		return errors.Wrap(marshalErr, "marshal response failed")
+	}
+
+	writer.Header().Set(http.HeaderContentType, http.ContentTypeJson)
+	writer.WriteHeader(status)
+	_, writeErr := writer.Write(payload)
+	return writeErr
+}
+
+// StreamRawResponse copies the body to the writer chunk by chunk, flushing after every chunk.
+func StreamRawResponse(writer gin.ResponseWriter, body io.Reader) (written int64, err error) {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buffer)
+		if n > 0 {
+			wn, writeErr := writer.Write(buffer[:n])
+			written += int64(wn)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			writer.Flush()
+		}
+		if readErr == io.EOF {
+			return written, nil
+		} else if readErr != nil {
+			return written, readErr
+		}
+	}
 }
 
 func CalculatePromptToken(inputs ...string) (promptToken int64) {
@@ -121,4 +453,6 @@ func CheckManagementKeyAvailable(_ context.Context, key string) bool {
 	return true
 }
 
+const defaultOpenaiBaseUrl = "https://api.openai.com/v1"
+
 var ErrorNoAvailableClient = errors.New("no available client")
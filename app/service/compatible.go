@@ -1,13 +1,23 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	nethttp "net/http"
+	"strconv"
 	"strings"
-	"time"
 
+	"github.com/gin-gonic/gin"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
 	"github.com/alioth-center/akasha-whisper/app/global"
 	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
 	"github.com/alioth-center/infrastructure/logger"
 	"github.com/alioth-center/infrastructure/network/http"
 	"github.com/alioth-center/infrastructure/thirdparty/openai"
@@ -22,136 +32,133 @@ type CompatibleService struct{}
 
 func NewCompatibleService() *CompatibleService { return &CompatibleService{} }
 
-func (srv *CompatibleService) ChatComplete(ctx http.Context[*openai.CompleteChatRequestBody, *openai.CompleteChatResponseBody]) {
-	apiKey, request := ctx.NormalHeaders().Authorization, ctx.Request()
+func (srv *CompatibleService) ChatComplete(ctx http.Context[*entity.ChatCompletionRequest, *entity.ChatResponse]) {
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
 
 	// calculate prompt token
 	inputMessages := make([]string, len(request.Messages))
 	for i, message := range request.Messages {
-		inputMessages[i] = message.GetStringContent()
+		inputMessages[i] = chatContentText(message.Content)
 	}
 	promptToken := CalculatePromptToken(inputMessages...)
 
-	// get available openai client
-	client, metadata, getErr := GetAvailableClient(ctx, apiKey, request.Model, promptToken, "chat")
-	if getErr != nil && errors.Is(getErr, ErrorNoAvailableClient) {
-		ctx.SetStatusCode(http.StatusForbidden)
-		ctx.SetResponse(srv.buildErrorChatCompleteResponse(ctx, "no available client"))
-		ctx.Abort()
-		return
-	} else if getErr != nil {
-		global.Logger.Error(logger.NewFields(ctx).WithMessage("get available client failed").WithData(getErr))
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(srv.buildErrorChatCompleteResponse(ctx, values.BuildStrings("internal server error: ", getErr.Error())))
-		ctx.Abort()
-		return
-	}
-
-	realPromptToken, realCompletionToken, requestID := int64(0), int64(0), ""
-	openaiRequest := openai.CompleteChatRequest{
-		Body: openai.CompleteChatRequestBody{
-			Model:            request.Model,
-			Messages:         request.Messages,
-			Temperature:      request.Temperature,
-			TopP:             request.TopP,
-			N:                request.N,
-			Stream:           request.Stream,
-			MaxTokens:        min(request.MaxTokens, global.Config.App.MaxToken),
-			PresencePenalty:  request.PresencePenalty,
-			FrequencyPenalty: request.FrequencyPenalty,
-			User:             request.User,
-			LogitBias:        request.LogitBias,
-			LogProbs:         request.LogProbs,
-			TopLogProbs:      request.TopLogProbs,
-			ResponseFormat:   request.ResponseFormat,
-			Seed:             request.Seed,
-			ServiceTier:      request.ServiceTier,
-			Tools:            request.Tools,
-			ToolChoice:       request.ToolChoice,
-		},
+	// check rate limits and concurrency of the user
+	release, refund, quotaErr := AcquireUserQuota(ctx, promptToken)
+	if quotaErr != nil {
+		AbortWithOpenaiError(ctx, quotaErr)
+		return
 	}
+	defer release()
 
-	if !request.Stream {
-		// complete chat without text stream
-		response, executeErr := client.CompleteChat(ctx, openaiRequest)
-		if executeErr != nil {
-			global.Logger.Error(logger.NewFields(ctx).WithMessage("complete chat failed").WithData(executeErr))
-			ctx.SetStatusCode(http.StatusInternalServerError)
-			ctx.SetResponse(srv.buildErrorChatCompleteResponse(ctx, values.BuildStrings("internal server error: ", executeErr.Error())))
-			ctx.Abort()
-			return
-		}
+	// check inputs with moderation model if the user is moderated
+	flagged, moderateErr := srv.moderationGate(ctx, apiKey, inputMessages, ctx.ExtraParams().GetString(http.RemoteIPKey))
+	if moderateErr != nil {
+		AbortWithOpenaiError(ctx, moderateErr)
+		return
+	}
+	if flagged {
+		AbortWithOpenaiError(ctx, ErrorContentFlagged)
+		return
+	}
 
-		realPromptToken, realCompletionToken, requestID = int64(response.Usage.PromptTokens), int64(response.Usage.CompletionTokens), response.ID
+	// get available openai clients, the next client is used if the upstream fails, follow-up requests of the
+	// session prefer the client served it
+	SetRequestSession(ctx, request.User, srv.chatSessionPrefix(request.Messages)...)
+	clients, getErr := GetAvailableClients(ctx, apiKey, request.Model, promptToken, model.OpenaiModelTypeChat)
+	if getErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, getErr)
+		return
+	}
 
-		// marshal response to json
-		responseJson, marshalErr := json.Marshal(response)
+	// hold the estimated cost until the real cost is billed, so concurrent requests cannot overspend the balance
+	clients, reservation, reserveErr := ReserveClients(ctx, clients, promptToken, EstimateCompletionToken(max(request.MaxTokens, request.MaxCompletionTokens), promptToken))
+	if reserveErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, reserveErr)
+		return
+	}
+	defer reservation.Release()
+
+	// the body of the caller is forwarded as is, except the fields the gateway must control
+	request.MaxTokens = min(request.MaxTokens, global.Config.App.MaxToken)
+	request.MaxCompletionTokens = min(request.MaxCompletionTokens, global.Config.App.MaxToken)
+	if request.Stream {
+		request.StreamOptions = srv.streamOptionsWithUsage(request.StreamOptions)
+	}
+
+	// nothing is written to the caller before the upstream accepted the request, so it can be retried
+	response, metadata, executeErr := ExecuteWithFailover(ctx, clients, promptToken, func(_ openai.Client, metadata *dto.AvailableClientDTO) (*nethttp.Response, error) {
+		request.Model = metadata.UpstreamModel()
+		payload, marshalErr := json.Marshal(request)
 		if marshalErr != nil {
-			global.Logger.Error(logger.NewFields(ctx).WithMessage("marshal response failed").WithData(marshalErr))
-			ctx.SetStatusCode(http.StatusInternalServerError)
-			ctx.SetResponse(srv.buildErrorChatCompleteResponse(ctx, values.BuildStrings("internal server error: ", marshalErr.Error())))
-			ctx.Abort()
-			return
+			return nil, errors.Wrap(marshalErr, "marshal request failed")
 		}
 
-		// set response header
-		ctx.CustomRender().Header().Set("Cache-Control", "no-cache")
-		ctx.CustomRender().Header().Set(http.HeaderContentType, http.ContentTypeJson)
-		ctx.CustomRender().WriteHeaderNow()
+		response, executeErr := ExecuteRawOpenaiRequest(ctx, metadata.ClientID, "chat/completions", bytes.NewReader(payload), http.ContentTypeJson)
+		if executeErr != nil {
+			return nil, executeErr
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, NewUpstreamResponseError(response)
+		}
 
-		// write response
-		_, writeErr := ctx.CustomRender().Write(responseJson)
-		if writeErr != nil {
-			global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
-			ctx.SetStatusCode(http.StatusInternalServerError)
-			ctx.SetResponse(srv.buildErrorChatCompleteResponse(ctx, values.BuildStrings("internal server error: ", writeErr.Error())))
-			ctx.Abort()
+		return response, nil
+	})
+	if executeErr != nil {
+		// nothing is billed if the upstream failed
+		AbortWithOpenaiError(ctx, executeErr)
+		return
+	}
+	defer response.Body.Close()
+
+	realPromptToken, realCompletionToken, requestID := promptToken, int64(0), ""
+	if !request.Stream {
+		// complete chat without text stream, the upstream body is relayed as is, only usage is parsed for billing
+		payload, readErr := io.ReadAll(response.Body)
+		if readErr != nil {
+			AbortWithOpenaiError(ctx, &UpstreamError{Err: errors.Wrap(readErr, "read chat response failed")})
 			return
 		}
-	} else {
-		// complete chat with text stream
-		openaiRequest.Body.StreamOptions = json.RawMessage(`{"include_usage": true}`)
-
-		response, executeErr := client.CompleteStreamingChat(ctx, openaiRequest)
-		if executeErr != nil {
-			global.Logger.Error(logger.NewFields(ctx).WithMessage("complete streaming chat failed").WithData(executeErr))
-			ctx.SetStatusCode(http.StatusInternalServerError)
-			ctx.SetResponse(srv.buildErrorChatCompleteResponse(ctx, values.BuildStrings("internal server error: ", executeErr.Error())))
-			ctx.Abort()
+		result := &entity.ChatResponse{}
+		if decodeErr := json.Unmarshal(payload, result); decodeErr != nil {
+			AbortWithOpenaiError(ctx, &UpstreamError{Err: errors.Wrap(decodeErr, "decode chat response failed")})
 			return
 		}
+		if result.Usage != nil {
+			realPromptToken, realCompletionToken = int64(result.Usage.PromptTokens), int64(result.Usage.CompletionTokens)
+		}
+		requestID = result.ID
 
-		// set response header
-		ctx.CustomRender().Header().Set(http.HeaderContentType, "text/event-stream")
+		// write response, the upstream has charged even if writing failed, so always bill
 		ctx.CustomRender().Header().Set("Cache-Control", "no-cache")
-		ctx.CustomRender().Header().Set("Transfer-Encoding", "chunked")
-		ctx.CustomRender().Header().Set("Connection", "keep-alive")
+		ctx.CustomRender().Header().Set(http.HeaderContentType, http.ContentTypeJson)
 		ctx.CustomRender().WriteHeaderNow()
-
-		// parse streaming response
-		for object := range response {
-			if object.Usage != nil {
-				realPromptToken, realCompletionToken, requestID = int64(object.Usage.PromptTokens), int64(object.Usage.CompletionTokens), object.Id
-			}
-
-			encodeErr := sse.Encode(ctx.CustomRender(), sse.Event{Data: object})
-			if encodeErr != nil {
-				global.Logger.Error(logger.NewFields(ctx).WithMessage("encode response failed").WithData(encodeErr))
-				continue
-			}
-
-			ctx.CustomRender().Flush()
+		if _, writeErr := ctx.CustomRender().Write(RestoreResponseModel(payload, metadata)); writeErr != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
 		}
-
-		// send done message
-		encodeErr := sse.Encode(ctx.CustomRender(), sse.Event{Data: "[DONE]"})
-		if encodeErr != nil {
-			global.Logger.Error(logger.NewFields(ctx).WithMessage("encode response failed").WithData(encodeErr))
+	} else {
+		// complete chat with text stream, chunks are relayed as is
+		usage, usageRequestID := srv.relayEventStream(ctx, ctx.CustomRender(), response.Body, metadata)
+		if usage != nil {
+			realPromptToken, realCompletionToken, requestID = int64(usage.PromptTokens), int64(usage.CompletionTokens), usageRequestID
 		}
-		ctx.CustomRender().Flush()
 	}
 
 	// consume success, update balances
+	srv.settleTokenUsage(ctx, metadata, ctx.ExtraParams().GetString(http.RemoteIPKey), requestID, promptToken, realPromptToken, realCompletionToken)
+
+	// return openai response
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+// settleTokenUsage bills the real token usage of the served request to the client and the user and records the
+// request, the estimated prompt tokens are billed if the upstream does not report the usage. Tokens beyond the
+// estimated prompt tokens are counted into the tpm windows of the client and the user, which only took the estimate.
+func (srv *CompatibleService) settleTokenUsage(ctx context.Context, metadata *dto.AvailableClientDTO, requestIP, requestID string, promptToken, realPromptToken, realCompletionToken int64) {
+	ClientModelLimiter.AddTokens(ClientModelLimitKey(metadata.ClientID, metadata.ModelID), realPromptToken+realCompletionToken-promptToken)
+	UserLimiter.AddTokens(strconv.Itoa(metadata.UserID), realPromptToken+realCompletionToken-promptToken)
+
 	promptCostAmount := metadata.ModelPromptPrice.Mul(decimal.NewFromInt(realPromptToken)).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit))
 	completionCostAmount := metadata.ModelCompletionPrice.Mul(decimal.NewFromInt(realCompletionToken)).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit))
 	balanceCost := promptCostAmount.Add(completionCostAmount).Mul(decimal.NewFromInt(-1))
@@ -163,7 +170,7 @@ func (srv *CompatibleService) ChatComplete(ctx http.Context[*openai.CompleteChat
 		ClientID:             int64(metadata.ClientID),
 		ModelID:              int64(metadata.ModelID),
 		UserID:               int64(metadata.UserID),
-		RequestIP:            ctx.ExtraParams().GetString(http.RemoteIPKey),
+		RequestIP:            requestIP,
 		RequestID:            requestID,
 		TraceID:              trace.GetTid(ctx),
 		PromptTokenUsage:     int(realPromptToken),
@@ -175,20 +182,91 @@ func (srv *CompatibleService) ChatComplete(ctx http.Context[*openai.CompleteChat
 			global.Logger.Error(logger.NewFields(ctx).WithMessage("update response result failed").WithData(err))
 		}
 	}
+}
 
-	// return openai response
-	ctx.SetStatusCode(http.StatusOK)
+// chatSessionPrefix returns the messages until the first user message, which are the same in every turn of the
+// conversation, so the hash identifies the session if the caller does not.
+func (srv *CompatibleService) chatSessionPrefix(messages []entity.ChatMessage) [][]byte {
+	prefix := make([][]byte, 0, 2)
+	for _, message := range messages {
+		prefix = append(prefix, []byte(message.Role), message.Content)
+		if message.Role == "user" {
+			break
+		}
+	}
+
+	return prefix
+}
+
+// relayEventStream relays the data events of the upstream stream to the caller as is, except the model is restored
+// to the model name called by the user, and sends the done event after the upstream ends. usage and requestID are
+// of the last chunk reporting the usage, usage is nil if the upstream does not report it.
+func (srv *CompatibleService) relayEventStream(ctx context.Context, writer gin.ResponseWriter, body io.Reader, metadata *dto.AvailableClientDTO) (usage *openai.UsageObject, requestID string) {
+	writer.Header().Set(http.HeaderContentType, "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Transfer-Encoding", "chunked")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeaderNow()
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, isData := strings.CutPrefix(scanner.Text(), "data:")
+		data = strings.TrimSpace(data)
+		if !isData || data == "" || data == "[DONE]" {
+			continue
+		}
+
+		// chat and text completion chunks share the id and usage fields
+		chunk := &struct {
+			ID    string              `json:"id"`
+			Usage *openai.UsageObject `json:"usage"`
+		}{}
+		if json.Unmarshal([]byte(data), chunk) == nil && chunk.Usage != nil {
+			usage, requestID = chunk.Usage, chunk.ID
+		}
+
+		encodeErr := sse.Encode(writer, sse.Event{Data: json.RawMessage(RestoreResponseModel([]byte(data), metadata))})
+		if encodeErr != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("encode response failed").WithData(encodeErr))
+			continue
+		}
+
+		writer.Flush()
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("read streaming response failed").WithData(scanErr))
+	}
+
+	// send done message
+	encodeErr := sse.Encode(writer, sse.Event{Data: "[DONE]"})
+	if encodeErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("encode response failed").WithData(encodeErr))
+	}
+	writer.Flush()
+
+	return usage, requestID
+}
+
+// streamOptionsWithUsage sets include_usage of the stream options, other options of the caller are kept, the usage
+// chunk is required to bill streaming requests.
+func (srv *CompatibleService) streamOptionsWithUsage(streamOptions json.RawMessage) json.RawMessage {
+	options := map[string]json.RawMessage{}
+	if len(streamOptions) > 0 {
+		_ = json.Unmarshal(streamOptions, &options)
+	}
+	options["include_usage"] = json.RawMessage("true")
+
+	payload, _ := json.Marshal(options)
+	return payload
 }
 
 func (srv *CompatibleService) ListModel(ctx http.Context[*openai.ListModelRequest, *openai.ListModelResponseBody]) {
-	apiKey := strings.TrimPrefix(ctx.NormalHeaders().Authorization, "Bearer ")
+	apiKey := AuthorizedApiKey(ctx)
 
 	models, queryErr := global.OpenaiModelDatabaseInstance.GetAvailableModelsByApiKey(ctx, apiKey)
 	if queryErr != nil {
-		global.Logger.Error(logger.NewFields(ctx).WithMessage("query available models failed").WithData(queryErr))
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.ListModelResponseBody{})
-		ctx.Abort()
+		AbortWithOpenaiError(ctx, errors.Wrap(queryErr, "query available models failed"))
 		return
 	}
 
@@ -203,62 +281,49 @@ func (srv *CompatibleService) ListModel(ctx http.Context[*openai.ListModelReques
 	}
 
 	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetResponse(response)
+	if writeErr := WriteJsonResponse(ctx.CustomRender(), http.StatusOK, response); writeErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
+	}
 }
 
-func (srv *CompatibleService) EmbeddingAuthorize(ctx http.Context[*openai.EmbeddingRequestBody, *openai.EmbeddingResponseBody]) {
-	// check api key available
-	exist, allowIPs, err := CheckApiKeyAvailable(ctx, ctx.NormalHeaders().Authorization)
-	if err != nil {
-		global.Logger.Error(logger.NewFields(ctx).WithMessage("check api key available failed").WithData(err))
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.EmbeddingResponseBody{})
-		ctx.Abort()
-		return
-	}
+func (srv *CompatibleService) Embedding(ctx http.Context[*openai.EmbeddingRequestBody, *openai.EmbeddingResponseBody]) {
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
 
-	if !exist {
-		ctx.SetStatusCode(http.StatusUnauthorized)
-		ctx.SetResponse(&openai.EmbeddingResponseBody{})
-		ctx.Abort()
+	// check rate limits and concurrency of the user
+	release, refund, quotaErr := AcquireUserQuota(ctx, 0)
+	if quotaErr != nil {
+		AbortWithOpenaiError(ctx, quotaErr)
 		return
 	}
+	defer release()
 
-	// check allow ip
-	if !CheckAllowIP(ctx, ctx.ClientIP(), strings.Split(allowIPs, ",")) {
-		ctx.SetStatusCode(http.StatusForbidden)
-		ctx.SetResponse(&openai.EmbeddingResponseBody{})
-		ctx.Abort()
+	// get available openai clients, the next client is used if the upstream fails
+	clients, getErr := GetAvailableClients(ctx, apiKey, request.Model, 0, model.OpenaiModelTypeEmbedding)
+	if getErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, getErr)
+		return
 	}
-}
 
-func (srv *CompatibleService) Embedding(ctx http.Context[*openai.EmbeddingRequestBody, *openai.EmbeddingResponseBody]) {
-	apiKey, request := ctx.NormalHeaders().Authorization, ctx.Request()
-
-	// get available openai client
-	client, metadata, getErr := GetAvailableClient(ctx, apiKey, request.Model, 0, "embedding")
-	if getErr != nil && errors.Is(getErr, ErrorNoAvailableClient) {
-		ctx.SetStatusCode(http.StatusForbidden)
-		ctx.SetResponse(&openai.EmbeddingResponseBody{})
-		ctx.Abort()
-		return
-	} else if getErr != nil {
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.EmbeddingResponseBody{})
-		ctx.Abort()
+	// hold the cost until it is billed, embedding is billed as one prompt token
+	clients, reservation, reserveErr := ReserveClients(ctx, clients, 1, 0)
+	if reserveErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, reserveErr)
 		return
 	}
+	defer reservation.Release()
 
-	response, executeErr := client.Embedding(ctx, openai.EmbeddingRequest{
-		Body: openai.EmbeddingRequestBody{
-			Input: request.Input,
-			Model: request.Model,
-		},
+	response, metadata, executeErr := ExecuteWithFailover(ctx, clients, 0, func(client openai.Client, metadata *dto.AvailableClientDTO) (openai.EmbeddingResponseBody, error) {
+		return client.Embedding(ctx, openai.EmbeddingRequest{
+			Body: openai.EmbeddingRequestBody{
+				Input: request.Input,
+				Model: metadata.UpstreamModel(),
+			},
+		})
 	})
 	if executeErr != nil {
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.EmbeddingResponseBody{})
-		ctx.Abort()
+		AbortWithOpenaiError(ctx, executeErr)
 		return
 	}
 
@@ -285,71 +350,84 @@ func (srv *CompatibleService) Embedding(ctx http.Context[*openai.EmbeddingReques
 		}
 	}
 
+	// the model name called by the user is responded
+	response.Model = metadata.ModelName
 	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetResponse(&response)
-}
-
-func (srv *CompatibleService) CreateSpeechAuthorize(ctx http.Context[*openai.CreateSpeechRequestBody, *openai.CreateSpeechResponseBody]) {
-	// check api key available
-	exist, allowIPs, err := CheckApiKeyAvailable(ctx, ctx.NormalHeaders().Authorization)
-	if err != nil {
-		global.Logger.Error(logger.NewFields(ctx).WithMessage("check api key available failed").WithData(err))
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.CreateSpeechResponseBody{})
-		ctx.Abort()
-		return
-	}
-
-	if !exist {
-		ctx.SetStatusCode(http.StatusUnauthorized)
-		ctx.SetResponse(&openai.CreateSpeechResponseBody{})
-		ctx.Abort()
-		return
-	}
-
-	// check allow ip
-	if !CheckAllowIP(ctx, ctx.ClientIP(), strings.Split(allowIPs, ",")) {
-		ctx.SetStatusCode(http.StatusForbidden)
-		ctx.SetResponse(&openai.CreateSpeechResponseBody{})
-		ctx.Abort()
+	if writeErr := WriteJsonResponse(ctx.CustomRender(), http.StatusOK, &response); writeErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
 	}
 }
 
 func (srv *CompatibleService) CreateSpeech(ctx http.Context[*openai.CreateSpeechRequestBody, *openai.CreateSpeechResponseBody]) {
-	apiKey, request := ctx.NormalHeaders().Authorization, ctx.Request()
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
 
-	// calculate prompt token
+	// calculate prompt token, speech is billed by input characters
 	promptToken := int64(len([]rune(request.Input)))
 
-	// get available openai client
-	client, metadata, getErr := GetAvailableClient(ctx, apiKey, request.Model, promptToken, "speech")
-	if getErr != nil && errors.Is(getErr, ErrorNoAvailableClient) {
-		ctx.SetStatusCode(http.StatusForbidden)
-		ctx.SetResponse(&openai.CreateSpeechResponseBody{})
-		ctx.Abort()
+	// check rate limits and concurrency of the user
+	release, refund, quotaErr := AcquireUserQuota(ctx, promptToken)
+	if quotaErr != nil {
+		AbortWithOpenaiError(ctx, quotaErr)
 		return
-	} else if getErr != nil {
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.CreateSpeechResponseBody{})
-		ctx.Abort()
+	}
+	defer release()
+
+	// get available openai clients, the audio is streamed with raw request, so only metadata is used
+	clients, getErr := GetAvailableClients(ctx, apiKey, request.Model, promptToken, model.OpenaiModelTypeSpeech)
+	if getErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, getErr)
+		return
+	}
+
+	// hold the estimated cost until the real cost is billed, so concurrent requests cannot overspend the balance
+	clients, reservation, reserveErr := ReserveClients(ctx, clients, promptToken, 0)
+	if reserveErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, reserveErr)
 		return
 	}
+	defer reservation.Release()
 
-	response, executeErr := client.CreateSpeech(ctx, openai.CreateSpeechRequest{
-		Body: openai.CreateSpeechRequestBody{
-			Model:          request.Model,
+	response, metadata, executeErr := ExecuteWithFailover(ctx, clients, promptToken, func(_ openai.Client, metadata *dto.AvailableClientDTO) (*nethttp.Response, error) {
+		payload, marshalErr := json.Marshal(&openai.CreateSpeechRequestBody{
+			Model:          metadata.UpstreamModel(),
 			Input:          request.Input,
 			Voice:          request.Voice,
 			ResponseFormat: request.ResponseFormat,
 			Speed:          request.Speed,
-		},
+		})
+		if marshalErr != nil {
+			return nil, errors.Wrap(marshalErr, "marshal request failed")
+		}
+
+		response, executeErr := ExecuteRawOpenaiRequest(ctx, metadata.ClientID, "audio/speech", bytes.NewReader(payload), http.ContentTypeJson)
+		if executeErr != nil {
+			return nil, executeErr
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, NewUpstreamResponseError(response)
+		}
+
+		return response, nil
 	})
 	if executeErr != nil {
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.CreateSpeechResponseBody{})
-		ctx.Abort()
+		// nothing is billed if the upstream failed
+		AbortWithOpenaiError(ctx, executeErr)
 		return
 	}
+	defer response.Body.Close()
+
+	// set response file header
+	ctx.CustomRender().Header().Set(http.HeaderContentType, srv.speechContentType(request.ResponseFormat))
+	ctx.CustomRender().Header().Set("Cache-Control", "no-cache")
+	ctx.CustomRender().Header().Set("Transfer-Encoding", "chunked")
+	ctx.CustomRender().WriteHeaderNow()
+
+	// stream audio bytes to caller, upstream has charged even if the caller disconnected, so always bill
+	if _, streamErr := StreamRawResponse(ctx.CustomRender(), response.Body); streamErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("stream speech response failed").WithData(streamErr))
+	}
 
 	// consume success, update balances
 	promptCostAmount := metadata.ModelPromptPrice.Mul(decimal.NewFromInt(promptToken).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit)))
@@ -373,55 +451,651 @@ func (srv *CompatibleService) CreateSpeech(ctx http.Context[*openai.CreateSpeech
 		}
 	}
 
-	// set response file header
-	switch request.ResponseFormat {
-	case "opus":
-		ctx.SetResponseHeader(http.HeaderContentType, "audio/ogg")
-	case "aac":
-		ctx.SetResponseHeader(http.HeaderContentType, "audio/aac")
-	case "flac":
-		ctx.SetResponseHeader(http.HeaderContentType, "audio/flac")
-	case "pcm":
-		ctx.SetResponseHeader(http.HeaderContentType, "audio/L16")
-	default:
-		ctx.SetResponseHeader(http.HeaderContentType, "audio/mpeg")
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+func (srv *CompatibleService) ImageGeneration(ctx http.Context[*openai.CreateImageRequestBody, *openai.ImageResponseBody]) {
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
+
+	// fill default values as openai does
+	if request.N <= 0 {
+		request.N = 1
+	}
+	if request.Size == "" {
+		request.Size = "1024x1024"
+	}
+	if request.Quality == "" {
+		request.Quality = "standard"
+	}
+
+	// check rate limits and concurrency of the user
+	release, refund, quotaErr := AcquireUserQuota(ctx, 0)
+	if quotaErr != nil {
+		AbortWithOpenaiError(ctx, quotaErr)
+		return
+	}
+	defer release()
+
+	// get available openai clients, the next client is used if the upstream fails
+	clients, getErr := GetAvailableClients(ctx, apiKey, request.Model, 0, model.OpenaiModelTypeImage)
+	if getErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, getErr)
+		return
+	}
+
+	// image is billed per generated image with the price of the size, clients without the price cannot serve it
+	clients, prices, priceErr := srv.imagePricedClients(ctx, clients, request.Size, request.Quality)
+	if priceErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, priceErr)
+		return
+	}
+
+	// hold the cost of all images before generating, images are expensive
+	clients, reservation, reserveErr := ReserveClientsAmount(ctx, clients, func(metadata *dto.AvailableClientDTO) decimal.Decimal {
+		return prices[metadata.ModelID].Mul(decimal.NewFromInt(int64(request.N)))
+	})
+	if reserveErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, reserveErr)
+		return
+	}
+	defer reservation.Release()
+
+	response, metadata, executeErr := ExecuteWithFailover(ctx, clients, 0, func(client openai.Client, metadata *dto.AvailableClientDTO) (openai.ImageResponseBody, error) {
+		return client.GenerateImage(ctx, openai.CreateImageRequest{
+			Body: openai.CreateImageRequestBody{
+				Prompt:         request.Prompt,
+				Model:          metadata.UpstreamModel(),
+				N:              request.N,
+				Size:           request.Size,
+				Quality:        request.Quality,
+				Style:          request.Style,
+				ResponseFormat: request.ResponseFormat,
+				User:           request.User,
+			},
+		})
+	})
+	if executeErr != nil {
+		// nothing is billed if the upstream failed
+		AbortWithOpenaiError(ctx, executeErr)
+		return
+	}
+
+	// consume success, update balances, only generated images are billed
+	generated := int64(len(response.Data))
+	balanceCost := prices[metadata.ModelID].Mul(decimal.NewFromInt(generated)).Mul(decimal.NewFromInt(-1))
+	_, updateClientBalanceErr := global.OpenaiClientBalanceDatabaseInstance.CreateBalanceRecord(ctx, metadata.ClientID, balanceCost, model.OpenaiClientBalanceActionConsumption)
+	_, updateUserBalanceErr := global.WhisperUserBalanceDatabaseInstance.CreateBalanceRecord(ctx, metadata.UserID, balanceCost, model.WhisperUserBalanceActionConsumption)
+	updateRequestErr := global.OpenaiRequestDatabaseInstance.CreateOpenaiRequestRecord(ctx, &model.OpenaiRequest{
+		ClientID:             int64(metadata.ClientID),
+		ModelID:              int64(metadata.ModelID),
+		UserID:               int64(metadata.UserID),
+		RequestIP:            ctx.ExtraParams().GetString(http.RemoteIPKey),
+		RequestID:            trace.GetTid(ctx),
+		TraceID:              trace.GetTid(ctx),
+		PromptTokenUsage:     int(generated),
+		CompletionTokenUsage: 0,
+		BalanceCost:          balanceCost.Abs(),
+	})
+	for _, err := range []error{updateClientBalanceErr, updateUserBalanceErr, updateRequestErr} {
+		if err != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("update response result failed").WithData(err))
+		}
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	if writeErr := WriteJsonResponse(ctx.CustomRender(), http.StatusOK, &response); writeErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
+	}
+}
+
+// imagePricedClients returns the clients of the models that have the price of the image size and quality, keyed by
+// model id, ErrorImagePriceNotConfigured is returned if none has, the prompt price is never used for images as it is
+// the price of tokens.
+func (srv *CompatibleService) imagePricedClients(ctx context.Context, clients []*dto.AvailableClientDTO, size, quality string) (priced []*dto.AvailableClientDTO, prices map[int]decimal.Decimal, err error) {
+	priced, prices = make([]*dto.AvailableClientDTO, 0, len(clients)), make(map[int]decimal.Decimal, len(clients))
+	for _, client := range clients {
+		price, found, queryErr := global.OpenaiImagePriceDatabaseInstance.GetImagePrice(ctx, client.ModelID, size, quality)
+		if queryErr != nil {
+			return nil, nil, errors.Wrap(queryErr, "query image price failed")
+		}
+		if !found {
+			global.Logger.Warn(logger.NewFields(ctx).WithMessage("image price not configured").WithData(map[string]any{"client_id": client.ClientID, "model": client.ModelName, "size": size, "quality": quality}))
+			continue
+		}
+
+		priced, prices[client.ModelID] = append(priced, client), price
+	}
+	if len(priced) == 0 {
+		return nil, nil, ErrorImagePriceNotConfigured
+	}
+
+	return priced, prices, nil
+}
+
+func (srv *CompatibleService) Completion(ctx http.Context[*entity.CompletionRequest, *entity.CompletionResponse]) {
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
+
+	// calculate prompt token
+	promptToken := CalculatePromptToken(srv.completionPrompts(request.Prompt)...)
+
+	// check rate limits and concurrency of the user
+	release, refund, quotaErr := AcquireUserQuota(ctx, promptToken)
+	if quotaErr != nil {
+		AbortWithOpenaiError(ctx, quotaErr)
+		return
+	}
+	defer release()
+
+	// get available openai clients
+	clients, getErr := GetAvailableClients(ctx, apiKey, request.Model, promptToken, model.OpenaiModelTypeCompletion)
+	if getErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, getErr)
+		return
+	}
+
+	// hold the estimated cost until the real cost is billed, so concurrent requests cannot overspend the balance
+	clients, reservation, reserveErr := ReserveClients(ctx, clients, promptToken, EstimateCompletionToken(request.MaxTokens, promptToken))
+	if reserveErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, reserveErr)
+		return
+	}
+	defer reservation.Release()
+
+	request.MaxTokens = min(request.MaxTokens, global.Config.App.MaxToken)
+	if request.Stream {
+		request.StreamOptions = srv.streamOptionsWithUsage(request.StreamOptions)
+	}
+
+	// nothing is written to the caller before the upstream accepted the request, so it can be retried
+	response, metadata, executeErr := ExecuteWithFailover(ctx, clients, promptToken, func(_ openai.Client, metadata *dto.AvailableClientDTO) (*nethttp.Response, error) {
+		request.Model = metadata.UpstreamModel()
+		payload, marshalErr := json.Marshal(request)
+		if marshalErr != nil {
+			return nil, errors.Wrap(marshalErr, "marshal request failed")
+		}
+
+		response, executeErr := ExecuteRawOpenaiRequest(ctx, metadata.ClientID, "completions", bytes.NewReader(payload), http.ContentTypeJson)
+		if executeErr != nil {
+			return nil, executeErr
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, NewUpstreamResponseError(response)
+		}
+
+		return response, nil
+	})
+	if executeErr != nil {
+		// nothing is billed if the upstream failed
+		AbortWithOpenaiError(ctx, executeErr)
+		return
 	}
+	defer response.Body.Close()
+
+	realPromptToken, realCompletionToken, requestID := promptToken, int64(0), ""
+	if !request.Stream {
+		// complete text without text stream, the upstream body is relayed as is, only usage is parsed for billing
+		payload, readErr := io.ReadAll(response.Body)
+		if readErr != nil {
+			AbortWithOpenaiError(ctx, &UpstreamError{Err: errors.Wrap(readErr, "read completion response failed")})
+			return
+		}
+		result := &entity.CompletionResponse{}
+		if decodeErr := json.Unmarshal(payload, result); decodeErr != nil {
+			AbortWithOpenaiError(ctx, &UpstreamError{Err: errors.Wrap(decodeErr, "decode completion response failed")})
+			return
+		}
+		if result.Usage != nil {
+			realPromptToken, realCompletionToken = int64(result.Usage.PromptTokens), int64(result.Usage.CompletionTokens)
+		}
+		requestID = result.ID
+
+		// write response, the upstream has charged even if writing failed, so always bill
+		ctx.CustomRender().Header().Set("Cache-Control", "no-cache")
+		ctx.CustomRender().Header().Set(http.HeaderContentType, http.ContentTypeJson)
+		ctx.CustomRender().WriteHeaderNow()
+		if _, writeErr := ctx.CustomRender().Write(RestoreResponseModel(payload, metadata)); writeErr != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
+		}
+	} else {
+		// complete text with text stream, chunks are relayed as is
+		usage, usageRequestID := srv.relayEventStream(ctx, ctx.CustomRender(), response.Body, metadata)
+		if usage != nil {
+			realPromptToken, realCompletionToken, requestID = int64(usage.PromptTokens), int64(usage.CompletionTokens), usageRequestID
+		}
+	}
+
+	// consume success, update balances
+	srv.settleTokenUsage(ctx, metadata, ctx.ExtraParams().GetString(http.RemoteIPKey), requestID, promptToken, realPromptToken, realCompletionToken)
+
 	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetResponse(&response)
 }
 
-func (srv *CompatibleService) ListModelAuthorize(ctx http.Context[*openai.ListModelRequest, *openai.ListModelResponseBody]) {
-	// check api key available
-	exist, allowIPs, err := CheckApiKeyAvailable(ctx, ctx.NormalHeaders().Authorization)
-	if err != nil {
-		global.Logger.Error(logger.NewFields(ctx).WithMessage("check api key available failed").WithData(err))
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		ctx.SetResponse(&openai.ListModelResponseBody{})
-		ctx.Abort()
+// completionPrompts extracts text prompts for token calculation, prompt can be a string or an array of strings,
+// token array prompts are counted by its raw length
+func (srv *CompatibleService) completionPrompts(prompt json.RawMessage) []string {
+	var single string
+	if json.Unmarshal(prompt, &single) == nil {
+		return []string{single}
+	}
+
+	var multiple []string
+	if json.Unmarshal(prompt, &multiple) == nil {
+		return multiple
+	}
+
+	return []string{string(prompt)}
+}
+
+func (srv *CompatibleService) Moderation(ctx http.Context[*entity.ModerationRequest, *entity.ModerationResponse]) {
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
+	if request.Model == "" {
+		request.Model = global.Config.App.ModerationModel
+	}
+
+	response, executeErr := srv.executeModeration(ctx, apiKey, request, ctx.ExtraParams().GetString(http.RemoteIPKey))
+	if executeErr != nil {
+		AbortWithOpenaiError(ctx, executeErr)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	if writeErr := WriteJsonResponse(ctx.CustomRender(), http.StatusOK, response); writeErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
+	}
+}
+
+// moderationGate checks the inputs with configured moderation model when the user is moderated,
+// flagged is false if the user is not moderated or no moderation model configured.
+func (srv *CompatibleService) moderationGate(ctx context.Context, apiKey string, inputs []string, requestIP string) (flagged bool, err error) {
+	if global.Config.App.ModerationModel == "" {
+		return false, nil
+	}
+
+	user, authorized := AuthorizedUser(ctx)
+	if !authorized {
+		return false, ErrorUnauthorizedRequest
+	} else if !user.Moderated {
+		return false, nil
+	}
+
+	input, _ := json.Marshal(inputs)
+	response, executeErr := srv.executeModeration(ctx, apiKey, &entity.ModerationRequest{Model: global.Config.App.ModerationModel, Input: input}, requestIP)
+	if errors.Is(executeErr, ErrorNoAvailableClient) {
+		return false, errors.WithMessage(ErrorModerationUnavailable, executeErr.Error())
+	} else if executeErr != nil {
+		return false, executeErr
+	}
+
+	return srv.moderationFlagged(response), nil
+}
+
+// executeModeration forwards the moderation request and bills it, the request is recorded as flagged if any input flagged.
+func (srv *CompatibleService) executeModeration(ctx context.Context, apiKey string, request *entity.ModerationRequest, requestIP string) (response *entity.ModerationResponse, err error) {
+	// calculate prompt token
+	inputs := []string{string(request.Input)}
+	var multiple []string
+	if json.Unmarshal(request.Input, &multiple) == nil {
+		inputs = multiple
+	}
+	promptToken := CalculatePromptToken(inputs...)
+
+	// get available openai client
+	_, metadata, releaseQuota, getErr := GetAvailableClient(ctx, apiKey, request.Model, promptToken, model.OpenaiModelTypeModeration)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	// hold the estimated cost until the real cost is billed
+	reservation, reserveErr := ReserveBalance(metadata, promptToken, 0)
+	if reserveErr != nil {
+		releaseQuota()
+		return nil, reserveErr
+	}
+	defer reservation.Release()
+
+	payload, marshalErr := json.Marshal(&entity.ModerationRequest{Model: metadata.UpstreamModel(), Input: request.Input})
+	if marshalErr != nil {
+		releaseQuota()
+		return nil, marshalErr
+	}
+
+	upstream, executeErr := ExecuteRawOpenaiRequest(ctx, metadata.ClientID, "moderations", bytes.NewReader(payload), http.ContentTypeJson)
+	if executeErr != nil {
+		releaseQuota()
+		return nil, executeErr
+	}
+	defer upstream.Body.Close()
+	if upstream.StatusCode != http.StatusOK {
+		releaseQuota()
+		return nil, NewUpstreamResponseError(upstream)
+	}
+
+	response = &entity.ModerationResponse{}
+	if decodeErr := json.NewDecoder(upstream.Body).Decode(response); decodeErr != nil {
+		releaseQuota()
+		return nil, errors.Wrap(decodeErr, "decode moderation response failed")
+	}
+	response.Model = metadata.ModelName
+
+	// consume success, update balances
+	status := model.OpenaiRequestStatusSuccess
+	if srv.moderationFlagged(response) {
+		status = model.OpenaiRequestStatusFlagged
+	}
+	balanceCost := metadata.ModelPromptPrice.Mul(decimal.NewFromInt(promptToken)).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit)).Mul(decimal.NewFromInt(-1))
+	_, updateClientBalanceErr := global.OpenaiClientBalanceDatabaseInstance.CreateBalanceRecord(ctx, metadata.ClientID, balanceCost, model.OpenaiClientBalanceActionConsumption)
+	_, updateUserBalanceErr := global.WhisperUserBalanceDatabaseInstance.CreateBalanceRecord(ctx, metadata.UserID, balanceCost, model.WhisperUserBalanceActionConsumption)
+	updateRequestErr := global.OpenaiRequestDatabaseInstance.CreateOpenaiRequestRecord(ctx, &model.OpenaiRequest{
+		ClientID:             int64(metadata.ClientID),
+		ModelID:              int64(metadata.ModelID),
+		UserID:               int64(metadata.UserID),
+		RequestIP:            requestIP,
+		RequestID:            response.ID,
+		TraceID:              trace.GetTid(ctx),
+		PromptTokenUsage:     int(promptToken),
+		CompletionTokenUsage: 0,
+		BalanceCost:          balanceCost.Abs(),
+		Status:               status,
+	})
+	for _, err := range []error{updateClientBalanceErr, updateUserBalanceErr, updateRequestErr} {
+		if err != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("update response result failed").WithData(err))
+		}
+	}
+
+	return response, nil
+}
+
+func (srv *CompatibleService) moderationFlagged(response *entity.ModerationResponse) bool {
+	for _, result := range response.Results {
+		if result.Flagged {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OpenaiBodyPreprocessor replaces the json body preprocessor of the framework, invalid bodies are responded with
+// openai error instead of the framework error, only for endpoints with custom render.
+func OpenaiBodyPreprocessor[request any, response any](_ *http.EndPoint[request, response], origin *gin.Context, dest http.PreprocessedContext[request, response]) {
+	// checking chain is aborted, no need to check
+	if origin.IsAborted() {
+		return
+	}
+
+	abort := func(message string) {
+		WriteOpenaiError(origin.Writer, http.StatusBadRequest, "invalid_request_error", "", message)
+		origin.Abort()
+		origin.Set(http.ErrorContextKey(), message)
+	}
+
+	payload, readErr := origin.GetRawData()
+	if readErr != nil {
+		abort(values.BuildStrings("invalid request body: ", readErr.Error()))
+		return
+	}
+
+	requestBody := values.Nil[request]()
+	if len(payload) > 0 {
+		if unmarshalErr := json.Unmarshal(payload, &requestBody); unmarshalErr != nil {
+			abort(values.BuildStrings("invalid request body: ", unmarshalErr.Error()))
+			return
+		}
+	}
+	if checkResult := values.CheckStruct(requestBody); checkResult != "" {
+		abort(values.BuildStrings("missing required field: ", checkResult))
+		return
+	}
+
+	dest.SetRequest(requestBody)
+	dest.SetResponseWriter(origin.Writer)
+}
+
+func (srv *CompatibleService) AudioFormPreprocessor(_ *http.EndPoint[*entity.AudioRequest, *entity.AudioResponse], origin *gin.Context, dest http.PreprocessedContext[*entity.AudioRequest, *entity.AudioResponse]) {
+	// checking chain is aborted, no need to check
+	if origin.IsAborted() {
+		return
+	}
+
+	abort := func(message string) {
+		WriteOpenaiError(origin.Writer, http.StatusBadRequest, "invalid_request_error", "", message)
+		origin.Abort()
+		origin.Set(http.ErrorContextKey(), message)
+	}
+
+	// read audio file from multipart form
+	header, formFileErr := origin.FormFile("file")
+	if formFileErr != nil {
+		abort(values.BuildStrings("invalid request body: ", formFileErr.Error()))
+		return
+	}
+	file, openErr := header.Open()
+	if openErr != nil {
+		abort(values.BuildStrings("invalid request body: ", openErr.Error()))
+		return
+	}
+	defer file.Close()
+	payload, readErr := io.ReadAll(file)
+	if readErr != nil {
+		abort(values.BuildStrings("invalid request body: ", readErr.Error()))
+		return
+	}
+
+	request := &entity.AudioRequest{
+		File:           payload,
+		FileName:       header.Filename,
+		Model:          origin.PostForm("model"),
+		Language:       origin.PostForm("language"),
+		Prompt:         origin.PostForm("prompt"),
+		ResponseFormat: origin.PostForm("response_format"),
+		Temperature:    origin.PostForm("temperature"),
+	}
+	if request.Model == "" {
+		abort("missing required field: model")
+		return
+	}
+
+	dest.SetRequest(request)
+	dest.SetResponseWriter(origin.Writer)
+}
+
+func (srv *CompatibleService) AudioTranscription(ctx http.Context[*entity.AudioRequest, *entity.AudioResponse]) {
+	srv.audio(ctx, "audio/transcriptions")
+}
+
+func (srv *CompatibleService) AudioTranslation(ctx http.Context[*entity.AudioRequest, *entity.AudioResponse]) {
+	srv.audio(ctx, "audio/translations")
+}
+
+func (srv *CompatibleService) audio(ctx http.Context[*entity.AudioRequest, *entity.AudioResponse], path string) {
+	apiKey, request := AuthorizedApiKey(ctx), ctx.Request()
+
+	// check rate limits and concurrency of the user
+	release, refund, quotaErr := AcquireUserQuota(ctx, 0)
+	if quotaErr != nil {
+		AbortWithOpenaiError(ctx, quotaErr)
+		return
+	}
+	defer release()
+
+	// get available openai clients, the next client is used if the upstream fails, audio duration is unknown before
+	// upstream returns
+	clients, getErr := GetAvailableClients(ctx, apiKey, request.Model, 0, model.OpenaiModelTypeTranscription)
+	if getErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, getErr)
+		return
+	}
+
+	// hold the estimated cost until the real cost is billed, the duration is estimated from the size of the file
+	estimatedSeconds := srv.estimateAudioSeconds(request.File)
+	clients, reservation, reserveErr := ReserveClients(ctx, clients, estimatedSeconds, 0)
+	if reserveErr != nil {
+		refund()
+		AbortWithOpenaiError(ctx, reserveErr)
+		return
+	}
+	defer reservation.Release()
+
+	// request verbose_json from upstream if the model is configured to support it, the duration is required for
+	// billing and the result is rendered in the format the caller requested, other models are called with the format
+	// of the caller
+	response, metadata, executeErr := ExecuteWithFailover(ctx, clients, 0, func(_ openai.Client, metadata *dto.AvailableClientDTO) (*nethttp.Response, error) {
+		upstreamFormat := request.ResponseFormat
+		if metadata.ModelAudioVerboseJson {
+			upstreamFormat = "verbose_json"
+		}
+		form := http.NewMultipartBodyBuilder().
+			WithFile("file", request.FileName, bytes.NewReader(request.File)).
+			WithForm("model", metadata.UpstreamModel())
+		for key, value := range map[string]string{"response_format": upstreamFormat, "language": request.Language, "prompt": request.Prompt, "temperature": request.Temperature} {
+			if value != "" {
+				form = form.WithForm(key, value)
+			}
+		}
+		body, contentType, buildErr := form.Build()
+		if buildErr != nil {
+			return nil, errors.Wrap(buildErr, "build audio form failed")
+		}
+
+		response, executeErr := ExecuteRawOpenaiRequest(ctx, metadata.ClientID, path, body, contentType)
+		if executeErr != nil {
+			return nil, executeErr
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, NewUpstreamResponseError(response)
+		}
+
+		return response, nil
+	})
+	if executeErr != nil {
+		// nothing is billed if the upstream failed
+		AbortWithOpenaiError(ctx, executeErr)
 		return
 	}
-	if !exist {
-		ctx.SetStatusCode(http.StatusUnauthorized)
-		ctx.SetResponse(&openai.ListModelResponseBody{})
-		ctx.Abort()
+	defer response.Body.Close()
+
+	payload, readErr := io.ReadAll(response.Body)
+	if readErr != nil {
+		AbortWithOpenaiError(ctx, &UpstreamError{Err: errors.Wrap(readErr, "read audio response failed")})
 		return
 	}
 
-	// check allow ip
-	if !CheckAllowIP(ctx, ctx.ClientIP(), strings.Split(allowIPs, ",")) {
-		ctx.SetStatusCode(http.StatusForbidden)
-		ctx.SetResponse(&openai.ListModelResponseBody{})
-		ctx.Abort()
+	// bill the duration reported by the upstream, the estimated duration is billed if the upstream does not report it
+	seconds, renderContentType, renderPayload := estimatedSeconds, response.Header.Get(http.HeaderContentType), payload
+	if metadata.ModelAudioVerboseJson {
+		result := &entity.AudioVerboseResponse{}
+		if decodeErr := json.Unmarshal(payload, result); decodeErr != nil {
+			AbortWithOpenaiError(ctx, &UpstreamError{Err: errors.Wrap(decodeErr, "decode audio response failed")})
+			return
+		}
+
+		seconds = int64(math.Ceil(result.Duration))
+		renderContentType, renderPayload = srv.renderAudioResult(request.ResponseFormat, result)
+	} else if result := (&entity.AudioResponse{}); json.Unmarshal(payload, result) == nil && result.Usage != nil && result.Usage.Seconds > 0 {
+		seconds = int64(math.Ceil(result.Usage.Seconds))
 	}
+
+	// write response in the format caller requested
+	ctx.CustomRender().Header().Set(http.HeaderContentType, renderContentType)
+	ctx.CustomRender().WriteHeaderNow()
+	if _, writeErr := ctx.CustomRender().Write(renderPayload); writeErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("write response failed").WithData(writeErr))
+	}
+
+	// consume success, update balances, audio is billed by seconds
+	promptCostAmount := metadata.ModelPromptPrice.Mul(decimal.NewFromInt(seconds)).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit))
+	balanceCost := promptCostAmount.Mul(decimal.NewFromInt(-1))
+	_, updateClientBalanceErr := global.OpenaiClientBalanceDatabaseInstance.CreateBalanceRecord(ctx, metadata.ClientID, balanceCost, model.OpenaiClientBalanceActionConsumption)
+	_, updateUserBalanceErr := global.WhisperUserBalanceDatabaseInstance.CreateBalanceRecord(ctx, metadata.UserID, balanceCost, model.WhisperUserBalanceActionConsumption)
+	updateRequestErr := global.OpenaiRequestDatabaseInstance.CreateOpenaiRequestRecord(ctx, &model.OpenaiRequest{
+		ClientID:             int64(metadata.ClientID),
+		ModelID:              int64(metadata.ModelID),
+		UserID:               int64(metadata.UserID),
+		RequestIP:            ctx.ExtraParams().GetString(http.RemoteIPKey),
+		RequestID:            trace.GetTid(ctx),
+		TraceID:              trace.GetTid(ctx),
+		PromptTokenUsage:     int(seconds),
+		CompletionTokenUsage: 0,
+		BalanceCost:          balanceCost.Abs(),
+	})
+	for _, err := range []error{updateClientBalanceErr, updateUserBalanceErr, updateRequestErr} {
+		if err != nil {
+			global.Logger.Error(logger.NewFields(ctx).WithMessage("update response result failed").WithData(err))
+		}
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+}
+
+// estimateAudioSeconds estimates the duration of the audio file with the bitrate of common compressed audio,
+// uncompressed audio is overestimated, which is fine for holding balance.
+func (srv *CompatibleService) estimateAudioSeconds(file []byte) int64 {
+	const audioBytesPerSecond = 16 * 1024
+
+	return max(int64(math.Ceil(float64(len(file))/audioBytesPerSecond)), 1)
+}
+
+func (srv *CompatibleService) renderAudioResult(format string, result *entity.AudioVerboseResponse) (contentType string, payload []byte) {
+	switch format {
+	case "text":
+		return http.ContentTypeTextPlain, []byte(result.Text)
+	case "verbose_json":
+		payload, _ = json.Marshal(result)
+		return http.ContentTypeJson, payload
+	case "srt", "vtt":
+		builder := strings.Builder{}
+		if format == "vtt" {
+			builder.WriteString("WEBVTT\n\n")
+		}
+		for i, segment := range result.Segments {
+			if format == "srt" {
+				builder.WriteString(strconv.Itoa(i + 1))
+				builder.WriteString("\n")
+			}
+			builder.WriteString(srv.formatSubtitleTime(segment.Start, format))
+			builder.WriteString(" --> ")
+			builder.WriteString(srv.formatSubtitleTime(segment.End, format))
+			builder.WriteString("\n")
+			builder.WriteString(strings.TrimSpace(segment.Text))
+			builder.WriteString("\n\n")
+		}
+		return http.ContentTypeTextPlain, []byte(builder.String())
+	default:
+		payload, _ = json.Marshal(&entity.AudioResponse{Text: result.Text})
+		return http.ContentTypeJson, payload
+	}
+}
+
+func (srv *CompatibleService) formatSubtitleTime(seconds float64, format string) string {
+	millis := int64(math.Round(seconds * 1000))
+	separator := ","
+	if format == "vtt" {
+		separator = "."
+	}
+
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", millis/3600000, millis/60000%60, millis/1000%60, separator, millis%1000)
 }
 
-func (srv *CompatibleService) buildErrorChatCompleteResponse(ctx context.Context, content string) *openai.CompleteChatResponseBody {
-	return &openai.CompleteChatResponseBody{
-		ID:      trace.GetTid(ctx),
-		Object:  "chat.completion",
-		Created: time.Now().UnixMilli(),
-		Choices: []openai.ReplyChoiceObject{{Index: 0, Message: openai.ChatMessageObject{Role: openai.ChatRoleEnumAssistant, Content: json.RawMessage(values.BuildStrings(`"`, content, `"`))}, FinishReason: "error"}},
-		Usage:   openai.UsageObject{},
-		Model:   "akasha-whisper",
+func (srv *CompatibleService) speechContentType(format string) string {
+	switch format {
+	case "opus":
+		return "audio/ogg"
+	case "aac":
+		return "audio/aac"
+	case "flac":
+		return "audio/flac"
+	case "wav":
+		return "audio/wav"
+	case "pcm":
+		return "audio/L16"
+	default:
+		return "audio/mpeg"
 	}
 }
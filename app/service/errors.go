@@ -0,0 +1,145 @@
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+	"github.com/alioth-center/infrastructure/utils/values"
+	"github.com/pkg/errors"
+)
+
+// ErrorBalanceReserved is returned when the balance covers the cost but is held by running requests.
+var ErrorBalanceReserved = errors.New("balance is held by running requests")
+
+// ErrorContentFlagged is returned when the inputs of a moderated user are flagged by the moderation model.
+var ErrorContentFlagged = errors.New("content flagged by moderation")
+
+// ErrorImagePriceNotConfigured is returned when no client of the image model has the price of the requested size and
+// quality, images are billed by these prices only.
+var ErrorImagePriceNotConfigured = errors.New("image price not configured")
+
+// ErrorModerationUnavailable is returned when the inputs of a moderated user cannot be checked, because no client
+// of the moderation model can serve the user, it is an outage of the gateway instead of a fault of the caller.
+var ErrorModerationUnavailable = errors.New("moderation model unavailable")
+
+// UpstreamError is the failure of calling the upstream without a response, such as network errors.
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return values.BuildStrings("upstream request failed: ", e.Err.Error())
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// OpenaiErrorOf maps the error of compatible handlers to the status and the openai error body. Upstream error
+// bodies are relayed only if the upstream rejected the request itself, errors of upstream credentials, quotas
+// and servers are hidden behind 502, other unknown errors are 500 without details.
+//
+// Reference: https://platform.openai.com/docs/guides/error-codes/api-errors
+func OpenaiErrorOf(err error) (status int, response *entity.OpenaiErrorResponse) {
+	var rateLimitErr *RateLimitError
+	var responseErr *UpstreamResponseError
+	var statusErr *openai.ResponseStatusError
+	var upstreamErr *UpstreamError
+	switch {
+	case errors.Is(err, ErrorUnauthorizedRequest):
+		return newOpenaiError(http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "incorrect api key provided")
+	case errors.As(err, &rateLimitErr) && rateLimitErr.Type != "":
+		return newOpenaiError(http.StatusTooManyRequests, rateLimitErr.Type, "rate_limit_exceeded", rateLimitErr.Error())
+	case errors.As(err, &rateLimitErr):
+		return newOpenaiError(http.StatusTooManyRequests, "requests", "rate_limit_exceeded", rateLimitErr.Error())
+	case errors.Is(err, ErrorModerationUnavailable):
+		return newOpenaiError(http.StatusServiceUnavailable, "server_error", "moderation_unavailable", "the moderation model is temporarily unavailable, please retry later")
+	case errors.Is(err, ErrorNoAvailableClient):
+		return newOpenaiError(http.StatusForbidden, "invalid_request_error", "model_not_found", "the model does not exist or you do not have access to it")
+	case errors.Is(err, ErrorInsufficientBalance):
+		return newOpenaiError(http.StatusPaymentRequired, "insufficient_quota", "insufficient_quota", "you exceeded your current quota, please check your balance")
+	case errors.Is(err, ErrorBalanceReserved):
+		return newOpenaiError(http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota", "you exceeded your current quota, balance is held by running requests")
+	case errors.Is(err, ErrorNoHealthyClient):
+		return newOpenaiError(http.StatusServiceUnavailable, "server_error", "model_unavailable", "the model is temporarily unavailable, please retry later")
+	case errors.Is(err, ErrorImagePriceNotConfigured):
+		return newOpenaiError(http.StatusBadRequest, "invalid_request_error", "unsupported_image_size", "the size and quality of the image are not supported by the model")
+	case errors.Is(err, ErrorContentFlagged):
+		return newOpenaiError(http.StatusBadRequest, "invalid_request_error", "content_policy_violation", "your request was rejected as a result of the content policy")
+	case errors.As(err, &responseErr):
+		relayed := &entity.OpenaiErrorResponse{}
+		if isRelayableUpstreamStatus(responseErr.StatusCode) && json.Unmarshal(responseErr.Body, relayed) == nil && relayed.Error.Message != "" {
+			return responseErr.StatusCode, relayed
+		}
+
+		return upstreamStatusError(responseErr.StatusCode)
+	case errors.As(err, &statusErr):
+		if isRelayableUpstreamStatus(statusErr.StatusCode) {
+			return newOpenaiError(statusErr.StatusCode, "invalid_request_error", "", values.BuildStrings("upstream rejected the request: ", statusErr.Status))
+		}
+
+		return upstreamStatusError(statusErr.StatusCode)
+	case errors.As(err, &upstreamErr):
+		return newOpenaiError(http.StatusBadGateway, "server_error", "upstream_error", "upstream service is unavailable")
+	default:
+		return newOpenaiError(http.StatusInternalServerError, "server_error", "", "internal server error")
+	}
+}
+
+// AbortWithOpenaiError writes the error as openai error response and aborts the chain, only for endpoints with
+// custom render. Retry-After header is set for rate limit errors, and 5xx errors are logged.
+func AbortWithOpenaiError[request any, response any](ctx http.Context[request, response], err error) {
+	status, body := OpenaiErrorOf(err)
+	if status >= http.StatusInternalServerError {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("serve compatible request failed").WithData(map[string]any{"status": status, "error": err.Error()}))
+	}
+
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		SetRetryAfter(ctx, rateLimitErr)
+	}
+
+	ctx.SetStatusCode(status)
+	WriteOpenaiErrorResponse(ctx.CustomRender(), status, body)
+	ctx.Abort()
+}
+
+// WriteOpenaiErrorResponse writes the openai error body to the writer.
+func WriteOpenaiErrorResponse(writer gin.ResponseWriter, status int, body *entity.OpenaiErrorResponse) {
+	payload, _ := json.Marshal(body)
+
+	writer.Header().Set(http.HeaderContentType, http.ContentTypeJson)
+	writer.WriteHeader(status)
+	_, _ = writer.Write(payload)
+}
+
+// isRelayableUpstreamStatus checks the upstream status is caused by the request itself, such as invalid parameters
+// or context length exceeded, these errors are useful for the caller and contain no upstream credentials.
+func isRelayableUpstreamStatus(status int) bool {
+	return status >= http.StatusBadRequest && status < http.StatusInternalServerError &&
+		status != http.StatusUnauthorized && status != http.StatusForbidden && status != http.StatusPaymentRequired && status != http.StatusTooManyRequests
+}
+
+// upstreamStatusError hides the upstream failure not caused by the request, rate limits are kept for retrying.
+func upstreamStatusError(status int) (int, *entity.OpenaiErrorResponse) {
+	if status == http.StatusTooManyRequests {
+		return newOpenaiError(http.StatusTooManyRequests, "requests", "rate_limit_exceeded", "rate limit reached for the upstream service, please retry later")
+	}
+
+	return newOpenaiError(http.StatusBadGateway, "server_error", "upstream_error", values.BuildStrings("upstream service responded with status ", values.IntToString(status)))
+}
+
+func newOpenaiError(status int, errorType, code, message string) (int, *entity.OpenaiErrorResponse) {
+	response := &entity.OpenaiErrorResponse{Error: entity.OpenaiError{Message: message, Type: errorType}}
+	if code != "" {
+		response.Error.Code = &code
+	}
+
+	return status, response
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"io"
+	nethttp "net/http"
+	"sync"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+	"github.com/alioth-center/infrastructure/trace"
+	"github.com/pkg/errors"
+)
+
+const (
+	CircuitStateClosed   = "closed"    // client serves requests normally
+	CircuitStateOpen     = "open"      // client failed continuously, excluded from routing until the probe succeeds
+	CircuitStateHalfOpen = "half_open" // cooldown passed, client is probed and serves one request on trial at a time
+)
+
+// healthEwmaWeight is the weight of the latest call in the moving averages of error rate and latency.
+const healthEwmaWeight = 0.1
+
+// ErrorNoHealthyClient is returned when the user can call the model but the circuits of all its clients are open.
+var ErrorNoHealthyClient = errors.New("no healthy client")
+
+// ErrorClientOnTrial is returned when the circuit of the client is half open and its trial call is in flight, the
+// request is failed over to the next client without calling the upstream.
+var ErrorClientOnTrial = errors.WithMessage(ErrorNoHealthyClient, "client is on trial")
+
+// ClientHealth tracks the health of the upstream of each client from live traffic, keyed by client id.
+var ClientHealth = NewHealthTracker()
+
+// HealthTracker records the calls of the upstreams and breaks the circuit of the client after consecutive failures,
+// open circuits are probed with list models after circuit_breaker_cooldown and closed once the upstream recovers.
+type HealthTracker struct {
+	mu      sync.Mutex
+	clients map[int]*clientHealth
+}
+
+type clientHealth struct {
+	state               string
+	consecutiveFailures int
+	requests            int64
+	failures            int64
+	inFlight            int
+	trial               bool
+	errorRate           float64
+	rateLimitRate       float64
+	latency             time.Duration
+	changedAt           time.Time
+}
+
+// ClientHealthSnapshot is the health of the client at the moment.
+type ClientHealthSnapshot struct {
+	State               string
+	ConsecutiveFailures int
+	Requests            int64
+	Failures            int64
+	InFlight            int
+	ErrorRate           float64
+	RateLimitRate       float64
+	Latency             time.Duration
+}
+
+func NewHealthTracker() *HealthTracker {
+	return &HealthTracker{clients: map[int]*clientHealth{}}
+}
+
+// Available checks the client can serve requests, clients with open circuit are not available, and clients with
+// half open circuit are not available while the trial call is in flight.
+func (t *HealthTracker) Available(clientID int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health, exist := t.clients[clientID]
+	return !exist || (health.state != CircuitStateOpen && !health.trial)
+}
+
+// Snapshot returns the health of the client, clients without traffic are healthy.
+func (t *HealthTracker) Snapshot(clientID int) ClientHealthSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health, exist := t.clients[clientID]
+	if !exist {
+		return ClientHealthSnapshot{State: CircuitStateClosed}
+	}
+
+	return ClientHealthSnapshot{
+		State:               health.state,
+		ConsecutiveFailures: health.consecutiveFailures,
+		Requests:            health.requests,
+		Failures:            health.failures,
+		InFlight:            health.inFlight,
+		ErrorRate:           health.errorRate,
+		RateLimitRate:       health.rateLimitRate,
+		Latency:             health.latency,
+	}
+}
+
+// RecordSuccess records a call answered by the upstream, a half open circuit is closed.
+func (t *HealthTracker) RecordSuccess(clientID int, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health := t.record(clientID, latency, false)
+	health.consecutiveFailures = 0
+	if health.state == CircuitStateHalfOpen {
+		health.state, health.changedAt, health.trial = CircuitStateClosed, time.Now(), false
+		global.Logger.Info(logger.NewFields(trace.NewContext()).WithMessage("client circuit closed").WithData(map[string]any{"client_id": clientID}))
+	}
+}
+
+// RecordFailure records a call failed by the upstream, the circuit is opened if the failures reach
+// circuit_breaker_threshold, or the client fails on trial.
+func (t *HealthTracker) RecordFailure(clientID int, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health := t.record(clientID, latency, true)
+	health.consecutiveFailures++
+
+	threshold := global.Config.App.CircuitBreakerThreshold
+	if health.state == CircuitStateHalfOpen || (health.state == CircuitStateClosed && threshold > 0 && health.consecutiveFailures >= threshold) {
+		t.open(clientID, health)
+	}
+}
+
+// RecordRateLimited records a call rejected by the rate limit of the upstream, it is neither success nor failure
+// of the circuit, only the rate of 429 responses is updated.
+func (t *HealthTracker) RecordRateLimited(clientID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health := t.get(clientID)
+	health.rateLimitRate += (1 - health.rateLimitRate) * healthEwmaWeight
+}
+
+// begin counts the call in flight until end is called, the call of a half open client is the trial of the circuit,
+// allowed is false if another trial is in flight. endTrial must be called after the trial is recorded.
+func (t *HealthTracker) begin(clientID int) (allowed bool, trial bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health := t.get(clientID)
+	if health.state == CircuitStateHalfOpen {
+		if health.trial {
+			return false, false
+		}
+		health.trial, trial = true, true
+	}
+	health.inFlight++
+
+	return true, trial
+}
+
+// endTrial lets the next call try the client, if the trial neither closed nor opened the circuit, such as rate limited.
+func (t *HealthTracker) endTrial(clientID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.get(clientID).trial = false
+}
+
+func (t *HealthTracker) end(clientID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.get(clientID).inFlight--
+}
+
+// get returns the health of the client, created as healthy if not tracked, the lock must be held by the caller.
+func (t *HealthTracker) get(clientID int) *clientHealth {
+	health, exist := t.clients[clientID]
+	if !exist {
+		health = &clientHealth{state: CircuitStateClosed, changedAt: time.Now()}
+		t.clients[clientID] = health
+	}
+
+	return health
+}
+
+// record updates the moving averages with the call, the latency only counts answered calls, as failures are
+// often rejected quickly, the lock must be held by the caller.
+func (t *HealthTracker) record(clientID int, latency time.Duration, failed bool) *clientHealth {
+	health := t.get(clientID)
+	if !failed && health.requests == health.failures {
+		health.latency = latency
+	}
+
+	result := 0.0
+	if failed {
+		result = 1
+		health.failures++
+	}
+	health.requests++
+	health.errorRate += (result - health.errorRate) * healthEwmaWeight
+	health.rateLimitRate -= health.rateLimitRate * healthEwmaWeight
+	if !failed {
+		health.latency += time.Duration(float64(latency-health.latency) * healthEwmaWeight)
+	}
+
+	return health
+}
+
+// open opens the circuit and schedules the probe after the cooldown, the lock must be held by the caller.
+func (t *HealthTracker) open(clientID int, health *clientHealth) {
+	health.state, health.changedAt, health.trial = CircuitStateOpen, time.Now(), false
+	global.Logger.Warn(logger.NewFields(trace.NewContext()).WithMessage("client circuit opened").WithData(map[string]any{"client_id": clientID, "consecutive_failures": health.consecutiveFailures}))
+
+	time.AfterFunc(time.Duration(global.Config.App.CircuitBreakerCooldown)*time.Second, func() { t.probe(clientID) })
+}
+
+// probe moves the open circuit to half open and calls list models of the client as the trial, the result is
+// recorded by the executor of the client, the circuit is opened again if the probe is not answered. The probe is
+// rejected if live traffic takes the trial first, then the circuit is left to the result of that request.
+func (t *HealthTracker) probe(clientID int) {
+	t.mu.Lock()
+	health, exist := t.clients[clientID]
+	if !exist || health.state != CircuitStateOpen {
+		t.mu.Unlock()
+		return
+	}
+	health.state, health.changedAt = CircuitStateHalfOpen, time.Now()
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(trace.NewContext(), 30*time.Second)
+	defer cancel()
+
+	client, getClientErr := GetOpenaiClient(ctx, &dto.AvailableClientDTO{ClientID: clientID})
+	if getClientErr == nil {
+		_, probeErr := client.ListModels(ctx, openai.ListModelRequest{})
+		global.Logger.Info(logger.NewFields(ctx).WithMessage("client probed").WithData(map[string]any{"client_id": clientID, "error": probeErr}))
+	}
+
+	// the probe is neither success nor failure, such as rate limited, probe again later
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if health.state == CircuitStateHalfOpen && !health.trial {
+		t.open(clientID, health)
+	}
+}
+
+// Wrap returns the executor recording the calls of the client, network errors, 5xx and the rejections of the
+// credentials of the client are failures, rate limited calls only count in the rate of 429 responses. The latency
+// is the time until the upstream responds, which is the time to first token of streaming requests, and the call
+// is in flight until the response body is closed.
+func (t *HealthTracker) Wrap(clientID int, executor http.Client) http.Client {
+	return &healthRecordingClient{clientID: clientID, tracker: t, executor: executor}
+}
+
+type healthRecordingClient struct {
+	clientID int
+	tracker  *HealthTracker
+	executor http.Client
+}
+
+func (c *healthRecordingClient) ExecuteRequest(request http.RequestBuilder) (response http.ResponseParser, err error) {
+	rawRequest, buildErr := request.Build()
+	if buildErr != nil {
+		return nil, errors.Wrap(buildErr, "build upstream request failed")
+	}
+
+	rawResponse, executeErr := c.ExecuteRawRequest(rawRequest)
+	if executeErr != nil {
+		return nil, executeErr
+	}
+
+	// the parser reads the whole body and replaces it, close the original one to end the call
+	body := rawResponse.Body
+	defer body.Close()
+
+	return http.NewSimpleResponseParser(rawResponse), nil
+}
+
+func (c *healthRecordingClient) ExecuteRawRequest(request *nethttp.Request) (response *nethttp.Response, err error) {
+	allowed, trial := c.tracker.begin(c.clientID)
+	if !allowed {
+		return nil, ErrorClientOnTrial
+	}
+	if trial {
+		defer c.tracker.endTrial(c.clientID)
+	}
+
+	startedAt := time.Now()
+	response, err = c.executor.ExecuteRawRequest(request)
+	latency := time.Since(startedAt)
+	if err != nil {
+		c.tracker.end(c.clientID)
+	} else {
+		response.Body = &inFlightBody{ReadCloser: response.Body, end: func() { c.tracker.end(c.clientID) }}
+	}
+
+	switch {
+	case err != nil && request.Context().Err() != nil:
+		// canceled by the caller, the upstream is not to blame
+	case err != nil:
+		c.tracker.RecordFailure(c.clientID, latency)
+	case response.StatusCode == http.StatusTooManyRequests:
+		c.tracker.RecordRateLimited(c.clientID)
+	case response.StatusCode >= http.StatusInternalServerError, response.StatusCode == http.StatusUnauthorized, response.StatusCode == http.StatusForbidden, response.StatusCode == http.StatusPaymentRequired:
+		c.tracker.RecordFailure(c.clientID, latency)
+	default:
+		c.tracker.RecordSuccess(c.clientID, latency)
+	}
+
+	return response, err
+}
+
+// inFlightBody ends the call of the client when the response body is closed.
+type inFlightBody struct {
+	io.ReadCloser
+	once sync.Once
+	end  func()
+}
+
+func (b *inFlightBody) Close() error {
+	b.once.Do(b.end)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,288 @@
+package service
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/utils/values"
+)
+
+// ClientModelLimiter limits the requests and tokens per minute of each (client, model), limits are
+// configured with rpm_limit and tpm_limit of openai models, non-positive limit means unlimited.
+var ClientModelLimiter = NewSlidingWindowLimiter(time.Minute)
+
+// UserLimiter limits the requests and tokens per minute of each whisper user, keyed by user id.
+var UserLimiter = NewSlidingWindowLimiter(time.Minute)
+
+// UserConcurrencyLimiter limits the concurrent requests of each whisper user, keyed by user id.
+var UserConcurrencyLimiter = NewConcurrencyLimiter()
+
+// SlidingWindowLimiter is an in-process sliding window log limiter of requests and tokens.
+type SlidingWindowLimiter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	windows map[string][]slidingWindowEvent
+}
+
+type slidingWindowEvent struct {
+	at       time.Time
+	requests int
+	tokens   int64
+}
+
+func NewSlidingWindowLimiter(window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{window: window, windows: map[string][]slidingWindowEvent{}}
+}
+
+// Allow checks a request with given tokens can be served without recording it, retryAfter is the
+// duration until the request can be served if not allowed.
+func (l *SlidingWindowLimiter) Allow(key string, rpm, tpm int, tokens int64) (allowed bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.allow(key, rpm, tpm, tokens, time.Now())
+}
+
+// Acquire records a request with given tokens if it is allowed, retryAfter is the duration until the
+// request can be served if not allowed.
+func (l *SlidingWindowLimiter) Acquire(key string, rpm, tpm int, tokens int64) (allowed bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if allowed, retryAfter = l.allow(key, rpm, tpm, tokens, now); allowed {
+		l.windows[key] = append(l.windows[key], slidingWindowEvent{at: now, requests: 1, tokens: tokens})
+	}
+
+	return allowed, retryAfter
+}
+
+// Release removes the latest request recorded by Acquire with the same tokens, so the quota taken by a request
+// that is not served is given back.
+func (l *SlidingWindowLimiter) Release(key string, tokens int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.windows[key]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].requests != 1 || events[i].tokens != tokens {
+			continue
+		}
+		if len(events) == 1 {
+			delete(l.windows, key)
+			return
+		}
+
+		l.windows[key] = append(events[:i], events[i+1:]...)
+		return
+	}
+}
+
+// AddTokens records the tokens consumed after the request is served, such as completion tokens.
+func (l *SlidingWindowLimiter) AddTokens(key string, tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.windows[key] = append(l.windows[key], slidingWindowEvent{at: time.Now(), tokens: tokens})
+}
+
+// Usage returns the requests and tokens recorded in the current window.
+func (l *SlidingWindowLimiter) Usage(key string) (requests int, tokens int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, event := range l.prune(key, time.Now()) {
+		requests, tokens = requests+event.requests, tokens+event.tokens
+	}
+
+	return requests, tokens
+}
+
+func (l *SlidingWindowLimiter) allow(key string, rpm, tpm int, tokens int64, now time.Time) (bool, time.Duration) {
+	events := l.prune(key, now)
+	requests, used := 0, int64(0)
+	for _, event := range events {
+		requests, used = requests+event.requests, used+event.tokens
+	}
+
+	retryAfter := time.Duration(0)
+	if rpm > 0 && requests+1 > rpm {
+		// wait until enough requests slide out of the window
+		for _, event := range events {
+			requests -= event.requests
+			if requests+1 <= rpm {
+				retryAfter = max(retryAfter, event.at.Add(l.window).Sub(now))
+				break
+			}
+		}
+	}
+	if tpm > 0 && used > 0 && used+tokens > int64(tpm) {
+		// wait until enough tokens slide out of the window, a request larger than the limit is allowed in an empty window
+		for _, event := range events {
+			used -= event.tokens
+			if used == 0 || used+tokens <= int64(tpm) {
+				retryAfter = max(retryAfter, event.at.Add(l.window).Sub(now))
+				break
+			}
+		}
+	}
+
+	return retryAfter <= 0, retryAfter
+}
+
+// prune removes the events out of the window, events are appended in time order.
+func (l *SlidingWindowLimiter) prune(key string, now time.Time) []slidingWindowEvent {
+	events, cutoff := l.windows[key], now.Add(-l.window)
+	index := 0
+	for index < len(events) && !events[index].at.After(cutoff) {
+		index++
+	}
+	if index == len(events) {
+		delete(l.windows, key)
+		return nil
+	}
+
+	events = events[index:]
+	l.windows[key] = events
+	return events
+}
+
+// ConcurrencyLimiter counts the running requests of each key.
+type ConcurrencyLimiter struct {
+	mu      sync.Mutex
+	running map[int]int
+}
+
+func NewConcurrencyLimiter() *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{running: map[int]int{}}
+}
+
+// Acquire takes a slot of the key if running requests are less than limit, non-positive limit means unlimited.
+func (l *ConcurrencyLimiter) Acquire(key int, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit > 0 && l.running[key] >= limit {
+		return false
+	}
+
+	l.running[key]++
+	return true
+}
+
+// Release gives back the slot taken by Acquire.
+func (l *ConcurrencyLimiter) Release(key int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.running[key] <= 1 {
+		delete(l.running, key)
+		return
+	}
+
+	l.running[key]--
+}
+
+// ClientModelLimitKey returns the limiter key of the client and model.
+func ClientModelLimitKey(clientID, modelID int) string {
+	return values.BuildStrings(strconv.Itoa(clientID), ":", strconv.Itoa(modelID))
+}
+
+// AcquireClientQuota takes the rpm and tpm quota of the client model for the request, a *RateLimitError is returned
+// if the quota is used up. release gives the quota back if the client does not serve the request.
+func AcquireClientQuota(metadata *dto.AvailableClientDTO, promptToken int64) (release func(), err error) {
+	key := ClientModelLimitKey(metadata.ClientID, metadata.ModelID)
+	allowed, retryAfter := ClientModelLimiter.Acquire(key, metadata.ModelRpmLimit, metadata.ModelTpmLimit, promptToken)
+	if !allowed {
+		return nil, &RateLimitError{Message: values.BuildStrings("rate limit reached for all clients of model ", metadata.ModelName), RetryAfter: retryAfter}
+	}
+
+	return func() { ClientModelLimiter.Release(key, promptToken) }, nil
+}
+
+// RateLimitError is returned when the request exceeds the rate limits, the request can be retried after RetryAfter.
+// Type is the openai error type, requests or tokens.
+type RateLimitError struct {
+	Type       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Message
+}
+
+// RetryAfterSeconds returns the Retry-After header value, rounded up to seconds.
+func (e *RateLimitError) RetryAfterSeconds() string {
+	return strconv.Itoa(int(math.Ceil(max(e.RetryAfter, time.Second).Seconds())))
+}
+
+// SetRetryAfter sets the Retry-After header of the rate limited response, works with custom render endpoints.
+func SetRetryAfter[request any, response any](ctx http.Context[request, response], err *RateLimitError) {
+	ctx.SetResponseHeader("Retry-After", err.RetryAfterSeconds())
+	if writer := ctx.CustomRender(); writer != nil {
+		writer.Header().Set("Retry-After", err.RetryAfterSeconds())
+	}
+}
+
+// AcquireUserQuota checks the rpm, tpm and concurrency limits of the authorized user before the request is routed, the
+// x-ratelimit-* headers are set to the response. release must be called after the request is served if err is nil,
+// and refund gives the rpm and tpm quota back if the request is not routed to any client, such as the user has no
+// permission of the model or no balance.
+//
+// Reference: https://platform.openai.com/docs/guides/rate-limits#rate-limits-in-headers
+func AcquireUserQuota[request any, response any](ctx http.Context[request, response], promptToken int64) (release func(), refund func(), err error) {
+	user, authorized := AuthorizedUser(ctx)
+	if !authorized {
+		return nil, nil, ErrorUnauthorizedRequest
+	}
+
+	userID := int(user.ID)
+	if !UserConcurrencyLimiter.Acquire(userID, user.ConcurrencyLimit) {
+		return nil, nil, &RateLimitError{Type: "requests", Message: values.BuildStrings("concurrent requests limit reached, limit: ", strconv.Itoa(user.ConcurrencyLimit)), RetryAfter: time.Second}
+	}
+
+	key := strconv.Itoa(userID)
+	allowed, retryAfter := UserLimiter.Acquire(key, user.RpmLimit, user.TpmLimit, promptToken)
+	requests, tokens := UserLimiter.Usage(key)
+	setRateLimitHeaders(ctx, "requests", user.RpmLimit, int64(requests), retryAfter)
+	setRateLimitHeaders(ctx, "tokens", user.TpmLimit, tokens, retryAfter)
+	if !allowed {
+		UserConcurrencyLimiter.Release(userID)
+
+		limitErr := &RateLimitError{Type: "requests", Message: values.BuildStrings("rate limit reached for requests, limit: ", strconv.Itoa(user.RpmLimit), " per minute"), RetryAfter: retryAfter}
+		if user.RpmLimit <= 0 || requests < user.RpmLimit {
+			limitErr.Type, limitErr.Message = "tokens", values.BuildStrings("rate limit reached for tokens, limit: ", strconv.Itoa(user.TpmLimit), " per minute, used: ", strconv.FormatInt(tokens, 10), ", requested: ", strconv.FormatInt(promptToken, 10))
+		}
+		return nil, nil, limitErr
+	}
+
+	return func() { UserConcurrencyLimiter.Release(userID) }, func() { UserLimiter.Release(key, promptToken) }, nil
+}
+
+// setRateLimitHeaders sets the x-ratelimit-* headers of the resource, nothing is set if the resource is unlimited.
+func setRateLimitHeaders[request any, response any](ctx http.Context[request, response], resource string, limit int, used int64, reset time.Duration) {
+	if limit <= 0 {
+		return
+	}
+
+	headers := map[string]string{
+		values.BuildStrings("x-ratelimit-limit-", resource):     strconv.Itoa(limit),
+		values.BuildStrings("x-ratelimit-remaining-", resource): strconv.FormatInt(max(int64(limit)-used, 0), 10),
+		values.BuildStrings("x-ratelimit-reset-", resource):     max(reset, 0).Round(time.Millisecond).String(),
+	}
+	for key, value := range headers {
+		ctx.SetResponseHeader(key, value)
+		if writer := ctx.CustomRender(); writer != nil {
+			writer.Header().Set(key, value)
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package service
 
 import (
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/alioth-center/akasha-whisper/app/dao"
 	"github.com/alioth-center/akasha-whisper/app/entity"
 	"github.com/alioth-center/akasha-whisper/app/global"
 	"github.com/alioth-center/akasha-whisper/app/model"
@@ -16,6 +18,7 @@ import (
 	"github.com/alioth-center/infrastructure/utils/generate"
 	"github.com/alioth-center/infrastructure/utils/network"
 	"github.com/alioth-center/infrastructure/utils/values"
+	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 )
 
@@ -58,12 +61,18 @@ func (srv *ManagementService) Overview(ctx http.Context[*entity.OverviewRequest,
 	}
 	for i, client := range clients {
 		result.Clients[i] = entity.ClientItem{
-			ID:       client.ClientID,
-			Name:     client.ClientDescription,
-			ApiKey:   values.SecretString(client.ClientKey, 6, 4, "*"),
-			Endpoint: client.ClientEndpoint,
-			Weight:   client.ClientWeight,
-			Balance:  client.ClientBalance,
+			ID:              client.ClientID,
+			Name:            client.ClientDescription,
+			ApiKey:          values.SecretString(client.ClientKey, 6, 4, "*"),
+			Endpoint:        client.ClientEndpoint,
+			Weight:          client.ClientWeight,
+			EffectiveWeight: int(ClientWeightTuner.EffectiveWeight(client.ClientID, int64(client.ClientWeight))),
+			WeightMinFactor: client.WeightMinFactor,
+			WeightMaxFactor: client.WeightMaxFactor,
+			Provider:        client.ClientProvider,
+			Balance:         client.ClientBalance,
+			Reserved:        BalanceReservations.ClientReserved(client.ClientID),
+			Health:          srv.clientHealth(client.ClientID),
 		}
 	}
 	for i, log := range clientBalanceLogs {
@@ -80,6 +89,21 @@ func (srv *ManagementService) Overview(ctx http.Context[*entity.OverviewRequest,
 	ctx.SetResponse(&response)
 }
 
+// clientHealth returns the current health of the client upstream.
+func (srv *ManagementService) clientHealth(clientID int) entity.ClientHealth {
+	health := ClientHealth.Snapshot(clientID)
+	return entity.ClientHealth{
+		CircuitState:        health.State,
+		ConsecutiveFailures: health.ConsecutiveFailures,
+		Requests:            health.Requests,
+		Failures:            health.Failures,
+		InFlight:            health.InFlight,
+		ErrorRate:           math.Round(health.ErrorRate*10000) / 10000,
+		RateLimitRate:       math.Round(health.RateLimitRate*10000) / 10000,
+		LatencyMs:           health.Latency.Milliseconds(),
+	}
+}
+
 func (srv *ManagementService) ListAllClients(ctx http.Context[*entity.ListClientsRequest, *entity.ListClientResponse]) {
 	clients, err := global.OpenaiClientDatabaseInstance.ListClients(ctx)
 	if err != nil {
@@ -92,12 +116,18 @@ func (srv *ManagementService) ListAllClients(ctx http.Context[*entity.ListClient
 	items := make([]*entity.ClientItem, len(clients))
 	for i, client := range clients {
 		items[i] = &entity.ClientItem{
-			ID:       client.ClientID,
-			Name:     client.ClientDescription,
-			ApiKey:   values.SecretString(client.ClientKey, 6, 4, "*"),
-			Endpoint: client.ClientEndpoint,
-			Weight:   client.ClientWeight,
-			Balance:  client.ClientBalance,
+			ID:              client.ClientID,
+			Name:            client.ClientDescription,
+			ApiKey:          values.SecretString(client.ClientKey, 6, 4, "*"),
+			Endpoint:        client.ClientEndpoint,
+			Weight:          client.ClientWeight,
+			EffectiveWeight: int(ClientWeightTuner.EffectiveWeight(client.ClientID, int64(client.ClientWeight))),
+			WeightMinFactor: client.WeightMinFactor,
+			WeightMaxFactor: client.WeightMaxFactor,
+			Provider:        client.ClientProvider,
+			Balance:         client.ClientBalance,
+			Reserved:        BalanceReservations.ClientReserved(client.ClientID),
+			Health:          srv.clientHealth(client.ClientID),
 		}
 	}
 
@@ -108,11 +138,38 @@ func (srv *ManagementService) ListAllClients(ctx http.Context[*entity.ListClient
 
 func (srv *ManagementService) CreateClient(ctx http.Context[*entity.CreateClientRequest, *entity.CreateClientResponse]) {
 	request := ctx.Request()
+	if !IsValidProvider(request.Provider) {
+		response := http.NewBaseResponse(ctx, []*entity.CreateClientScanModelItem{}, http.NewBaseError(http.StatusBadRequest, "invalid provider"))
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetResponse(&response)
+		return
+	}
+
 	client := &model.OpenaiClient{
-		Description: request.Name,
-		ApiKey:      request.ApiKey,
-		Endpoint:    request.Endpoint,
-		Weight:      request.Weight,
+		Description:     request.Name,
+		ApiKey:          request.ApiKey,
+		Endpoint:        request.Endpoint,
+		Weight:          request.Weight,
+		Provider:        request.Provider,
+		WeightMinFactor: request.WeightMinFactor,
+		WeightMaxFactor: request.WeightMaxFactor,
+	}
+	if client.Provider == "" {
+		client.Provider = model.OpenaiClientProviderOpenai
+	}
+
+	// bounds of the weight tuning, unset means the effective weight is between 0.1 and 2 times of the weight
+	if client.WeightMinFactor == 0 {
+		client.WeightMinFactor = defaultWeightMinFactor
+	}
+	if client.WeightMaxFactor == 0 {
+		client.WeightMaxFactor = max(defaultWeightMaxFactor, client.WeightMinFactor)
+	}
+	if client.WeightMinFactor < 0 || client.WeightMaxFactor < client.WeightMinFactor {
+		response := http.NewBaseResponse(ctx, []*entity.CreateClientScanModelItem{}, http.NewBaseError(http.StatusBadRequest, "invalid weight factors"))
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetResponse(&response)
+		return
 	}
 
 	// insert into database
@@ -141,8 +198,9 @@ func (srv *ManagementService) CreateClient(ctx http.Context[*entity.CreateClient
 	}
 	global.Logger.Info(logger.NewFields(ctx).WithMessage("client balance initialized"))
 
-	// initialize openai client
-	openaiClient := openai.NewClient(openai.Config{ApiKey: client.ApiKey, BaseUrl: client.Endpoint}, global.Logger)
+	// initialize openai client, non-openai providers are served by provider adapters
+	config, executor := NewUpstream(client.Provider, client.Endpoint, client.ApiKey)
+	openaiClient := openai.NewCustomClient(*config, ClientHealth.Wrap(int(client.ID), executor), global.Logger)
 	models, listErr := openaiClient.ListModels(ctx, openai.ListModelRequest{})
 	if listErr != nil {
 		global.Logger.Error(logger.NewFields(ctx).WithMessage("failed to list models when create client").WithData(listErr))
@@ -193,6 +251,53 @@ func (srv *ManagementService) ModifyClientBalance(ctx http.Context[*entity.Modif
 	ctx.SetResponse(&response)
 }
 
+func (srv *ManagementService) ListClientWeightLogs(ctx http.Context[*entity.ListClientWeightLogsRequest, *entity.ListClientWeightLogsResponse]) {
+	client := ctx.PathParams().GetString("client_name")
+
+	page, offset := ctx.QueryParams().GetInt("page"), ctx.QueryParams().GetInt("offset")
+	if page == 0 || page > 100 {
+		page = 100
+	}
+
+	startStr, endStr := ctx.QueryParams().GetString("start"), ctx.QueryParams().GetString("end")
+	start, parseErr := strconv.ParseInt(startStr, 10, 64)
+	if parseErr != nil || start == 0 {
+		start = time.Now().AddDate(0, 0, -7).UnixMilli()
+	}
+	end, parseErr := strconv.ParseInt(endStr, 10, 64)
+	if parseErr != nil || end == 0 {
+		end = time.Now().UnixMilli()
+	}
+
+	logs, queryErr := global.OpenaiClientWeightDatabaseInstance.ListWeightRecordsByClientName(ctx, client, time.UnixMilli(start), time.UnixMilli(end), page, offset)
+	if queryErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("failed to list client weight logs").WithData(queryErr))
+		response := http.NewBaseResponse(ctx, []*entity.ClientWeightLog{}, queryErr)
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetResponse(&response)
+		return
+	}
+
+	items := make([]*entity.ClientWeightLog, len(logs))
+	for i, log := range logs {
+		items[i] = &entity.ClientWeightLog{
+			ID:              int(log.ID),
+			Weight:          log.Weight,
+			PreviousWeight:  log.PreviousWeight,
+			EffectiveWeight: log.EffectiveWeight,
+			ErrorRate:       log.ErrorRate,
+			RateLimitRate:   log.RateLimitRate,
+			LatencyMs:       log.LatencyMs,
+			Reason:          log.Reason,
+			CreatedAt:       log.CreatedAt.Format(time.RFC3339),
+		}
+	}
+
+	response := http.NewBaseResponse(ctx, items, nil)
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetResponse(&response)
+}
+
 func (srv *ManagementService) ListClientModels(ctx http.Context[*entity.ListClientModelRequest, *entity.ListClientModelResponse]) {
 	models, queryErr := global.OpenaiModelDatabaseInstance.GetModelsByClientDescription(ctx, ctx.PathParams().GetString("client_name"))
 	if queryErr != nil {
@@ -205,14 +310,18 @@ func (srv *ManagementService) ListClientModels(ctx http.Context[*entity.ListClie
 	items := make([]*entity.ModelItem, len(models))
 	for i, modelItem := range models {
 		items[i] = &entity.ModelItem{
-			ID:              modelItem.ModelID,
-			Name:            modelItem.ModelName,
-			MaxTokens:       modelItem.MaxTokens,
-			RpmLimit:        modelItem.ModelRpmLimit,
-			TpmLimit:        modelItem.ModelTpmLimit,
-			PromptPrice:     modelItem.PromptPrice,
-			CompletionPrice: modelItem.CompletionPrice,
-			LastUpdatedAt:   modelItem.LastUpdatedAt.UnixMilli(),
+			ID:               modelItem.ModelID,
+			Name:             modelItem.ModelName,
+			UpstreamModel:    modelItem.UpstreamModel,
+			RoutingStrategy:  modelItem.RoutingStrategy,
+			Type:             modelItem.ModelType,
+			MaxTokens:        modelItem.MaxTokens,
+			RpmLimit:         modelItem.ModelRpmLimit,
+			TpmLimit:         modelItem.ModelTpmLimit,
+			AudioVerboseJson: modelItem.AudioVerboseJson,
+			PromptPrice:      modelItem.PromptPrice,
+			CompletionPrice:  modelItem.CompletionPrice,
+			LastUpdatedAt:    modelItem.LastUpdatedAt.UnixMilli(),
 		}
 	}
 
@@ -225,18 +334,52 @@ func (srv *ManagementService) CreateClientModels(ctx http.Context[*entity.Create
 	request := ctx.Request()
 
 	modelData := make([]*model.OpenaiModel, len(request.Models))
+	imagePrices := map[string][]*model.OpenaiImagePrice{}
 	for i, modelItem := range request.Models {
+		if modelItem.Type == "" {
+			modelItem.Type = model.OpenaiModelTypeChat
+		}
+		if !IsValidRoutingStrategy(modelItem.RoutingStrategy) {
+			response := http.NewBaseResponse(ctx, &entity.CreateResponse{Success: false}, http.NewBaseError(http.StatusBadRequest, "invalid routing strategy"))
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetResponse(&response)
+			return
+		}
+
 		modelData[i] = &model.OpenaiModel{
-			Model:           modelItem.Name,
-			MaxTokens:       modelItem.MaxTokens,
-			PromptPrice:     modelItem.PromptPrice,
-			CompletionPrice: modelItem.CompletionPrice,
-			RpmLimit:        modelItem.RpmLimit,
-			TpmLimit:        modelItem.TpmLimit,
+			Model:            modelItem.Name,
+			UpstreamModel:    modelItem.UpstreamModel,
+			RoutingStrategy:  modelItem.RoutingStrategy,
+			Type:             modelItem.Type,
+			MaxTokens:        modelItem.MaxTokens,
+			PromptPrice:      modelItem.PromptPrice,
+			CompletionPrice:  modelItem.CompletionPrice,
+			RpmLimit:         modelItem.RpmLimit,
+			TpmLimit:         modelItem.TpmLimit,
+			AudioVerboseJson: modelItem.AudioVerboseJson,
+		}
+
+		// image models are billed per image, collect prices by size and quality
+		for _, price := range modelItem.ImagePrices {
+			imagePrices[modelItem.Name] = append(imagePrices[modelItem.Name], &model.OpenaiImagePrice{Size: price.Size, Quality: price.Quality, Price: price.Price})
 		}
 	}
 
 	insertErr := global.OpenaiModelDatabaseInstance.CreateOrUpdateModelWithClientDescriptions(ctx, modelData, ctx.PathParams().GetString("client_name"))
+	if errors.Is(insertErr, dao.ErrorConflictingRoutingStrategy) {
+		response := http.NewBaseResponse(ctx, &entity.CreateResponse{Success: false}, http.NewBaseError(http.StatusBadRequest, insertErr.Error()))
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetResponse(&response)
+		return
+	}
+	if insertErr != nil {
+		response := http.NewBaseResponse(ctx, &entity.CreateResponse{Success: false}, insertErr)
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetResponse(&response)
+		return
+	}
+
+	insertErr = global.OpenaiImagePriceDatabaseInstance.CreateOrUpdateImagePricesWithClientDescription(ctx, imagePrices, ctx.PathParams().GetString("client_name"))
 	if insertErr != nil {
 		response := http.NewBaseResponse(ctx, &entity.CreateResponse{Success: false}, insertErr)
 		ctx.SetStatusCode(http.StatusInternalServerError)
@@ -268,11 +411,15 @@ func (srv *ManagementService) ListWhisperUsers(ctx http.Context[*entity.ListWhis
 	items := make([]*entity.WhisperUserResult, len(users))
 	for i, user := range users {
 		items[i] = &entity.WhisperUserResult{
-			ID:       int(user.ID),
-			ApiKey:   user.ApiKey,
-			Email:    user.Email,
-			Language: user.Language,
-			AllowIPs: strings.Split(user.AllowIps, ","),
+			ID:               int(user.ID),
+			ApiKey:           user.ApiKey,
+			Email:            user.Email,
+			Language:         user.Language,
+			AllowIPs:         strings.Split(user.AllowIps, ","),
+			Moderated:        user.Moderated,
+			RpmLimit:         user.RpmLimit,
+			TpmLimit:         user.TpmLimit,
+			ConcurrencyLimit: user.ConcurrencyLimit,
 		}
 	}
 
@@ -294,11 +441,25 @@ func (srv *ManagementService) CreateWhisperUser(ctx http.Context[*entity.CreateW
 
 	// create user
 	user := &model.WhisperUser{
-		Email:    request.Email,
-		ApiKey:   generate.RandomBase62WithPrefix("aw-", 64),
-		Role:     request.Role,
-		Language: request.Language,
-		AllowIps: strings.Join(values.FilterArray(request.AllowIPs, func(s string) bool { return network.IsValidIPOrCIDR(s) }), ","),
+		Email:     request.Email,
+		ApiKey:    generate.RandomBase62WithPrefix("aw-", 64),
+		Role:      request.Role,
+		Language:  request.Language,
+		AllowIps:  strings.Join(values.FilterArray(request.AllowIPs, func(s string) bool { return network.IsValidIPOrCIDR(s) }), ","),
+		Moderated: request.Moderated,
+		// non-positive limit means unlimited
+		RpmLimit:         -1,
+		TpmLimit:         -1,
+		ConcurrencyLimit: -1,
+	}
+	if request.RpmLimit != nil {
+		user.RpmLimit = *request.RpmLimit
+	}
+	if request.TpmLimit != nil {
+		user.TpmLimit = *request.TpmLimit
+	}
+	if request.ConcurrencyLimit != nil {
+		user.ConcurrencyLimit = *request.ConcurrencyLimit
 	}
 	created, createErr := global.WhisperUserDatabaseInstance.CreateWhisperUser(ctx, user)
 	if createErr != nil {
@@ -327,11 +488,15 @@ func (srv *ManagementService) CreateWhisperUser(ctx http.Context[*entity.CreateW
 	global.BearerTokenBloomFilterInstance.AddKeys(user.ApiKey)
 
 	result := &entity.WhisperUserResult{
-		ID:       int(user.ID),
-		ApiKey:   user.ApiKey,
-		Email:    user.Email,
-		Language: user.Language,
-		AllowIPs: strings.Split(user.AllowIps, ","),
+		ID:               int(user.ID),
+		ApiKey:           user.ApiKey,
+		Email:            user.Email,
+		Language:         user.Language,
+		AllowIPs:         strings.Split(user.AllowIps, ","),
+		Moderated:        user.Moderated,
+		RpmLimit:         user.RpmLimit,
+		TpmLimit:         user.TpmLimit,
+		ConcurrencyLimit: user.ConcurrencyLimit,
 	}
 	response := http.NewBaseResponse(ctx, result, nil)
 	ctx.SetStatusCode(http.StatusOK)
@@ -383,15 +548,20 @@ func (srv *ManagementService) GetWhisperUser(ctx http.Context[*entity.GetWhisper
 	}
 
 	result := &entity.WhisperUserInfo{
-		ID:              user.UserInfo.ID,
-		Email:           user.UserInfo.Email,
-		ApiKey:          user.UserInfo.ApiKey,
-		Role:            user.UserInfo.Role,
-		Language:        user.UserInfo.Language,
-		Balance:         user.UserInfo.Balance,
-		AvailableModels: user.Models,
-		UpdatedAt:       user.UserInfo.UpdatedAt.Format(time.RFC3339),
-		AllowIPs:        strings.Split(user.UserInfo.AllowIps, ","),
+		ID:               user.UserInfo.ID,
+		Email:            user.UserInfo.Email,
+		ApiKey:           user.UserInfo.ApiKey,
+		Role:             user.UserInfo.Role,
+		Language:         user.UserInfo.Language,
+		Balance:          user.UserInfo.Balance,
+		ReservedBalance:  BalanceReservations.UserReserved(user.UserInfo.ID),
+		AvailableModels:  user.Models,
+		UpdatedAt:        user.UserInfo.UpdatedAt.Format(time.RFC3339),
+		AllowIPs:         strings.Split(user.UserInfo.AllowIps, ","),
+		Moderated:        user.UserInfo.Moderated,
+		RpmLimit:         user.UserInfo.RpmLimit,
+		TpmLimit:         user.UserInfo.TpmLimit,
+		ConcurrencyLimit: user.UserInfo.ConcurrencyLimit,
 	}
 
 	response := http.NewBaseResponse(ctx, result, nil)
@@ -421,17 +591,50 @@ func (srv *ManagementService) UpdateWhisperUser(ctx http.Context[*entity.UpdateW
 		return
 	}
 
+	// moderated flag may be set to false, which is ignored by struct updates
+	if request.Moderated != nil {
+		if updateErr = global.WhisperUserDatabaseInstance.UpdateWhisperUserModerated(ctx, userID, *request.Moderated); updateErr != nil {
+			response := http.NewBaseResponse(ctx, &entity.WhisperUserResult{}, updateErr)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			ctx.SetResponse(&response)
+			return
+		}
+		user.Moderated = *request.Moderated
+	}
+
+	// limits may be set to zero or negative, which are ignored by struct updates
+	limits := map[string]any{}
+	if request.RpmLimit != nil {
+		limits[model.WhisperUserCols.RpmLimit], user.RpmLimit = *request.RpmLimit, *request.RpmLimit
+	}
+	if request.TpmLimit != nil {
+		limits[model.WhisperUserCols.TpmLimit], user.TpmLimit = *request.TpmLimit, *request.TpmLimit
+	}
+	if request.ConcurrencyLimit != nil {
+		limits[model.WhisperUserCols.ConcurrencyLimit], user.ConcurrencyLimit = *request.ConcurrencyLimit, *request.ConcurrencyLimit
+	}
+	if updateErr = global.WhisperUserDatabaseInstance.UpdateWhisperUserLimits(ctx, userID, limits); updateErr != nil {
+		response := http.NewBaseResponse(ctx, &entity.WhisperUserResult{}, updateErr)
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetResponse(&response)
+		return
+	}
+
 	// add api-key to bloom filter
 	if request.RefreshApiToken {
 		global.BearerTokenBloomFilterInstance.AddKeys(user.ApiKey)
 	}
 
 	result := &entity.WhisperUserResult{
-		ID:       int(user.ID),
-		ApiKey:   user.ApiKey,
-		Email:    user.Email,
-		Language: user.Language,
-		AllowIPs: request.AllowIPs,
+		ID:               int(user.ID),
+		ApiKey:           user.ApiKey,
+		Email:            user.Email,
+		Language:         user.Language,
+		AllowIPs:         request.AllowIPs,
+		Moderated:        user.Moderated,
+		RpmLimit:         user.RpmLimit,
+		TpmLimit:         user.TpmLimit,
+		ConcurrencyLimit: user.ConcurrencyLimit,
 	}
 	response := http.NewBaseResponse(ctx, result, nil)
 	ctx.SetStatusCode(http.StatusOK)
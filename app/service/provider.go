@@ -0,0 +1,270 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+	"github.com/alioth-center/infrastructure/utils/values"
+	"github.com/pkg/errors"
+)
+
+// ProviderAdapter translates openai format requests into the native api of the provider, and translates
+// the native responses back into openai format, so that the services can treat all upstreams as openai.
+type ProviderAdapter interface {
+	// Execute sends the openai format request to the provider, endpoint is the openai endpoint path
+	// relative to the base url, such as chat/completions.
+	Execute(executor http.Client, request *nethttp.Request, endpoint string) (response *nethttp.Response, err error)
+}
+
+// NewUpstream builds the openai client config and the request executor of the client with given provider,
+// requests of non-openai providers are translated by the provider adapters inside the executor.
+func NewUpstream(provider, endpoint, apiKey string) (config *openai.Config, executor http.Client) {
+	baseUrl, rawQuery, _ := strings.Cut(endpoint, "?")
+	query, _ := url.ParseQuery(rawQuery)
+
+	var adapter ProviderAdapter
+	switch provider {
+	case model.OpenaiClientProviderAzure:
+		adapter = &azureAdapter{baseUrl: strings.TrimSuffix(baseUrl, "/"), apiKey: apiKey, apiVersion: query.Get("api-version")}
+	case model.OpenaiClientProviderAnthropic:
+		adapter = &anthropicAdapter{baseUrl: strings.TrimSuffix(strings.TrimSuffix(baseUrl, "/"), "/v1"), apiKey: apiKey}
+	case model.OpenaiClientProviderGemini:
+		adapter = &geminiAdapter{baseUrl: strings.TrimSuffix(strings.TrimSuffix(baseUrl, "/"), "/v1beta"), apiKey: apiKey}
+	default:
+		return &openai.Config{ApiKey: apiKey, BaseUrl: endpoint}, global.Client
+	}
+
+	return &openai.Config{ApiKey: apiKey, BaseUrl: baseUrl}, &providerClient{baseUrl: baseUrl, adapter: adapter, executor: global.Client}
+}
+
+// IsValidProvider checks the provider is supported, empty provider is treated as openai.
+func IsValidProvider(provider string) bool {
+	switch provider {
+	case "", model.OpenaiClientProviderOpenai, model.OpenaiClientProviderAzure, model.OpenaiClientProviderAnthropic, model.OpenaiClientProviderGemini:
+		return true
+	default:
+		return false
+	}
+}
+
+// providerClient implements http.Client, requests built by openai client or raw requests are passed to the adapter.
+type providerClient struct {
+	baseUrl  string
+	adapter  ProviderAdapter
+	executor http.Client
+}
+
+func (c *providerClient) ExecuteRequest(request http.RequestBuilder) (response http.ResponseParser, err error) {
+	rawRequest, buildErr := request.Build()
+	if buildErr != nil {
+		return nil, errors.Wrap(buildErr, "build provider request failed")
+	}
+
+	rawResponse, executeErr := c.ExecuteRawRequest(rawRequest)
+	if executeErr != nil {
+		return nil, executeErr
+	}
+
+	return http.NewSimpleResponseParser(rawResponse), nil
+}
+
+func (c *providerClient) ExecuteRawRequest(request *nethttp.Request) (response *nethttp.Response, err error) {
+	basePath := ""
+	if parsed, parseErr := url.Parse(c.baseUrl); parseErr == nil {
+		basePath = strings.TrimSuffix(parsed.Path, "/")
+	}
+	endpoint := strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, basePath), "/")
+
+	return c.adapter.Execute(c.executor, request, endpoint)
+}
+
+// newProviderRequest builds a request to the provider with the context of the original request.
+func newProviderRequest(origin *nethttp.Request, method http.Method, target string, body []byte, headers map[string]string) (*nethttp.Request, error) {
+	// the logging client reads the body of every request, requests without body carry an empty one
+	var reader io.Reader = nethttp.NoBody
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	request, buildErr := nethttp.NewRequestWithContext(origin.Context(), string(method), target, reader)
+	if buildErr != nil {
+		return nil, errors.Wrap(buildErr, "build provider request failed")
+	}
+	if body != nil {
+		request.Header.Set(http.HeaderContentType, http.ContentTypeJson)
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	return request, nil
+}
+
+// newProviderJsonResponse builds an openai format json response of the request.
+func newProviderJsonResponse(request *nethttp.Request, status int, payload any) *nethttp.Response {
+	body, _ := json.Marshal(payload)
+	return &nethttp.Response{
+		Status:        nethttp.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        nethttp.Header{http.HeaderContentType: []string{http.ContentTypeJson}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
+
+// newProviderErrorResponse builds an openai format error response of the request.
+func newProviderErrorResponse(request *nethttp.Request, status int, errorType, message string) *nethttp.Response {
+	return newProviderJsonResponse(request, status, &entity.OpenaiErrorResponse{Error: entity.OpenaiError{Message: message, Type: errorType}})
+}
+
+// newProviderUnsupportedResponse builds the error response of endpoints not supported by the provider.
+func newProviderUnsupportedResponse(request *nethttp.Request, provider, endpoint string) *nethttp.Response {
+	return newProviderErrorResponse(request, http.StatusNotFound, "invalid_request_error", values.BuildStrings("endpoint ", endpoint, " is not supported by provider ", provider))
+}
+
+// newProviderUpstreamErrorResponse translates the error response of the provider into openai format, the status code is kept.
+func newProviderUpstreamErrorResponse(request *nethttp.Request, upstream *nethttp.Response) *nethttp.Response {
+	payload, _ := io.ReadAll(upstream.Body)
+	_ = upstream.Body.Close()
+
+	// anthropic and gemini both wrap the error message with error.message
+	message := strings.TrimSpace(string(payload))
+	upstreamError := struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if json.Unmarshal(payload, &upstreamError) == nil && upstreamError.Error.Message != "" {
+		message = upstreamError.Error.Message
+	}
+	if message == "" {
+		message = upstream.Status
+	}
+
+	return newProviderErrorResponse(request, upstream.StatusCode, "upstream_error", message)
+}
+
+// newProviderStreamResponse builds an openai format server sent events response, events are written by the producer.
+func newProviderStreamResponse(request *nethttp.Request, producer func(send func(payload any))) *nethttp.Response {
+	reader, writer := io.Pipe()
+	go func() {
+		producer(func(payload any) {
+			data, _ := json.Marshal(payload)
+			_, _ = writer.Write([]byte(values.BuildStrings("data: ", string(data), "\n\n")))
+		})
+		_, _ = writer.Write([]byte("data: [DONE]\n\n"))
+		_ = writer.Close()
+	}()
+
+	return &nethttp.Response{
+		Status:        nethttp.StatusText(http.StatusOK),
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        nethttp.Header{http.HeaderContentType: []string{"text/event-stream"}},
+		Body:          reader,
+		ContentLength: -1,
+		Request:       request,
+	}
+}
+
+// readProviderRequestModel reads the body of the openai format request, returns the body and the model in it,
+// the model is read from json body or the model field of multipart form.
+func readProviderRequestModel(request *nethttp.Request) (body []byte, modelName string, err error) {
+	if request.Body == nil {
+		return nil, "", nil
+	}
+
+	body, readErr := io.ReadAll(request.Body)
+	if readErr != nil {
+		return nil, "", errors.Wrap(readErr, "read provider request body failed")
+	}
+	_ = request.Body.Close()
+
+	mediaType, params, _ := mime.ParseMediaType(request.Header.Get(http.HeaderContentType))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		form, parseErr := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(32 << 20)
+		if parseErr != nil {
+			return nil, "", errors.Wrap(parseErr, "parse provider request form failed")
+		}
+		defer form.RemoveAll()
+
+		if len(form.Value["model"]) > 0 {
+			modelName = form.Value["model"][0]
+		}
+		return body, modelName, nil
+	}
+
+	payload := struct {
+		Model string `json:"model"`
+	}{}
+	_ = json.Unmarshal(body, &payload)
+	return body, payload.Model, nil
+}
+
+// chatContentParts parses the content of openai chat message, string content is parsed as a text part.
+func chatContentParts(content json.RawMessage) []entity.ChatContentPart {
+	if len(content) == 0 || string(content) == "null" {
+		return nil
+	}
+
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return []entity.ChatContentPart{{Type: "text", Text: text}}
+	}
+
+	parts := make([]entity.ChatContentPart, 0)
+	_ = json.Unmarshal(content, &parts)
+	return parts
+}
+
+// chatContentText joins the text parts of the content of openai chat message.
+func chatContentText(content json.RawMessage) string {
+	texts := make([]string, 0, 1)
+	for _, part := range chatContentParts(content) {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// parseDataUrl parses a base64 data url like data:image/png;base64,xxx, ok is false if it is not a data url.
+func parseDataUrl(dataUrl string) (mediaType, data string, ok bool) {
+	if !strings.HasPrefix(dataUrl, "data:") {
+		return "", "", false
+	}
+
+	header, data, found := strings.Cut(strings.TrimPrefix(dataUrl, "data:"), ",")
+	if !found || !strings.HasSuffix(header, ";base64") {
+		return "", "", false
+	}
+
+	return strings.TrimSuffix(header, ";base64"), data, true
+}
+
+// toolCallArguments returns the arguments of tool call as json object, invalid arguments are replaced with empty object.
+func toolCallArguments(arguments string) json.RawMessage {
+	if !json.Valid([]byte(arguments)) || !strings.HasPrefix(strings.TrimSpace(arguments), "{") {
+		return json.RawMessage("{}")
+	}
+
+	return json.RawMessage(arguments)
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	nethttp "net/http"
+	"strings"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+	"github.com/alioth-center/infrastructure/utils/values"
+	"github.com/pkg/errors"
+)
+
+const (
+	anthropicApiVersion       = "2023-06-01"
+	defaultAnthropicMaxTokens = 4096
+)
+
+// anthropicAdapter serves anthropic native messages api, chat completions and models are supported.
+//
+// Reference: https://docs.anthropic.com/en/api/messages
+type anthropicAdapter struct {
+	baseUrl string
+	apiKey  string
+}
+
+func (a *anthropicAdapter) Execute(executor http.Client, request *nethttp.Request, endpoint string) (*nethttp.Response, error) {
+	headers := map[string]string{"x-api-key": a.apiKey, "anthropic-version": anthropicApiVersion}
+
+	switch endpoint {
+	case "chat/completions":
+		chatRequest := &entity.ChatRequest{}
+		if decodeErr := json.NewDecoder(request.Body).Decode(chatRequest); decodeErr != nil {
+			return newProviderErrorResponse(request, http.StatusBadRequest, "invalid_request_error", values.BuildStrings("invalid chat request: ", decodeErr.Error())), nil
+		}
+
+		payload, _ := json.Marshal(a.buildMessageRequest(chatRequest))
+		upstreamRequest, buildErr := newProviderRequest(request, http.POST, values.BuildStrings(a.baseUrl, "/v1/messages"), payload, headers)
+		if buildErr != nil {
+			return nil, buildErr
+		}
+
+		response, executeErr := executor.ExecuteRawRequest(upstreamRequest)
+		if executeErr != nil {
+			return nil, executeErr
+		}
+		if response.StatusCode != http.StatusOK {
+			return newProviderUpstreamErrorResponse(request, response), nil
+		}
+		if chatRequest.Stream {
+			return a.streamChatResponse(request, chatRequest.Model, response.Body), nil
+		}
+		defer response.Body.Close()
+
+		result := &entity.AnthropicMessageResponse{}
+		if decodeErr := json.NewDecoder(response.Body).Decode(result); decodeErr != nil {
+			return nil, errors.Wrap(decodeErr, "decode anthropic response failed")
+		}
+
+		return newProviderJsonResponse(request, http.StatusOK, a.buildChatResponse(chatRequest.Model, result)), nil
+	case "models":
+		upstreamRequest, buildErr := newProviderRequest(request, http.GET, values.BuildStrings(a.baseUrl, "/v1/models?limit=1000"), nil, headers)
+		if buildErr != nil {
+			return nil, buildErr
+		}
+
+		response, executeErr := executor.ExecuteRawRequest(upstreamRequest)
+		if executeErr != nil {
+			return nil, executeErr
+		}
+		if response.StatusCode != http.StatusOK {
+			return newProviderUpstreamErrorResponse(request, response), nil
+		}
+		defer response.Body.Close()
+
+		models := &entity.AnthropicModelListResponse{}
+		if decodeErr := json.NewDecoder(response.Body).Decode(models); decodeErr != nil {
+			return nil, errors.Wrap(decodeErr, "decode anthropic models failed")
+		}
+
+		result := openai.ListModelResponseBody{Object: "list", Data: make([]openai.ModelObject, len(models.Data))}
+		for i, item := range models.Data {
+			result.Data[i] = openai.ModelObject{ID: item.ID, Created: item.CreatedAt.Unix(), Object: "model", OwnedBy: model.OpenaiClientProviderAnthropic}
+		}
+
+		return newProviderJsonResponse(request, http.StatusOK, result), nil
+	default:
+		return newProviderUnsupportedResponse(request, model.OpenaiClientProviderAnthropic, endpoint), nil
+	}
+}
+
+// buildMessageRequest converts openai chat request to anthropic messages request, system messages are joined
+// into the system prompt, tool results are sent as user messages and consecutive messages of the same role are merged.
+func (a *anthropicAdapter) buildMessageRequest(request *entity.ChatRequest) *entity.AnthropicMessageRequest {
+	result := &entity.AnthropicMessageRequest{
+		Model:         request.Model,
+		MaxTokens:     request.MaxTokens,
+		StopSequences: request.Stop,
+		Stream:        request.Stream,
+		Temperature:   request.Temperature,
+		TopP:          request.TopP,
+	}
+	if result.MaxTokens <= 0 {
+		result.MaxTokens = defaultAnthropicMaxTokens
+	}
+	if request.User != "" {
+		result.Metadata = &entity.AnthropicMetadata{UserID: request.User}
+	}
+
+	systems, messages := make([]string, 0), make([]entity.AnthropicMessage, 0, len(request.Messages))
+	blocksOf := make([][]entity.AnthropicContentBlock, 0, len(request.Messages))
+	for _, message := range request.Messages {
+		role, blocks := "user", make([]entity.AnthropicContentBlock, 0, 1)
+		switch message.Role {
+		case "system", "developer":
+			systems = append(systems, chatContentText(message.Content))
+			continue
+		case "tool":
+			content, _ := json.Marshal(chatContentText(message.Content))
+			blocks = append(blocks, entity.AnthropicContentBlock{Type: "tool_result", ToolUseID: message.ToolCallID, Content: content})
+		case "assistant":
+			role = "assistant"
+			if text := chatContentText(message.Content); text != "" {
+				blocks = append(blocks, entity.AnthropicContentBlock{Type: "text", Text: text})
+			}
+			for _, call := range message.ToolCalls {
+				blocks = append(blocks, entity.AnthropicContentBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: toolCallArguments(call.Function.Arguments)})
+			}
+		default:
+			for _, part := range chatContentParts(message.Content) {
+				switch part.Type {
+				case "text":
+					blocks = append(blocks, entity.AnthropicContentBlock{Type: "text", Text: part.Text})
+				case "image_url":
+					if part.ImageUrl == nil {
+						continue
+					}
+					if mediaType, data, ok := parseDataUrl(part.ImageUrl.Url); ok {
+						blocks = append(blocks, entity.AnthropicContentBlock{Type: "image", Source: &entity.AnthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}})
+					} else {
+						blocks = append(blocks, entity.AnthropicContentBlock{Type: "image", Source: &entity.AnthropicImageSource{Type: "url", Url: part.ImageUrl.Url}})
+					}
+				}
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// anthropic requires the roles alternate, merge the blocks into the previous message with the same role
+		if len(messages) > 0 && messages[len(messages)-1].Role == role {
+			blocksOf[len(blocksOf)-1] = append(blocksOf[len(blocksOf)-1], blocks...)
+			continue
+		}
+		messages = append(messages, entity.AnthropicMessage{Role: role})
+		blocksOf = append(blocksOf, blocks)
+	}
+	for i := range messages {
+		messages[i].Content, _ = json.Marshal(blocksOf[i])
+	}
+	result.Messages = messages
+	if len(systems) > 0 {
+		result.System, _ = json.Marshal(strings.Join(systems, "\n"))
+	}
+
+	for _, tool := range request.Tools {
+		schema, _ := json.Marshal(tool.Function.Parameters)
+		if tool.Function.Parameters == nil {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		result.Tools = append(result.Tools, entity.AnthropicTool{Name: tool.Function.Name, Description: tool.Function.Description, InputSchema: schema})
+	}
+	switch choice := request.ToolChoice.(type) {
+	case string:
+		switch choice {
+		case "auto":
+			result.ToolChoice = &entity.AnthropicToolChoice{Type: "auto"}
+		case "required":
+			result.ToolChoice = &entity.AnthropicToolChoice{Type: "any"}
+		case "none":
+			result.ToolChoice = &entity.AnthropicToolChoice{Type: "none"}
+		}
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			name, _ := function["name"].(string)
+			result.ToolChoice = &entity.AnthropicToolChoice{Type: "tool", Name: name}
+		}
+	}
+
+	return result
+}
+
+// buildChatResponse converts anthropic messages response to openai chat response.
+func (a *anthropicAdapter) buildChatResponse(modelName string, response *entity.AnthropicMessageResponse) *entity.ChatResponse {
+	message, texts := &entity.ChatMessage{Role: "assistant"}, make([]string, 0, 1)
+	for _, block := range response.Content {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+		case "tool_use":
+			message.ToolCalls = append(message.ToolCalls, entity.ChatToolCall{ID: block.ID, Type: "function", Function: entity.ChatToolCallFunction{Name: block.Name, Arguments: string(block.Input)}})
+		}
+	}
+	message.Content, _ = json.Marshal(strings.Join(texts, ""))
+
+	finishReason := "stop"
+	if response.StopReason != nil {
+		finishReason = a.finishReason(*response.StopReason)
+	}
+	return &entity.ChatResponse{
+		ID:      response.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   modelName,
+		Choices: []entity.ChatChoice{{Index: 0, Message: message, FinishReason: &finishReason}},
+		Usage: &openai.UsageObject{
+			PromptTokens:     response.Usage.InputTokens,
+			CompletionTokens: response.Usage.OutputTokens,
+			TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens,
+		},
+	}
+}
+
+// streamChatResponse converts anthropic message events to openai chat chunks, the last chunk carries the usage.
+func (a *anthropicAdapter) streamChatResponse(request *nethttp.Request, modelName string, body io.ReadCloser) *nethttp.Response {
+	return newProviderStreamResponse(request, func(send func(payload any)) {
+		defer body.Close()
+
+		id, created, usage := "", time.Now().Unix(), &openai.UsageObject{}
+		chunk := func(delta *entity.ChatMessage, finishReason *string) *entity.ChatResponse {
+			return &entity.ChatResponse{ID: id, Object: "chat.completion.chunk", Created: created, Model: modelName, Choices: []entity.ChatChoice{{Index: 0, Delta: delta, FinishReason: finishReason}}}
+		}
+
+		// tool calls are indexed by the order of tool_use blocks
+		toolIndexes, finishReason := map[int]int{}, "stop"
+		for event := range http.ParseServerSentEventFromBody(body, 4096, 256) {
+			payload := &entity.AnthropicStreamEvent{}
+			if json.Unmarshal(event.Data, payload) != nil {
+				continue
+			}
+
+			switch payload.Type {
+			case "message_start":
+				if payload.Message != nil {
+					id, usage.PromptTokens = payload.Message.ID, payload.Message.Usage.InputTokens
+				}
+				send(chunk(&entity.ChatMessage{Role: "assistant", Content: json.RawMessage(`""`)}, nil))
+			case "content_block_start":
+				if payload.ContentBlock != nil && payload.ContentBlock.Type == "tool_use" {
+					index := len(toolIndexes)
+					toolIndexes[payload.Index] = index
+					send(chunk(&entity.ChatMessage{ToolCalls: []entity.ChatToolCall{{Index: &index, ID: payload.ContentBlock.ID, Type: "function", Function: entity.ChatToolCallFunction{Name: payload.ContentBlock.Name}}}}, nil))
+				}
+			case "content_block_delta":
+				if payload.Delta == nil {
+					continue
+				}
+				switch payload.Delta.Type {
+				case "text_delta":
+					content, _ := json.Marshal(payload.Delta.Text)
+					send(chunk(&entity.ChatMessage{Content: content}, nil))
+				case "input_json_delta":
+					index := toolIndexes[payload.Index]
+					send(chunk(&entity.ChatMessage{ToolCalls: []entity.ChatToolCall{{Index: &index, Function: entity.ChatToolCallFunction{Arguments: payload.Delta.PartialJson}}}}, nil))
+				}
+			case "message_delta":
+				if payload.Delta != nil && payload.Delta.StopReason != "" {
+					finishReason = a.finishReason(payload.Delta.StopReason)
+				}
+				if payload.Usage != nil {
+					usage.CompletionTokens = payload.Usage.OutputTokens
+				}
+			}
+		}
+
+		send(chunk(&entity.ChatMessage{}, &finishReason))
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		send(&entity.ChatResponse{ID: id, Object: "chat.completion.chunk", Created: created, Model: modelName, Choices: []entity.ChatChoice{}, Usage: usage})
+	})
+}
+
+func (a *anthropicAdapter) finishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
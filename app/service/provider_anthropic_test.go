@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+)
+
+const anthropicTestStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":12,"output_tokens":1}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"weather"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":\"Paris\"}"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":7}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+func TestAnthropicAdapter_Execute(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      http.Method
+		path        string
+		body        string
+		status      int
+		contentType string
+		response    string
+		target      string
+		checkSent   func(t *testing.T, request providerRequest)
+		checkResult func(t *testing.T, status int, payload []byte)
+	}{
+		{
+			name:        "chat completions",
+			method:      http.POST,
+			path:        "chat/completions",
+			body:        `{"model":"claude-3-5-sonnet","messages":[{"role":"system","content":"be brief"},{"role":"developer","content":"be kind"},{"role":"user","content":"hi"}],"user":"u1"}`,
+			status:      http.StatusOK,
+			contentType: http.ContentTypeJson,
+			response:    `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"Hello"}],"stop_reason":"max_tokens","usage":{"input_tokens":12,"output_tokens":7}}`,
+			target:      "/v1/messages",
+			checkSent: func(t *testing.T, request providerRequest) {
+				sent := &entity.AnthropicMessageRequest{}
+				if json.Unmarshal(request.Body, sent) != nil {
+					t.Fatalf("request = %s, expected anthropic messages request", request.Body)
+				}
+				if sent.Model != "claude-3-5-sonnet" || sent.MaxTokens != defaultAnthropicMaxTokens || string(sent.System) != `"be brief\nbe kind"` {
+					t.Errorf("request = %s, expected system prompts joined and default max tokens", request.Body)
+				}
+				if len(sent.Messages) != 1 || sent.Messages[0].Role != "user" || string(sent.Messages[0].Content) != `[{"type":"text","text":"hi"}]` {
+					t.Errorf("messages = %+v, expected the user message only", sent.Messages)
+				}
+				if sent.Metadata == nil || sent.Metadata.UserID != "u1" {
+					t.Errorf("metadata = %+v, expected user u1", sent.Metadata)
+				}
+			},
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				result := &entity.ChatResponse{}
+				if status != http.StatusOK || json.Unmarshal(payload, result) != nil || len(result.Choices) != 1 {
+					t.Fatalf("response = %d %s, expected chat response", status, payload)
+				}
+				if result.Object != "chat.completion" || result.Model != "claude-3-5-sonnet" || string(result.Choices[0].Message.Content) != `"Hello"` {
+					t.Errorf("response = %s, expected the text of the message", payload)
+				}
+				if result.Choices[0].FinishReason == nil || *result.Choices[0].FinishReason != "length" {
+					t.Errorf("finish reason = %v, expected length", result.Choices[0].FinishReason)
+				}
+				if result.Usage == nil || *result.Usage != (openai.UsageObject{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19}) {
+					t.Errorf("usage = %+v, expected 12 + 7 tokens", result.Usage)
+				}
+			},
+		},
+		{
+			name:        "streaming chat completions",
+			method:      http.POST,
+			path:        "chat/completions",
+			body:        `{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"hi"}],"max_tokens":100,"stream":true}`,
+			status:      http.StatusOK,
+			contentType: "text/event-stream",
+			response:    anthropicTestStream,
+			target:      "/v1/messages",
+			checkSent: func(t *testing.T, request providerRequest) {
+				sent := &entity.AnthropicMessageRequest{}
+				if json.Unmarshal(request.Body, sent) != nil || !sent.Stream || sent.MaxTokens != 100 {
+					t.Errorf("request = %s, expected streaming request with max tokens 100", request.Body)
+				}
+			},
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				events := streamPayloads(payload)
+				if status != http.StatusOK || len(events) != 7 || events[len(events)-1] != "[DONE]" {
+					t.Fatalf("response = %d %s, expected 6 chunks and done", status, payload)
+				}
+
+				chunks := make([]*entity.ChatResponse, len(events)-1)
+				for i, event := range events[:len(events)-1] {
+					chunks[i] = &entity.ChatResponse{}
+					if json.Unmarshal([]byte(event), chunks[i]) != nil || chunks[i].ID != "msg_1" || chunks[i].Object != "chat.completion.chunk" {
+						t.Fatalf("chunk = %s, expected chat chunk of msg_1", event)
+					}
+				}
+				if chunks[0].Choices[0].Delta.Role != "assistant" || string(chunks[1].Choices[0].Delta.Content) != `"Hello"` {
+					t.Errorf("chunks = %s, expected role and text", payload)
+				}
+				if calls := chunks[2].Choices[0].Delta.ToolCalls; len(calls) != 1 || calls[0].ID != "toolu_1" || calls[0].Function.Name != "weather" || *calls[0].Index != 0 {
+					t.Errorf("tool call = %+v, expected weather call", calls)
+				}
+				if calls := chunks[3].Choices[0].Delta.ToolCalls; len(calls) != 1 || calls[0].Function.Arguments != `{"city":"Paris"}` {
+					t.Errorf("tool call arguments = %+v, expected city Paris", calls)
+				}
+				if reason := chunks[4].Choices[0].FinishReason; reason == nil || *reason != "tool_calls" {
+					t.Errorf("finish reason = %v, expected tool_calls", reason)
+				}
+				if len(chunks[5].Choices) != 0 || chunks[5].Usage == nil || *chunks[5].Usage != (openai.UsageObject{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19}) {
+					t.Errorf("last chunk = %s, expected usage only", events[5])
+				}
+			},
+		},
+		{
+			name:        "upstream error",
+			method:      http.POST,
+			path:        "chat/completions",
+			body:        `{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"hi"}]}`,
+			status:      http.StatusTooManyRequests,
+			contentType: http.ContentTypeJson,
+			response:    `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`,
+			target:      "/v1/messages",
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				result := &entity.OpenaiErrorResponse{}
+				if status != http.StatusTooManyRequests || json.Unmarshal(payload, result) != nil || result.Error.Message != "slow down" {
+					t.Errorf("response = %d %s, expected 429 with the message of anthropic", status, payload)
+				}
+			},
+		},
+		{
+			name:        "models",
+			method:      http.GET,
+			path:        "models",
+			status:      http.StatusOK,
+			contentType: http.ContentTypeJson,
+			response:    `{"data":[{"id":"claude-3-5-sonnet","display_name":"Claude 3.5 Sonnet","created_at":"2024-10-22T00:00:00Z"}],"has_more":false}`,
+			target:      "/v1/models",
+			checkSent: func(t *testing.T, request providerRequest) {
+				if request.Query.Get("limit") != "1000" {
+					t.Errorf("query = %s, expected limit 1000", request.Query.Encode())
+				}
+			},
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				result := &openai.ListModelResponseBody{}
+				if status != http.StatusOK || json.Unmarshal(payload, result) != nil || len(result.Data) != 1 {
+					t.Fatalf("response = %d %s, expected one model", status, payload)
+				}
+				if result.Data[0].ID != "claude-3-5-sonnet" || result.Data[0].OwnedBy != model.OpenaiClientProviderAnthropic || result.Data[0].Created != 1729555200 {
+					t.Errorf("model = %+v, expected claude-3-5-sonnet owned by anthropic", result.Data[0])
+				}
+			},
+		},
+		{
+			name:   "unsupported endpoint",
+			method: http.POST,
+			path:   "embeddings",
+			body:   `{"model":"claude-3-5-sonnet","input":"hi"}`,
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				if status != http.StatusNotFound {
+					t.Errorf("response = %d %s, expected 404", status, payload)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newProviderUpstream(t, tt.status, tt.contentType, tt.response)
+			status, payload := executeProvider(t, model.OpenaiClientProviderAnthropic, upstream.URL, "anthropic-key", tt.method, tt.path, http.ContentTypeJson, []byte(tt.body))
+			tt.checkResult(t, status, payload)
+
+			received := upstream.received()
+			if tt.target == "" {
+				if len(received) != 0 {
+					t.Errorf("upstream called %d times, expected none", len(received))
+				}
+				return
+			}
+			if len(received) != 1 {
+				t.Fatalf("upstream called %d times, expected once", len(received))
+			}
+
+			request := received[0]
+			if request.Method != string(tt.method) || request.Path != tt.target {
+				t.Errorf("request = %s %s, expected %s %s", request.Method, request.Path, tt.method, tt.target)
+			}
+			if request.Header.Get("x-api-key") != "anthropic-key" || request.Header.Get("anthropic-version") != anthropicApiVersion || request.Header.Get(http.HeaderAuthorization) != "" {
+				t.Errorf("headers = %v, expected x-api-key and anthropic-version only", request.Header)
+			}
+			if tt.checkSent != nil {
+				tt.checkSent(t, request)
+			}
+		})
+	}
+}
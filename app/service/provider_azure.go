@@ -0,0 +1,53 @@
+package service
+
+import (
+	"bytes"
+	nethttp "net/http"
+	"net/url"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/utils/values"
+)
+
+const defaultAzureApiVersion = "2024-06-01"
+
+// azureAdapter serves azure openai, the request and response bodies are openai format already,
+// only the url and the authorization header differ, the model name is used as the deployment name.
+//
+// Reference: https://learn.microsoft.com/en-us/azure/ai-services/openai/reference
+type azureAdapter struct {
+	baseUrl    string
+	apiKey     string
+	apiVersion string
+}
+
+func (a *azureAdapter) Execute(executor http.Client, request *nethttp.Request, endpoint string) (*nethttp.Response, error) {
+	apiVersion := a.apiVersion
+	if apiVersion == "" {
+		apiVersion = defaultAzureApiVersion
+	}
+	query := url.Values{"api-version": []string{apiVersion}}.Encode()
+
+	body, modelName, readErr := readProviderRequestModel(request)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	target := values.BuildStrings(a.baseUrl, "/openai/deployments/", url.PathEscape(modelName), "/", endpoint, "?", query)
+	if endpoint == "models" {
+		target = values.BuildStrings(a.baseUrl, "/openai/models?", query)
+	} else if modelName == "" {
+		return newProviderErrorResponse(request, http.StatusBadRequest, "invalid_request_error", "model is required by provider "+model.OpenaiClientProviderAzure), nil
+	}
+
+	upstreamRequest, buildErr := nethttp.NewRequestWithContext(request.Context(), request.Method, target, bytes.NewReader(body))
+	if buildErr != nil {
+		return nil, buildErr
+	}
+	upstreamRequest.Header = request.Header.Clone()
+	upstreamRequest.Header.Del(http.HeaderAuthorization)
+	upstreamRequest.Header.Set("api-key", a.apiKey)
+
+	return executor.ExecuteRawRequest(upstreamRequest)
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/network/http"
+)
+
+func TestAzureAdapter_Execute(t *testing.T) {
+	form := &bytes.Buffer{}
+	formBody, formType, _ := http.NewMultipartBodyBuilder().WithFile("file", "audio.mp3", bytes.NewReader([]byte("audio"))).WithForm("model", "whisper-1").Build()
+	_, _ = form.ReadFrom(formBody)
+
+	tests := []struct {
+		name        string
+		query       string
+		method      http.Method
+		path        string
+		contentType string
+		body        []byte
+		status      int
+		upstream    bool
+		target      string
+		apiVersion  string
+	}{
+		{
+			name:        "chat completions",
+			method:      http.POST,
+			path:        "chat/completions",
+			contentType: http.ContentTypeJson,
+			body:        []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`),
+			status:      http.StatusOK,
+			upstream:    true,
+			target:      "/openai/deployments/gpt-4o/chat/completions",
+			apiVersion:  defaultAzureApiVersion,
+		},
+		{
+			name:        "api version of endpoint",
+			query:       "?api-version=2024-10-21",
+			method:      http.POST,
+			path:        "embeddings",
+			contentType: http.ContentTypeJson,
+			body:        []byte(`{"model":"text-embedding-3-small","input":"hi"}`),
+			status:      http.StatusOK,
+			upstream:    true,
+			target:      "/openai/deployments/text-embedding-3-small/embeddings",
+			apiVersion:  "2024-10-21",
+		},
+		{
+			name:        "model of multipart form",
+			method:      http.POST,
+			path:        "audio/transcriptions",
+			contentType: formType,
+			body:        form.Bytes(),
+			status:      http.StatusOK,
+			upstream:    true,
+			target:      "/openai/deployments/whisper-1/audio/transcriptions",
+			apiVersion:  defaultAzureApiVersion,
+		},
+		{
+			name:       "models",
+			method:     http.GET,
+			path:       "models",
+			status:     http.StatusOK,
+			upstream:   true,
+			target:     "/openai/models",
+			apiVersion: defaultAzureApiVersion,
+		},
+		{
+			name:        "missing model",
+			method:      http.POST,
+			path:        "chat/completions",
+			contentType: http.ContentTypeJson,
+			body:        []byte(`{"messages":[{"role":"user","content":"hi"}]}`),
+			status:      http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newProviderUpstream(t, http.StatusOK, http.ContentTypeJson, `{"id":"chatcmpl-1","object":"chat.completion"}`)
+			status, payload := executeProvider(t, model.OpenaiClientProviderAzure, upstream.URL+tt.query, "azure-key", tt.method, tt.path, tt.contentType, tt.body)
+			if status != tt.status {
+				t.Fatalf("status = %d, expected %d, body %s", status, tt.status, payload)
+			}
+
+			received := upstream.received()
+			if !tt.upstream {
+				if len(received) != 0 {
+					t.Errorf("upstream called %d times, expected none", len(received))
+				}
+				return
+			}
+			if len(received) != 1 {
+				t.Fatalf("upstream called %d times, expected once", len(received))
+			}
+
+			// azure accepts openai format, only the url and the authorization differ
+			request := received[0]
+			if request.Method != string(tt.method) || request.Path != tt.target || request.Query.Get("api-version") != tt.apiVersion {
+				t.Errorf("request = %s %s?%s, expected %s %s?api-version=%s", request.Method, request.Path, request.Query.Encode(), tt.method, tt.target, tt.apiVersion)
+			}
+			if request.Header.Get("api-key") != "azure-key" || request.Header.Get(http.HeaderAuthorization) != "" {
+				t.Errorf("api-key = %q, authorization = %q, expected api-key only", request.Header.Get("api-key"), request.Header.Get(http.HeaderAuthorization))
+			}
+			if !bytes.Equal(request.Body, tt.body) {
+				t.Errorf("body = %s, expected %s", request.Body, tt.body)
+			}
+			if string(payload) != `{"id":"chatcmpl-1","object":"chat.completion"}` {
+				t.Errorf("response = %s, expected the upstream response as is", payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	nethttp "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+	"github.com/alioth-center/infrastructure/utils/values"
+	"github.com/pkg/errors"
+)
+
+// geminiAdapter serves google gemini native api, chat completions, embeddings and models are supported.
+//
+// Reference: https://ai.google.dev/api
+type geminiAdapter struct {
+	baseUrl string
+	apiKey  string
+}
+
+func (a *geminiAdapter) Execute(executor http.Client, request *nethttp.Request, endpoint string) (*nethttp.Response, error) {
+	headers := map[string]string{"x-goog-api-key": a.apiKey}
+
+	switch endpoint {
+	case "chat/completions":
+		chatRequest := &entity.ChatRequest{}
+		if decodeErr := json.NewDecoder(request.Body).Decode(chatRequest); decodeErr != nil {
+			return newProviderErrorResponse(request, http.StatusBadRequest, "invalid_request_error", values.BuildStrings("invalid chat request: ", decodeErr.Error())), nil
+		}
+
+		target := values.BuildStrings(a.baseUrl, "/v1beta/models/", url.PathEscape(chatRequest.Model), ":generateContent")
+		if chatRequest.Stream {
+			target = values.BuildStrings(a.baseUrl, "/v1beta/models/", url.PathEscape(chatRequest.Model), ":streamGenerateContent?alt=sse")
+		}
+		payload, _ := json.Marshal(a.buildGenerateContentRequest(chatRequest))
+		response, executeErr := a.execute(executor, request, http.POST, target, payload, headers)
+		if executeErr != nil || response.StatusCode != http.StatusOK {
+			return response, executeErr
+		}
+		if chatRequest.Stream {
+			return a.streamChatResponse(request, chatRequest.Model, response.Body), nil
+		}
+		defer response.Body.Close()
+
+		result := &entity.GeminiGenerateContentResponse{}
+		if decodeErr := json.NewDecoder(response.Body).Decode(result); decodeErr != nil {
+			return nil, errors.Wrap(decodeErr, "decode gemini response failed")
+		}
+
+		return newProviderJsonResponse(request, http.StatusOK, a.buildChatResponse(chatRequest.Model, time.Now().Unix(), result, false)), nil
+	case "embeddings":
+		embeddingRequest := &struct {
+			Model string          `json:"model"`
+			Input json.RawMessage `json:"input"`
+		}{}
+		if decodeErr := json.NewDecoder(request.Body).Decode(embeddingRequest); decodeErr != nil {
+			return newProviderErrorResponse(request, http.StatusBadRequest, "invalid_request_error", values.BuildStrings("invalid embedding request: ", decodeErr.Error())), nil
+		}
+
+		// input can be a string or an array of strings
+		inputs := make([]string, 0, 1)
+		if json.Unmarshal(embeddingRequest.Input, &inputs) != nil {
+			var input string
+			_ = json.Unmarshal(embeddingRequest.Input, &input)
+			inputs = []string{input}
+		}
+
+		embedRequest := &entity.GeminiBatchEmbedRequest{Requests: make([]entity.GeminiEmbedRequest, len(inputs))}
+		for i, input := range inputs {
+			embedRequest.Requests[i] = entity.GeminiEmbedRequest{Model: values.BuildStrings("models/", embeddingRequest.Model), Content: entity.GeminiContent{Parts: []entity.GeminiPart{{Text: input}}}}
+		}
+		payload, _ := json.Marshal(embedRequest)
+		target := values.BuildStrings(a.baseUrl, "/v1beta/models/", url.PathEscape(embeddingRequest.Model), ":batchEmbedContents")
+		response, executeErr := a.execute(executor, request, http.POST, target, payload, headers)
+		if executeErr != nil || response.StatusCode != http.StatusOK {
+			return response, executeErr
+		}
+		defer response.Body.Close()
+
+		embeddings := &entity.GeminiBatchEmbedResponse{}
+		if decodeErr := json.NewDecoder(response.Body).Decode(embeddings); decodeErr != nil {
+			return nil, errors.Wrap(decodeErr, "decode gemini embeddings failed")
+		}
+
+		// gemini does not return usage of embeddings, calculate it locally
+		promptToken := int(CalculatePromptToken(inputs...))
+		result := openai.EmbeddingResponseBody{Object: "list", Model: embeddingRequest.Model, Data: make([]openai.EmbeddingDataItem, len(embeddings.Embeddings)), Usage: openai.UsageObject{PromptTokens: promptToken, TotalTokens: promptToken}}
+		for i, embedding := range embeddings.Embeddings {
+			result.Data[i] = openai.EmbeddingDataItem{Object: "embedding", Embedding: embedding.Values, Index: i}
+		}
+
+		return newProviderJsonResponse(request, http.StatusOK, result), nil
+	case "models":
+		response, executeErr := a.execute(executor, request, http.GET, values.BuildStrings(a.baseUrl, "/v1beta/models?pageSize=1000"), nil, headers)
+		if executeErr != nil || response.StatusCode != http.StatusOK {
+			return response, executeErr
+		}
+		defer response.Body.Close()
+
+		models := &entity.GeminiModelListResponse{}
+		if decodeErr := json.NewDecoder(response.Body).Decode(models); decodeErr != nil {
+			return nil, errors.Wrap(decodeErr, "decode gemini models failed")
+		}
+
+		result := openai.ListModelResponseBody{Object: "list", Data: make([]openai.ModelObject, len(models.Models))}
+		for i, item := range models.Models {
+			result.Data[i] = openai.ModelObject{ID: strings.TrimPrefix(item.Name, "models/"), Object: "model", OwnedBy: model.OpenaiClientProviderGemini}
+		}
+
+		return newProviderJsonResponse(request, http.StatusOK, result), nil
+	default:
+		return newProviderUnsupportedResponse(request, model.OpenaiClientProviderGemini, endpoint), nil
+	}
+}
+
+// execute sends the request to gemini, error responses are translated into openai format.
+func (a *geminiAdapter) execute(executor http.Client, origin *nethttp.Request, method http.Method, target string, payload []byte, headers map[string]string) (*nethttp.Response, error) {
+	upstreamRequest, buildErr := newProviderRequest(origin, method, target, payload, headers)
+	if buildErr != nil {
+		return nil, buildErr
+	}
+
+	response, executeErr := executor.ExecuteRawRequest(upstreamRequest)
+	if executeErr != nil {
+		return nil, executeErr
+	}
+	if response.StatusCode != http.StatusOK {
+		return newProviderUpstreamErrorResponse(origin, response), nil
+	}
+
+	return response, nil
+}
+
+// buildGenerateContentRequest converts openai chat request to gemini generate content request, system messages
+// are joined into the system instruction and tool results are sent as function responses of user.
+func (a *geminiAdapter) buildGenerateContentRequest(request *entity.ChatRequest) *entity.GeminiGenerateContentRequest {
+	result := &entity.GeminiGenerateContentRequest{Contents: make([]entity.GeminiContent, 0, len(request.Messages))}
+	if request.Temperature != nil || request.TopP != nil || request.MaxTokens > 0 || len(request.Stop) > 0 {
+		result.GenerationConfig = &entity.GeminiGenerationConfig{Temperature: request.Temperature, TopP: request.TopP, MaxOutputTokens: request.MaxTokens, StopSequences: request.Stop}
+	}
+
+	// function response of gemini is matched by name, while openai matches tool result by tool call id
+	systems, toolNames := make([]string, 0), map[string]string{}
+	for _, message := range request.Messages {
+		role, parts := "user", make([]entity.GeminiPart, 0, 1)
+		switch message.Role {
+		case "system", "developer":
+			systems = append(systems, chatContentText(message.Content))
+			continue
+		case "tool":
+			response := json.RawMessage(chatContentText(message.Content))
+			if !json.Valid(response) || !strings.HasPrefix(strings.TrimSpace(string(response)), "{") {
+				response, _ = json.Marshal(map[string]string{"content": string(response)})
+			}
+			parts = append(parts, entity.GeminiPart{FunctionResponse: &entity.GeminiFunctionResponse{Name: toolNames[message.ToolCallID], Response: response}})
+		case "assistant":
+			role = "model"
+			if text := chatContentText(message.Content); text != "" {
+				parts = append(parts, entity.GeminiPart{Text: text})
+			}
+			for _, call := range message.ToolCalls {
+				toolNames[call.ID] = call.Function.Name
+				parts = append(parts, entity.GeminiPart{FunctionCall: &entity.GeminiFunctionCall{Name: call.Function.Name, Args: toolCallArguments(call.Function.Arguments)}})
+			}
+		default:
+			for _, part := range chatContentParts(message.Content) {
+				switch part.Type {
+				case "text":
+					parts = append(parts, entity.GeminiPart{Text: part.Text})
+				case "image_url":
+					if part.ImageUrl == nil {
+						continue
+					}
+					if mediaType, data, ok := parseDataUrl(part.ImageUrl.Url); ok {
+						parts = append(parts, entity.GeminiPart{InlineData: &entity.GeminiInlineData{MimeType: mediaType, Data: data}})
+					} else {
+						parts = append(parts, entity.GeminiPart{FileData: &entity.GeminiFileData{FileUri: part.ImageUrl.Url}})
+					}
+				}
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+
+		// merge the parts into the previous content with the same role, parallel tool results must be in one content
+		if len(result.Contents) > 0 && result.Contents[len(result.Contents)-1].Role == role {
+			result.Contents[len(result.Contents)-1].Parts = append(result.Contents[len(result.Contents)-1].Parts, parts...)
+			continue
+		}
+		result.Contents = append(result.Contents, entity.GeminiContent{Role: role, Parts: parts})
+	}
+	if len(systems) > 0 {
+		result.SystemInstruction = &entity.GeminiContent{Parts: []entity.GeminiPart{{Text: strings.Join(systems, "\n")}}}
+	}
+
+	if len(request.Tools) > 0 {
+		declarations := make([]entity.GeminiFunctionDeclaration, len(request.Tools))
+		for i, tool := range request.Tools {
+			declarations[i] = entity.GeminiFunctionDeclaration{Name: tool.Function.Name, Description: tool.Function.Description, Parameters: tool.Function.Parameters}
+		}
+		result.Tools = []entity.GeminiTool{{FunctionDeclarations: declarations}}
+	}
+	switch choice := request.ToolChoice.(type) {
+	case string:
+		switch choice {
+		case "auto":
+			result.ToolConfig = &entity.GeminiToolConfig{FunctionCallingConfig: entity.GeminiFunctionCallingConfig{Mode: "AUTO"}}
+		case "required":
+			result.ToolConfig = &entity.GeminiToolConfig{FunctionCallingConfig: entity.GeminiFunctionCallingConfig{Mode: "ANY"}}
+		case "none":
+			result.ToolConfig = &entity.GeminiToolConfig{FunctionCallingConfig: entity.GeminiFunctionCallingConfig{Mode: "NONE"}}
+		}
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			name, _ := function["name"].(string)
+			result.ToolConfig = &entity.GeminiToolConfig{FunctionCallingConfig: entity.GeminiFunctionCallingConfig{Mode: "ANY", AllowedFunctionNames: []string{name}}}
+		}
+	}
+
+	return result
+}
+
+// buildChatResponse converts gemini response to openai chat response, or to a chat chunk if chunk is true.
+func (a *geminiAdapter) buildChatResponse(modelName string, created int64, response *entity.GeminiGenerateContentResponse, chunk bool) *entity.ChatResponse {
+	result := &entity.ChatResponse{ID: values.BuildStrings("chatcmpl-", strconv.FormatInt(created, 10)), Object: "chat.completion", Created: created, Model: modelName, Choices: make([]entity.ChatChoice, 0, len(response.Candidates))}
+	if chunk {
+		result.Object = "chat.completion.chunk"
+	}
+	if response.UsageMetadata != nil {
+		result.Usage = &openai.UsageObject{
+			PromptTokens:     response.UsageMetadata.PromptTokenCount,
+			CompletionTokens: response.UsageMetadata.CandidatesTokenCount,
+			TotalTokens:      response.UsageMetadata.TotalTokenCount,
+		}
+	}
+
+	for _, candidate := range response.Candidates {
+		message, texts := &entity.ChatMessage{Role: "assistant"}, make([]string, 0, 1)
+		for _, part := range candidate.Content.Parts {
+			if part.FunctionCall != nil {
+				index, arguments := len(message.ToolCalls), string(part.FunctionCall.Args)
+				if arguments == "" {
+					arguments = "{}"
+				}
+				call := entity.ChatToolCall{ID: values.BuildStrings("call_", strconv.FormatInt(created, 10), "_", strconv.Itoa(index)), Type: "function", Function: entity.ChatToolCallFunction{Name: part.FunctionCall.Name, Arguments: arguments}}
+				if chunk {
+					call.Index = &index
+				}
+				message.ToolCalls = append(message.ToolCalls, call)
+			} else if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+		}
+		message.Content, _ = json.Marshal(strings.Join(texts, ""))
+
+		choice := entity.ChatChoice{Index: candidate.Index}
+		if chunk {
+			choice.Delta = message
+		} else {
+			choice.Message = message
+		}
+		if candidate.FinishReason != "" {
+			finishReason := a.finishReason(candidate.FinishReason)
+			if len(message.ToolCalls) > 0 && finishReason == "stop" {
+				finishReason = "tool_calls"
+			}
+			choice.FinishReason = &finishReason
+		}
+		result.Choices = append(result.Choices, choice)
+	}
+
+	return result
+}
+
+// streamChatResponse converts gemini streaming responses to openai chat chunks, the last chunk carries the usage.
+func (a *geminiAdapter) streamChatResponse(request *nethttp.Request, modelName string, body io.ReadCloser) *nethttp.Response {
+	return newProviderStreamResponse(request, func(send func(payload any)) {
+		defer body.Close()
+
+		// usage metadata of gemini is cumulative, only the last one is sent
+		created, usage := time.Now().Unix(), (*openai.UsageObject)(nil)
+		for event := range http.ParseServerSentEventFromBody(body, 4096, 256) {
+			payload := &entity.GeminiGenerateContentResponse{}
+			if json.Unmarshal(event.Data, payload) != nil {
+				continue
+			}
+
+			chunk := a.buildChatResponse(modelName, created, payload, true)
+			if chunk.Usage != nil {
+				usage, chunk.Usage = chunk.Usage, nil
+			}
+			if len(chunk.Choices) > 0 {
+				send(chunk)
+			}
+		}
+
+		if usage != nil {
+			send(&entity.ChatResponse{ID: values.BuildStrings("chatcmpl-", strconv.FormatInt(created, 10)), Object: "chat.completion.chunk", Created: created, Model: modelName, Choices: []entity.ChatChoice{}, Usage: usage})
+		}
+	})
+}
+
+func (a *geminiAdapter) finishReason(finishReason string) string {
+	switch finishReason {
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alioth-center/akasha-whisper/app/entity"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/alioth-center/infrastructure/thirdparty/openai"
+)
+
+const geminiTestStream = `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]},"index":0}],"usageMetadata":{"promptTokenCount":12,"candidatesTokenCount":1,"totalTokenCount":13}}
+
+data: {"candidates":[{"content":{"role":"model","parts":[{"text":"lo"}]},"finishReason":"MAX_TOKENS","index":0}],"usageMetadata":{"promptTokenCount":12,"candidatesTokenCount":7,"totalTokenCount":19}}
+
+`
+
+func TestGeminiAdapter_Execute(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      http.Method
+		path        string
+		body        string
+		status      int
+		contentType string
+		response    string
+		target      string
+		query       string
+		checkSent   func(t *testing.T, request providerRequest)
+		checkResult func(t *testing.T, status int, payload []byte)
+	}{
+		{
+			name:        "chat completions",
+			method:      http.POST,
+			path:        "chat/completions",
+			body:        `{"model":"gemini-1.5-pro","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"weather?"}],"max_tokens":100}`,
+			status:      http.StatusOK,
+			contentType: http.ContentTypeJson,
+			response:    `{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"weather","args":{"city":"Paris"}}}]},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":12,"candidatesTokenCount":7,"totalTokenCount":19}}`,
+			target:      "/v1beta/models/gemini-1.5-pro:generateContent",
+			checkSent: func(t *testing.T, request providerRequest) {
+				sent := &entity.GeminiGenerateContentRequest{}
+				if json.Unmarshal(request.Body, sent) != nil {
+					t.Fatalf("request = %s, expected gemini generate content request", request.Body)
+				}
+				if sent.SystemInstruction == nil || len(sent.SystemInstruction.Parts) != 1 || sent.SystemInstruction.Parts[0].Text != "be brief" {
+					t.Errorf("system instruction = %+v, expected be brief", sent.SystemInstruction)
+				}
+				roles := make([]string, len(sent.Contents))
+				for i, content := range sent.Contents {
+					roles[i] = content.Role
+				}
+				if len(roles) != 3 || roles[0] != "user" || roles[1] != "model" || roles[2] != "user" || sent.Contents[2].Parts[0].Text != "weather?" {
+					t.Errorf("contents = %s, expected user, model and user", request.Body)
+				}
+				if sent.GenerationConfig == nil || sent.GenerationConfig.MaxOutputTokens != 100 {
+					t.Errorf("generation config = %+v, expected max output tokens 100", sent.GenerationConfig)
+				}
+			},
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				result := &entity.ChatResponse{}
+				if status != http.StatusOK || json.Unmarshal(payload, result) != nil || len(result.Choices) != 1 {
+					t.Fatalf("response = %d %s, expected chat response", status, payload)
+				}
+				calls := result.Choices[0].Message.ToolCalls
+				if result.Object != "chat.completion" || len(calls) != 1 || calls[0].Function.Name != "weather" || calls[0].Function.Arguments != `{"city":"Paris"}` {
+					t.Errorf("response = %s, expected weather call", payload)
+				}
+				if result.Choices[0].FinishReason == nil || *result.Choices[0].FinishReason != "tool_calls" {
+					t.Errorf("finish reason = %v, expected tool_calls", result.Choices[0].FinishReason)
+				}
+				if result.Usage == nil || *result.Usage != (openai.UsageObject{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19}) {
+					t.Errorf("usage = %+v, expected 12 + 7 tokens", result.Usage)
+				}
+			},
+		},
+		{
+			name:        "streaming chat completions",
+			method:      http.POST,
+			path:        "chat/completions",
+			body:        `{"model":"gemini-1.5-pro","messages":[{"role":"user","content":"hi"}],"stream":true}`,
+			status:      http.StatusOK,
+			contentType: "text/event-stream",
+			response:    geminiTestStream,
+			target:      "/v1beta/models/gemini-1.5-pro:streamGenerateContent",
+			query:       "alt=sse",
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				events := streamPayloads(payload)
+				if status != http.StatusOK || len(events) != 4 || events[3] != "[DONE]" {
+					t.Fatalf("response = %d %s, expected 3 chunks and done", status, payload)
+				}
+
+				chunks := make([]*entity.ChatResponse, 3)
+				for i, event := range events[:3] {
+					chunks[i] = &entity.ChatResponse{}
+					if json.Unmarshal([]byte(event), chunks[i]) != nil || chunks[i].Object != "chat.completion.chunk" {
+						t.Fatalf("chunk = %s, expected chat chunk", event)
+					}
+				}
+				if chunks[0].Usage != nil || string(chunks[0].Choices[0].Delta.Content) != `"Hel"` || string(chunks[1].Choices[0].Delta.Content) != `"lo"` {
+					t.Errorf("chunks = %s, expected text without usage", payload)
+				}
+				if reason := chunks[1].Choices[0].FinishReason; reason == nil || *reason != "length" {
+					t.Errorf("finish reason = %v, expected length", reason)
+				}
+				if len(chunks[2].Choices) != 0 || chunks[2].Usage == nil || *chunks[2].Usage != (openai.UsageObject{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19}) {
+					t.Errorf("last chunk = %s, expected the last usage only", events[2])
+				}
+			},
+		},
+		{
+			name:        "embeddings",
+			method:      http.POST,
+			path:        "embeddings",
+			body:        `{"model":"text-embedding-004","input":["hello","world"]}`,
+			status:      http.StatusOK,
+			contentType: http.ContentTypeJson,
+			response:    `{"embeddings":[{"values":[0.1,0.2]},{"values":[0.3,0.4]}]}`,
+			target:      "/v1beta/models/text-embedding-004:batchEmbedContents",
+			checkSent: func(t *testing.T, request providerRequest) {
+				sent := &entity.GeminiBatchEmbedRequest{}
+				if json.Unmarshal(request.Body, sent) != nil || len(sent.Requests) != 2 {
+					t.Fatalf("request = %s, expected two embed requests", request.Body)
+				}
+				if sent.Requests[0].Model != "models/text-embedding-004" || sent.Requests[1].Content.Parts[0].Text != "world" {
+					t.Errorf("request = %s, expected models/text-embedding-004 of each input", request.Body)
+				}
+			},
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				result := &openai.EmbeddingResponseBody{}
+				if status != http.StatusOK || json.Unmarshal(payload, result) != nil || len(result.Data) != 2 {
+					t.Fatalf("response = %d %s, expected two embeddings", status, payload)
+				}
+				if result.Data[1].Index != 1 || len(result.Data[1].Embedding) != 2 || result.Data[1].Embedding[0] != 0.3 {
+					t.Errorf("embedding = %+v, expected the second embedding", result.Data[1])
+				}
+				if promptToken := int(CalculatePromptToken("hello", "world")); result.Usage.PromptTokens != promptToken || result.Usage.TotalTokens != promptToken {
+					t.Errorf("usage = %+v, expected %d tokens calculated locally", result.Usage, promptToken)
+				}
+			},
+		},
+		{
+			name:        "upstream error",
+			method:      http.POST,
+			path:        "chat/completions",
+			body:        `{"model":"gemini-1.5-pro","messages":[{"role":"user","content":"hi"}]}`,
+			status:      http.StatusBadRequest,
+			contentType: http.ContentTypeJson,
+			response:    `{"error":{"code":400,"message":"API key not valid","status":"INVALID_ARGUMENT"}}`,
+			target:      "/v1beta/models/gemini-1.5-pro:generateContent",
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				result := &entity.OpenaiErrorResponse{}
+				if status != http.StatusBadRequest || json.Unmarshal(payload, result) != nil || result.Error.Message != "API key not valid" {
+					t.Errorf("response = %d %s, expected 400 with the message of gemini", status, payload)
+				}
+			},
+		},
+		{
+			name:        "models",
+			method:      http.GET,
+			path:        "models",
+			status:      http.StatusOK,
+			contentType: http.ContentTypeJson,
+			response:    `{"models":[{"name":"models/gemini-1.5-pro","displayName":"Gemini 1.5 Pro"}]}`,
+			target:      "/v1beta/models",
+			query:       "pageSize=1000",
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				result := &openai.ListModelResponseBody{}
+				if status != http.StatusOK || json.Unmarshal(payload, result) != nil || len(result.Data) != 1 {
+					t.Fatalf("response = %d %s, expected one model", status, payload)
+				}
+				if result.Data[0].ID != "gemini-1.5-pro" || result.Data[0].OwnedBy != model.OpenaiClientProviderGemini {
+					t.Errorf("model = %+v, expected gemini-1.5-pro owned by gemini", result.Data[0])
+				}
+			},
+		},
+		{
+			name:   "unsupported endpoint",
+			method: http.POST,
+			path:   "images/generations",
+			body:   `{"model":"imagen-3","prompt":"a cat"}`,
+			checkResult: func(t *testing.T, status int, payload []byte) {
+				if status != http.StatusNotFound {
+					t.Errorf("response = %d %s, expected 404", status, payload)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newProviderUpstream(t, tt.status, tt.contentType, tt.response)
+			status, payload := executeProvider(t, model.OpenaiClientProviderGemini, upstream.URL, "gemini-key", tt.method, tt.path, http.ContentTypeJson, []byte(tt.body))
+			tt.checkResult(t, status, payload)
+
+			received := upstream.received()
+			if tt.target == "" {
+				if len(received) != 0 {
+					t.Errorf("upstream called %d times, expected none", len(received))
+				}
+				return
+			}
+			if len(received) != 1 {
+				t.Fatalf("upstream called %d times, expected once", len(received))
+			}
+
+			request := received[0]
+			if request.Method != string(tt.method) || request.Path != tt.target || request.Query.Encode() != tt.query {
+				t.Errorf("request = %s %s?%s, expected %s %s?%s", request.Method, request.Path, request.Query.Encode(), tt.method, tt.target, tt.query)
+			}
+			if request.Header.Get("x-goog-api-key") != "gemini-key" || request.Header.Get(http.HeaderAuthorization) != "" {
+				t.Errorf("headers = %v, expected x-goog-api-key only", request.Header)
+			}
+			if tt.checkSent != nil {
+				tt.checkSent(t, request)
+			}
+		})
+	}
+}
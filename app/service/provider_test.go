@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alioth-center/infrastructure/network/http"
+)
+
+// providerRequest is a request received by the fake provider upstream.
+type providerRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header nethttp.Header
+	Body   []byte
+}
+
+// providerUpstream is a fake provider upstream, it records the requests and responds with the fixed response.
+type providerUpstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []providerRequest
+}
+
+func newProviderUpstream(t *testing.T, status int, contentType, response string) *providerUpstream {
+	t.Helper()
+
+	upstream := &providerUpstream{}
+	upstream.Server = httptest.NewServer(nethttp.HandlerFunc(func(writer nethttp.ResponseWriter, request *nethttp.Request) {
+		body, _ := io.ReadAll(request.Body)
+		upstream.mu.Lock()
+		upstream.requests = append(upstream.requests, providerRequest{Method: request.Method, Path: request.URL.Path, Query: request.URL.Query(), Header: request.Header.Clone(), Body: body})
+		upstream.mu.Unlock()
+
+		writer.Header().Set(http.HeaderContentType, contentType)
+		writer.WriteHeader(status)
+		_, _ = writer.Write([]byte(response))
+	}))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+// received returns the requests received by the upstream.
+func (u *providerUpstream) received() []providerRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return append([]providerRequest{}, u.requests...)
+}
+
+// executeProvider sends the openai format request to the client of the provider as the services do, the path is
+// relative to the base url of the client, the translated status and body are returned.
+func executeProvider(t *testing.T, provider, endpoint, apiKey string, method http.Method, path, contentType string, body []byte) (status int, payload []byte) {
+	t.Helper()
+
+	config, executor := NewUpstream(provider, endpoint, apiKey)
+	request, buildErr := nethttp.NewRequest(string(method), strings.TrimSuffix(config.BaseUrl, "/")+"/"+path, bytes.NewReader(body))
+	if buildErr != nil {
+		t.Fatalf("build request failed: %v", buildErr)
+	}
+	if contentType != "" {
+		request.Header.Set(http.HeaderContentType, contentType)
+	}
+	request.Header.Set(http.HeaderAuthorization, "Bearer "+apiKey)
+
+	response, executeErr := executor.ExecuteRawRequest(request)
+	if executeErr != nil {
+		t.Fatalf("execute request failed: %v", executeErr)
+	}
+	defer response.Body.Close()
+
+	payload, readErr := io.ReadAll(response.Body)
+	if readErr != nil {
+		t.Fatalf("read response failed: %v", readErr)
+	}
+
+	return response.StatusCode, payload
+}
+
+// streamPayloads returns the data of the server sent events, the done event is kept as is.
+func streamPayloads(payload []byte) []string {
+	events := make([]string, 0)
+	for _, line := range strings.Split(string(payload), "\n") {
+		if data, found := strings.CutPrefix(line, "data: "); found {
+			events = append(events, data)
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/network/http"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ErrorInsufficientBalance is returned when the balance cannot cover the estimated cost of the request.
+var ErrorInsufficientBalance = errors.New("insufficient balance")
+
+// completionTokenEstimate is the least completion tokens reserved for requests without max tokens.
+const completionTokenEstimate = 256
+
+// BalanceReservations holds the estimated costs of in-flight requests, the held amounts are not spendable
+// by other requests until the real costs are written to the balance records.
+var BalanceReservations = NewReservationLedger()
+
+// ReservationLedger is an in-process ledger of held balances of users and clients. Holds are neither shared with
+// other instances of the gateway nor kept across restarts, instances sharing a database cannot see the holds of each
+// other, so concurrent requests are only kept from overspending within a single instance.
+type ReservationLedger struct {
+	mu      sync.Mutex
+	users   map[int]decimal.Decimal
+	clients map[int]decimal.Decimal
+}
+
+func NewReservationLedger() *ReservationLedger {
+	return &ReservationLedger{users: map[int]decimal.Decimal{}, clients: map[int]decimal.Decimal{}}
+}
+
+// requestReservationKey is the context key of the reservation of the request stored by ReserveClients.
+type requestReservationKey struct{}
+
+// BalanceReservation is an amount held on a user and a client, Release must be called after the request is settled.
+type BalanceReservation struct {
+	ledger   *ReservationLedger
+	userID   int
+	clientID int
+	amount   decimal.Decimal
+	released bool
+
+	// estimate calculates the amount to hold on another client, the amount is kept if it is nil
+	estimate func(metadata *dto.AvailableClientDTO) decimal.Decimal
+}
+
+// UserReserved returns the held amount of the user.
+func (l *ReservationLedger) UserReserved(userID int) decimal.Decimal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.users[userID]
+}
+
+// ClientReserved returns the held amount of the client.
+func (l *ReservationLedger) ClientReserved(clientID int) decimal.Decimal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.clients[clientID]
+}
+
+// Reserve holds the amount on the user and the client of the metadata if both balances minus held amounts cover
+// it, ErrorInsufficientBalance is returned if the balances cannot cover it, and ErrorBalanceReserved is returned
+// if the balances are held by other requests.
+func (l *ReservationLedger) Reserve(metadata *dto.AvailableClientDTO, amount decimal.Decimal) (*BalanceReservation, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if metadata.UserBalance.LessThan(amount) || metadata.ClientBalance.LessThan(amount) {
+		return nil, ErrorInsufficientBalance
+	}
+	if metadata.UserBalance.Sub(l.users[metadata.UserID]).LessThan(amount) || metadata.ClientBalance.Sub(l.clients[metadata.ClientID]).LessThan(amount) {
+		return nil, ErrorBalanceReserved
+	}
+
+	l.users[metadata.UserID] = l.users[metadata.UserID].Add(amount)
+	l.clients[metadata.ClientID] = l.clients[metadata.ClientID].Add(amount)
+	return &BalanceReservation{ledger: l, userID: metadata.UserID, clientID: metadata.ClientID, amount: amount}, nil
+}
+
+// Release gives back the held amount, it is safe to call multiple times.
+func (r *BalanceReservation) Release() {
+	if r == nil {
+		return
+	}
+
+	r.ledger.mu.Lock()
+	defer r.ledger.mu.Unlock()
+
+	if r.released {
+		return
+	}
+	r.ledger.take(r.userID, r.clientID, r.amount)
+	r.released = true
+}
+
+// MoveTo moves the held amount to the client of the metadata, as failover may serve the request with another
+// client or fallback model than the reserved one. The hold is kept on the current client if the balances of the
+// new one cannot cover it, ErrorInsufficientBalance or ErrorBalanceReserved is returned as Reserve does.
+func (r *BalanceReservation) MoveTo(metadata *dto.AvailableClientDTO) error {
+	if r == nil {
+		return nil
+	}
+
+	r.ledger.mu.Lock()
+	defer r.ledger.mu.Unlock()
+
+	amount := r.amount
+	if r.estimate != nil {
+		amount = r.estimate(metadata)
+	}
+	if r.released || (r.clientID == metadata.ClientID && r.amount.Equal(amount)) {
+		return nil
+	}
+
+	// the amount held by this reservation is spendable for itself
+	userReserved, clientReserved := r.ledger.users[metadata.UserID], r.ledger.clients[metadata.ClientID]
+	if metadata.UserID == r.userID {
+		userReserved = userReserved.Sub(r.amount)
+	}
+	if metadata.ClientID == r.clientID {
+		clientReserved = clientReserved.Sub(r.amount)
+	}
+	if metadata.UserBalance.LessThan(amount) || metadata.ClientBalance.LessThan(amount) {
+		return ErrorInsufficientBalance
+	}
+	if metadata.UserBalance.Sub(userReserved).LessThan(amount) || metadata.ClientBalance.Sub(clientReserved).LessThan(amount) {
+		return ErrorBalanceReserved
+	}
+
+	r.ledger.take(r.userID, r.clientID, r.amount)
+	r.ledger.users[metadata.UserID] = r.ledger.users[metadata.UserID].Add(amount)
+	r.ledger.clients[metadata.ClientID] = r.ledger.clients[metadata.ClientID].Add(amount)
+	r.userID, r.clientID, r.amount = metadata.UserID, metadata.ClientID, amount
+	return nil
+}
+
+// take removes the amount from the holds of the user and the client, the caller must hold the lock.
+func (l *ReservationLedger) take(userID, clientID int, amount decimal.Decimal) {
+	if remaining := l.users[userID].Sub(amount); remaining.IsPositive() {
+		l.users[userID] = remaining
+	} else {
+		delete(l.users, userID)
+	}
+	if remaining := l.clients[clientID].Sub(amount); remaining.IsPositive() {
+		l.clients[clientID] = remaining
+	} else {
+		delete(l.clients, clientID)
+	}
+}
+
+// ReserveBalance holds the estimated cost of the request on the selected client.
+func ReserveBalance(metadata *dto.AvailableClientDTO, promptToken, completionToken int64) (*BalanceReservation, error) {
+	reservation, err := BalanceReservations.Reserve(metadata, estimateCost(metadata, promptToken, completionToken))
+	if err != nil {
+		return nil, err
+	}
+
+	reservation.estimate = func(metadata *dto.AvailableClientDTO) decimal.Decimal {
+		return estimateCost(metadata, promptToken, completionToken)
+	}
+	return reservation, nil
+}
+
+func estimateCost(metadata *dto.AvailableClientDTO, promptToken, completionToken int64) decimal.Decimal {
+	promptCost := metadata.ModelPromptPrice.Mul(decimal.NewFromInt(promptToken))
+	completionCost := metadata.ModelCompletionPrice.Mul(decimal.NewFromInt(completionToken))
+
+	return promptCost.Add(completionCost).Div(decimal.NewFromInt(global.Config.App.PriceTokenUnit))
+}
+
+// ReserveClients holds the estimated cost of the request on the first client that can afford it, the clients from
+// the reserved one are returned as the candidates, so the next client or fallback model serves the request if the
+// balances of the selected one cannot cover the estimated cost. The error of the first client is returned if none can.
+// The reservation is stored to the request context, ExecuteWithFailover moves it to the client serving the request.
+func ReserveClients[request any, response any](ctx http.Context[request, response], clients []*dto.AvailableClientDTO, promptToken, completionToken int64) (reserved []*dto.AvailableClientDTO, reservation *BalanceReservation, err error) {
+	return ReserveClientsAmount(ctx, clients, func(metadata *dto.AvailableClientDTO) decimal.Decimal {
+		return estimateCost(metadata, promptToken, completionToken)
+	})
+}
+
+// ReserveClientsAmount holds the amount estimated for each client as ReserveClients does, used by requests not billed
+// by tokens, such as images billed by the price of the size.
+func ReserveClientsAmount[request any, response any](ctx http.Context[request, response], clients []*dto.AvailableClientDTO, estimate func(metadata *dto.AvailableClientDTO) decimal.Decimal) (reserved []*dto.AvailableClientDTO, reservation *BalanceReservation, err error) {
+	for i, client := range clients {
+		clientReservation, reserveErr := BalanceReservations.Reserve(client, estimate(client))
+		if reserveErr == nil {
+			clientReservation.estimate = estimate
+			ctx.SetValue(requestReservationKey{}, clientReservation)
+			return clients[i:], clientReservation, nil
+		}
+		if err == nil {
+			err = reserveErr
+		}
+	}
+
+	return nil, nil, err
+}
+
+// requestReservation returns the reservation of the request stored by ReserveClients, nil if not reserved.
+func requestReservation(ctx context.Context) *BalanceReservation {
+	reservation, _ := ctx.Value(requestReservationKey{}).(*BalanceReservation)
+	return reservation
+}
+
+// EstimateCompletionToken returns the completion tokens to reserve, max tokens of the request is used if it is
+// specified, otherwise the completion is estimated as long as the prompt and at least completionTokenEstimate,
+// both are capped by max_token of the app.
+func EstimateCompletionToken(maxTokens int, promptToken int64) int64 {
+	estimated := max(promptToken, completionTokenEstimate)
+	if maxTokens > 0 {
+		estimated = int64(maxTokens)
+	}
+	if global.Config.App.MaxToken > 0 {
+		estimated = min(estimated, int64(global.Config.App.MaxToken))
+	}
+
+	return estimated
+}
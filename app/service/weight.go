@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alioth-center/akasha-whisper/app/global"
+	"github.com/alioth-center/akasha-whisper/app/model"
+	"github.com/alioth-center/akasha-whisper/app/model/dto"
+	"github.com/alioth-center/infrastructure/logger"
+	"github.com/alioth-center/infrastructure/trace"
+	"github.com/alioth-center/infrastructure/utils/values"
+)
+
+// weightTuningLatencyFloor is added to the latencies before comparing, so differences of a few milliseconds between
+// fast upstreams do not change the weights.
+const weightTuningLatencyFloor = 50 * time.Millisecond
+
+// default bounds of the effective weight as factors of the manual weight, used if the client does not set them.
+const (
+	defaultWeightMinFactor = 0.1
+	defaultWeightMaxFactor = 2
+)
+
+// ClientWeightTuner adjusts the effective weights of the clients from live traffic, keyed by client id.
+var ClientWeightTuner = NewWeightTuner()
+
+// WeightTuner periodically scales the manual weight of each client by its error rate, 429 rate, latency and remaining
+// balance compared with the other clients, bounded by weight_min_factor and weight_max_factor of the client. The
+// manual weight stays the baseline, clients are routed with the manual weight until they are tuned.
+type WeightTuner struct {
+	mu      sync.RWMutex
+	weights map[int]tunedWeight
+}
+
+type tunedWeight struct {
+	manual    int64
+	effective int64
+}
+
+func NewWeightTuner() *WeightTuner {
+	return &WeightTuner{weights: map[int]tunedWeight{}}
+}
+
+// StartWeightTuning tunes the client weights every weight_tuning_interval seconds, nothing is done if disabled.
+func StartWeightTuning() {
+	if global.Config.App.WeightTuningInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(global.Config.App.WeightTuningInterval) * time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			ClientWeightTuner.Tune(trace.NewContext())
+		}
+	}()
+}
+
+// EffectiveWeight returns the tuned weight of the client, the manual weight if the client is not tuned or the
+// manual weight is changed after tuning.
+func (t *WeightTuner) EffectiveWeight(clientID int, weight int64) int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tuned, exist := t.weights[clientID]
+	if !exist || tuned.manual != weight {
+		return weight
+	}
+
+	return tuned.effective
+}
+
+// Tune calculates the effective weights of all clients and records the changed ones, changes less than 5% of the
+// current weight are ignored, so the weights do not jitter with the moving averages.
+func (t *WeightTuner) Tune(ctx context.Context) {
+	clients, listErr := global.OpenaiClientDatabaseInstance.ListClients(ctx)
+	if listErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("list clients for weight tuning failed").WithData(listErr))
+		return
+	}
+
+	// latency and balance are compared with the averages of the clients
+	latencies, balances := make([]float64, 0, len(clients)), make([]float64, 0, len(clients))
+	for _, client := range clients {
+		if health := ClientHealth.Snapshot(client.ClientID); health.Requests > 0 && health.Latency > 0 {
+			latencies = append(latencies, float64(health.Latency))
+		}
+		if client.ClientWeight > 0 {
+			balances = append(balances, max(client.ClientBalance.InexactFloat64(), 0))
+		}
+	}
+	averageLatency, averageBalance := average(latencies), average(balances)
+
+	weights, records := make(map[int]tunedWeight, len(clients)), make([]*model.OpenaiClientWeight, 0)
+	for _, client := range clients {
+		manual := int64(client.ClientWeight)
+		if manual <= 0 {
+			// clients without weight are only used for failover, they are never tuned
+			continue
+		}
+
+		health := ClientHealth.Snapshot(client.ClientID)
+		latencyFactor := 1.0
+		if health.Requests > 0 && health.Latency > 0 && averageLatency > 0 {
+			latencyFactor = (averageLatency + float64(weightTuningLatencyFloor)) / float64(health.Latency+weightTuningLatencyFloor)
+			latencyFactor = min(max(latencyFactor, 0.5), 2)
+		}
+		balanceFactor := 1.0
+		if averageBalance > 0 {
+			balanceFactor = min(max(max(client.ClientBalance.InexactFloat64(), 0)/averageBalance, 0.5), 2)
+		}
+		factor := (1 - health.ErrorRate) * (1 - health.RateLimitRate) * latencyFactor * balanceFactor
+		factor = min(max(factor, client.WeightMinFactor), client.WeightMaxFactor)
+
+		previous := t.EffectiveWeight(client.ClientID, manual)
+		effective := max(int64(math.Round(float64(manual)*factor)), 1)
+		if math.Abs(float64(effective-previous))*20 < float64(previous) {
+			effective = previous
+		}
+		weights[client.ClientID] = tunedWeight{manual: manual, effective: effective}
+		if effective == previous {
+			continue
+		}
+
+		records = append(records, &model.OpenaiClientWeight{
+			ClientID:        int64(client.ClientID),
+			Weight:          int(manual),
+			PreviousWeight:  int(previous),
+			EffectiveWeight: int(effective),
+			ErrorRate:       health.ErrorRate,
+			RateLimitRate:   health.RateLimitRate,
+			LatencyMs:       health.Latency.Milliseconds(),
+			Reason: values.BuildStrings(
+				"error_rate ", formatFactor(health.ErrorRate), ", rate_limit_rate ", formatFactor(health.RateLimitRate),
+				", latency_factor ", formatFactor(latencyFactor), ", balance_factor ", formatFactor(balanceFactor),
+			),
+		})
+	}
+
+	t.mu.Lock()
+	t.weights = weights
+	t.mu.Unlock()
+
+	if len(records) == 0 {
+		return
+	}
+	if createErr := global.OpenaiClientWeightDatabaseInstance.CreateWeightRecords(ctx, records); createErr != nil {
+		global.Logger.Error(logger.NewFields(ctx).WithMessage("record client weights failed").WithData(createErr))
+	}
+	global.Logger.Info(logger.NewFields(ctx).WithMessage("client weights tuned").WithData(records))
+}
+
+// applyEffectiveWeights replaces the manual weights of the clients with the tuned weights.
+func applyEffectiveWeights(clients []*dto.AvailableClientDTO) {
+	for _, client := range clients {
+		client.ClientWeight = ClientWeightTuner.EffectiveWeight(client.ClientID, client.ClientWeight)
+	}
+}
+
+func average(items []float64) float64 {
+	if len(items) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, item := range items {
+		sum += item
+	}
+
+	return sum / float64(len(items))
+}
+
+func formatFactor(factor float64) string {
+	return strconv.FormatFloat(factor, 'f', 2, 64)
+}